@@ -1,21 +1,217 @@
 package main
 
 import(
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
 	"utility"
 	"opensock"
-	"time"
 )
+
+const usage = `opensock is a socks5 proxy with an encrypted tunnel
+
+Usage:
+  opensock run [-c opensock.cfg] [-mode client|server|standard] [-bind ip:port] [-log-level DBG|INFO|WARN|ERR] [-log-dir dir]
+  opensock check [-c opensock.cfg]
+  opensock genkey [-bytes 32]
+  opensock speedtest [-c opensock.cfg] [-server ip:port] [-key key] [-user name] [-password pw] [-pings 10] [-bytes 10485760]
+  opensock trace <trace-id> [log and access log files...]
+  opensock version
+
+Without a command, or with only the flags of run, opensock runs: "opensock -c file"
+is "opensock run -c file".
+Use "opensock <command> -h" for the flags of a command.
+`
+
 func main(){
+	os.Exit(runCommand(os.Args[1:]))
+}
 
-	log := utility.NewLog("opensock", "DBG", 500000, "")
-	/*
-	logCtx := utility.NewLogContext(0, log)
-	go netcore.TcpServer("0.0.0.0", 22222, logCtx, opensock.ClientInit)
-	*/
-	server := opensock.NewSockServer(log)
-	server.Main()
-	for{
-		time.Sleep(time.Second * 10)
+func runCommand(args []string) int{
+	if len(args) == 0{
+		return run(nil)
 	}
+	switch args[0]{
+	case "run":
+		return run(args[1:])
+	case "check":
+		return check(args[1:])
+	case "genkey":
+		return genkey(args[1:])
+	case "speedtest":
+		return speedtest(args[1:])
+	case "trace":
+		return trace(args[1:])
+	case "version":
+		fmt.Println("opensock", opensock.Version)
+		return opensock.ExitOK
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+		return opensock.ExitOK
+	}
+	if strings.HasPrefix(args[0], "-"){
+		return run(args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command:%s\n\n%s", args[0], usage)
+	return opensock.ExitUsage
+}
 
-}
\ No newline at end of file
+//parse parse the flags of a command, it returns false after printing the usage
+func parse(fs *flag.FlagSet, args []string) (bool, int){
+	fs.SetOutput(os.Stderr)
+	if err := fs.Parse(args); err != nil{
+		if err == flag.ErrHelp{
+			return false, opensock.ExitOK
+		}
+		return false, opensock.ExitUsage
+	}
+	if fs.NArg() > 0{
+		fmt.Fprintf(os.Stderr, "unexpected arguments:%s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return false, opensock.ExitUsage
+	}
+	return true, opensock.ExitOK
+}
+
+//logLevel map the level names accepted on the command line to the ones of utility
+func logLevel(level string) (string, bool){
+	level = strings.ToUpper(level)
+	switch level{
+	case "DEBUG":
+		return "DBG", true
+	case "WARNING":
+		return "WARN", true
+	case "ERROR":
+		return "ERR", true
+	case "DBG", "INFO", "NOTICE", "WARN", "ERR":
+		return level, true
+	}
+	return "", false
+}
+
+func run(args []string) int{
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	config := fs.String("c", opensock.DefaultConfigFile, "the config file")
+	mode := fs.String("mode", "", "override the mode of the config: client, server or standard")
+	bind := fs.String("bind", "", "override the bindaddr of the config")
+	level := fs.String("log-level", "DBG", "the log level: DBG, INFO, NOTICE, WARN or ERR")
+	logDir := fs.String("log-dir", "", "the directory of the log file, the current one by default")
+	if ok, status := parse(fs, args); !ok{
+		return status
+	}
+	lv, ok := logLevel(*level)
+	if !ok{
+		fmt.Fprintf(os.Stderr, "invalid log level:%s\n", *level)
+		return opensock.ExitUsage
+	}
+	log := utility.NewLog("opensock", lv, 500000, *logDir)
+	server := opensock.NewSockServerWithOptions(log, &opensock.Options{
+		Config: *config,
+		Mode: *mode,
+		BindAddr: *bind,
+	})
+	return server.Main()
+}
+
+func check(args []string) int{
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	config := fs.String("c", opensock.DefaultConfigFile, "the config file")
+	if ok, status := parse(fs, args); !ok{
+		return status
+	}
+	if err := opensock.CheckConfig(*config); err != nil{
+		fmt.Fprintln(os.Stderr, err)
+		return opensock.ExitFailed
+	}
+	fmt.Printf("%s ok\n", *config)
+	return opensock.ExitOK
+}
+
+//genkey print a random key for the tunnel
+func genkey(args []string) int{
+	fs := flag.NewFlagSet("genkey", flag.ContinueOnError)
+	size := fs.Int("bytes", 32, "the random bytes in the key, 16 to 192")
+	if ok, status := parse(fs, args); !ok{
+		return status
+	}
+	if *size < 16 || *size > 192{
+		fmt.Fprintln(os.Stderr, "bytes must be between 16 and 192")
+		return opensock.ExitUsage
+	}
+	key := make([]byte, *size)
+	if _, err := rand.Read(key); err != nil{
+		fmt.Fprintln(os.Stderr, "failed to generate key:", err)
+		return opensock.ExitFailed
+	}
+	fmt.Println(base64.RawURLEncoding.EncodeToString(key))
+	return opensock.ExitOK
+}
+
+//speedtest measure the tunnel to a server, the flags override the serverip,
+//key, user and password of the config
+func speedtest(args []string) int{
+	fs := flag.NewFlagSet("speedtest", flag.ContinueOnError)
+	config := fs.String("c", "", "the config file, "+opensock.DefaultConfigFile+" when -server is not given")
+	server := fs.String("server", "", "the tunnel server ip:port")
+	key := fs.String("key", "", "the key of the tunnel")
+	user := fs.String("user", "", "the user of the tunnel handshake")
+	password := fs.String("password", "", "the password of the user")
+	pings := fs.Int("pings", 10, "the round trips measured")
+	size := fs.Int64("bytes", 10*1024*1024, "the bytes downloaded then uploaded")
+	if ok, status := parse(fs, args); !ok{
+		return status
+	}
+	if *config == "" && *server == ""{
+		*config = opensock.DefaultConfigFile
+	}
+	res, err := opensock.SpeedTest(&opensock.SpeedTestOptions{
+		Config: *config,
+		Server: *server,
+		Key: *key,
+		User: *user,
+		Password: *password,
+		Pings: *pings,
+		Bytes: *size,
+	})
+	if err != nil{
+		fmt.Fprintln(os.Stderr, "speed test failed:", err)
+		return opensock.ExitFailed
+	}
+	res.Print(os.Stdout)
+	return opensock.ExitOK
+}
+
+//trace print the story of one session from the logs of the client and the
+//server, the files default to those of opensock.log and access.log found in
+//the current directory
+func trace(args []string) int{
+	if len(args) == 0 || strings.HasPrefix(args[0], "-"){
+		fmt.Fprintln(os.Stderr, "usage: opensock trace <trace-id> [log and access log files...]")
+		return opensock.ExitUsage
+	}
+	files := args[1:]
+	if len(files) == 0{
+		for _, file := range []string{"opensock.log", "access.log"}{
+			if _, err := os.Stat(file); err == nil{
+				files = append(files, file)
+			}
+		}
+		if len(files) == 0{
+			fmt.Fprintln(os.Stderr, "no opensock.log or access.log in the current directory")
+			return opensock.ExitFailed
+		}
+	}
+	n, err := opensock.FindTrace(args[0], files, os.Stdout)
+	if err != nil{
+		fmt.Fprintln(os.Stderr, err)
+		return opensock.ExitFailed
+	}
+	if n == 0{
+		fmt.Fprintf(os.Stderr, "no line with trace:%s\n", args[0])
+		return opensock.ExitFailed
+	}
+	return opensock.ExitOK
+}
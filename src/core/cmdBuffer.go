@@ -1,6 +1,7 @@
 //GetHead get element at tail
 package core
 
+import "sync/atomic"
 import "time"
 import "utility"
 
@@ -14,6 +15,8 @@ type CmdList struct {
 	name string
 	log  *utility.LogContext
 	//waitGroup *sync.WaitGroup
+	buffered  int64  //size for the readers outside the pump goroutine
+	discarded uint64 //cmds dropped after cmdTTL
 }
 type CmdContainor interface {
 }
@@ -28,6 +31,7 @@ func (l *CmdList) deQueue() {
 		return
 	}
 	l.size--
+	atomic.StoreInt64(&l.buffered, int64(l.size))
 	//cmd := l.head.cmd
 	l.head = l.head.next
 }
@@ -36,6 +40,7 @@ func (l *CmdList) deQueue() {
 func (l *CmdList) pushFront(cmd *Client_cmd) {
 	node := &listNode{cmd: cmd, next: nil, enQueueTime: time.Now()}
 	l.size++
+	atomic.StoreInt64(&l.buffered, int64(l.size))
 	if l.head == nil {
 		l.head = node
 		l.tail = node
@@ -46,11 +51,11 @@ func (l *CmdList) pushFront(cmd *Client_cmd) {
 	l.size++
 }
 */
+//getFront return the element at head without removing it
 func (l *CmdList) getFront() *listNode {
 	if l.size == 0 {
 		return nil
 	}
-	l.size--
 	return l.head
 }
 
@@ -58,6 +63,7 @@ func (l *CmdList) getFront() *listNode {
 func (l *CmdList) enQueue(cmd CmdContainer) {
 	node := &listNode{cmd: cmd, next: nil, enQueueTime: time.Now()}
 	l.size++
+	atomic.StoreInt64(&l.buffered, int64(l.size))
 	if l.head == nil {
 		l.head = node
 		l.tail = node
@@ -73,6 +79,12 @@ func (l *CmdList) length() int {
 	return l.size
 }
 
+//Stats return the number of buffered cmds and how many cmds are discarded,
+//it's safe to call from any goroutine
+func (l *CmdList) Stats() (int, uint64) {
+	return int(atomic.LoadInt64(&l.buffered)), atomic.LoadUint64(&l.discarded)
+}
+
 //PumpCmd forward cmd from one channel to another channel
 func (l *CmdList) PumpCmd(inChan <-chan CmdContainer, outChan chan<- CmdContainer) {
 	log := l.log
@@ -95,6 +107,7 @@ func (l *CmdList) PumpCmd(inChan <-chan CmdContainer, outChan chan<- CmdContaine
 			for oldCmd := l.getFront(); oldCmd != nil; oldCmd = l.getFront() {
 				if now.After(oldCmd.enQueueTime.Add(cmdTTL * time.Second)) {
 					l.deQueue()
+					atomic.AddUint64(&l.discarded, 1)
 					log.LogWarn("discard cmd:%d", oldCmd.cmd.GetFromID())
 					continue
 				}
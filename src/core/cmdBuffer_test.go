@@ -0,0 +1,36 @@
+package core
+
+import (
+	"strconv"
+	"testing"
+)
+
+type testCmd uint32
+
+func (c testCmd) GetFromID() uint32 { return uint32(c) }
+func (c testCmd) GetToID() uint32   { return 0 }
+func (c testCmd) GetType() uint32   { return 0 }
+func (c testCmd) String() string    { return strconv.Itoa(int(c)) }
+
+//TestCmdList the pump loop gets every buffered cmd in order, getFront doesn't
+//take one off the size before deQueue
+func TestCmdList(t *testing.T) {
+	l := &CmdList{}
+	for i := 1; i <= 3; i++ {
+		l.enQueue(testCmd(i))
+		if buffered, _ := l.Stats(); buffered != i {
+			t.Fatalf("%d buffered after %d cmds", buffered, i)
+		}
+	}
+	var got []uint32
+	for front := l.getFront(); front != nil; front = l.getFront() {
+		got = append(got, front.cmd.GetFromID())
+		l.deQueue()
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 3 {
+		t.Fatalf("cmds %v", got)
+	}
+	if buffered, _ := l.Stats(); buffered != 0 || l.length() != 0 {
+		t.Fatalf("%d buffered, length %d after the pump", buffered, l.length())
+	}
+}
@@ -79,6 +79,29 @@ type routeCmd struct {
 var msgIDSrc uint64
 var routeCtx *RouteContext
 
+//RouteStats the queue lengths of the route
+type RouteStats struct {
+	CmdQueue      int
+	RegisterQueue int
+	CmdBuffered   int
+	CmdDiscarded  uint64
+}
+
+//GetRouteStats return the queue lengths of the route, zero when no route is created
+func GetRouteStats() RouteStats {
+	r := routeCtx
+	if r == nil {
+		return RouteStats{}
+	}
+	buffered, discarded := r.cmdPool.Stats()
+	return RouteStats{
+		CmdQueue:      len(r.cmdChan),
+		RegisterQueue: len(r.registerChan),
+		CmdBuffered:   buffered,
+		CmdDiscarded:  discarded,
+	}
+}
+
 //NewRouteMsg create a route message
 func NewRouteMsg(from, to uint32, cmd uint16, msg interface{}, route_cmd int) *RouteMsg {
 	return &RouteMsg{
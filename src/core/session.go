@@ -1,5 +1,10 @@
 package core
 
+import (
+	"errors"
+	"net"
+)
+
 type Frame interface {
 }
 
@@ -7,4 +12,40 @@ type Frame interface {
 type Session interface{
 	ReadProc([]byte)(int, []byte, error)
 	UpdateProc()([]byte, error)
-}
\ No newline at end of file
+}
+
+//SessionCloser is implemented by the session which need to release resources
+//when its connection exits
+type SessionCloser interface{
+	CloseProc()
+}
+
+//SessionHalfCloser is implemented by the session which keep the connection after
+//the peer shut down its sending side. The connection stops reading but is still
+//updated until UpdateProc shuts down the sending side too. An error closes the
+//connection at once
+type SessionHalfCloser interface{
+	ShutdownProc() error
+}
+
+//SessionResetter is implemented by the session which need to know the peer reset
+//the connection, ResetProc is called before CloseProc
+type SessionResetter interface{
+	ResetProc()
+}
+
+//SessionDetacher is implemented by the session which take over the raw connection.
+//When ReadProc returns ErrDetach the reply is written, then the connection stops
+//without closing and DetachProc runs in a new goroutine with the bytes not consumed
+type SessionDetacher interface{
+	DetachProc(conn net.Conn, buffered []byte)
+}
+
+var (
+	//ErrDetach is returned by ReadProc to hand the connection over to the session
+	ErrDetach = errors.New("detach")
+	//ErrCloseWrite is returned by UpdateProc to shut down the sending side after the data is written
+	ErrCloseWrite = errors.New("close write")
+	//ErrReset is returned by UpdateProc to abort the connection with a reset
+	ErrReset = errors.New("reset")
+)
@@ -0,0 +1,294 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"utility"
+)
+
+const (
+	defaultBanWindow = 60
+	defaultBanTime   = 300
+	purgeThreshold   = 1024
+)
+
+var (
+	errTooManySessions = errors.New("too many sessions")
+	errTooManyPerIP    = errors.New("too many sessions from the address")
+	errBanned          = errors.New("address is banned")
+)
+
+//AdmissionConfig limits the connections accepted by a server, 0 means unlimited.
+//AcceptRate is in connections per second. A source is banned for BanTime seconds
+//after BanThreshold handshake failures within BanWindow seconds
+type AdmissionConfig struct {
+	MaxSessions  int `json:"maxsessions"`
+	MaxPerIP     int `json:"maxperip"`
+	MaxPerUser   int `json:"maxperuser"`
+	AcceptRate   int `json:"acceptrate"`
+	AcceptBurst  int `json:"acceptburst"`
+	BanThreshold int `json:"banthreshold"`
+	BanWindow    int `json:"banwindow"`
+	BanTime      int `json:"bantime"`
+}
+
+//Validate check the config values
+func (c *AdmissionConfig) Validate() error {
+	for _, v := range []int{c.MaxSessions, c.MaxPerIP, c.MaxPerUser, c.AcceptRate,
+		c.AcceptBurst, c.BanThreshold, c.BanWindow, c.BanTime} {
+		if v < 0 {
+			return errors.New("negative admission limit")
+		}
+	}
+	return nil
+}
+
+//AdmissionStats the counters of an admission controller
+type AdmissionStats struct {
+	Active         int    `json:"active"`
+	Accepted       uint64 `json:"accepted"`
+	RejectedMax    uint64 `json:"rejectedmax"`
+	RejectedIP     uint64 `json:"rejectedip"`
+	RejectedUser   uint64 `json:"rejecteduser"`
+	RejectedBanned uint64 `json:"rejectedbanned"`
+	Bans           uint64 `json:"bans"`
+	Throttled      uint64 `json:"throttled"`
+	Banned         int    `json:"banned"`
+}
+
+type failureRecord struct {
+	count int
+	first time.Time
+}
+
+//Admission decide whether a new connection is accepted. A nil Admission accepts everything
+type Admission struct {
+	cfg      AdmissionConfig
+	lock     sync.Mutex
+	perIP    map[string]int
+	perUser  map[string]int
+	failures map[string]*failureRecord
+	banned   map[string]time.Time
+	rate     *utility.TokenBucket
+	stats    AdmissionStats
+}
+
+//admittedConn release the admission slot when it's closed
+type admittedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *admittedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+//CloseWrite shut down the sending side of the connection under it
+func (c *admittedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write unsupported")
+}
+
+//NewAdmission create an admission controller, it returns nil without config
+func NewAdmission(cfg *AdmissionConfig) *Admission {
+	if cfg == nil {
+		return nil
+	}
+	a := &Admission{
+		perIP:    make(map[string]int),
+		perUser:  make(map[string]int),
+		failures: make(map[string]*failureRecord),
+		banned:   make(map[string]time.Time),
+	}
+	a.setConfig(cfg)
+	return a
+}
+
+func (a *Admission) setConfig(cfg *AdmissionConfig) {
+	a.cfg = *cfg
+	a.rate = utility.NewTokenBucket(int64(cfg.AcceptRate), int64(cfg.AcceptBurst))
+	if a.cfg.BanWindow <= 0 {
+		a.cfg.BanWindow = defaultBanWindow
+	}
+	if a.cfg.BanTime <= 0 {
+		a.cfg.BanTime = defaultBanTime
+	}
+}
+
+//Update replace the limits, the sessions already admitted are kept. A nil
+//config removes the limits
+func (a *Admission) Update(cfg *AdmissionConfig) {
+	if a == nil {
+		return
+	}
+	if cfg == nil {
+		cfg = &AdmissionConfig{}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.setConfig(cfg)
+}
+
+//AddrIP return the ip part of an address
+func AddrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+//waitAccept sleep until the accept rate allows a new connection
+func (a *Admission) waitAccept() {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	rate := a.rate
+	a.lock.Unlock()
+	if utility.WaitTokens(1, rate) > 0 {
+		a.lock.Lock()
+		a.stats.Throttled++
+		a.lock.Unlock()
+	}
+}
+
+//Admit check the limits for a new connection. The returned connection must be
+//used instead of conn, closing it releases the slot
+func (a *Admission) Admit(conn net.Conn) (net.Conn, error) {
+	if a == nil {
+		return conn, nil
+	}
+	ip := AddrIP(conn.RemoteAddr())
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if until, ok := a.banned[ip]; ok {
+		if now.Before(until) {
+			a.stats.RejectedBanned++
+			return nil, errBanned
+		}
+		delete(a.banned, ip)
+	}
+	if a.cfg.MaxSessions > 0 && a.stats.Active >= a.cfg.MaxSessions {
+		a.stats.RejectedMax++
+		return nil, errTooManySessions
+	}
+	if a.cfg.MaxPerIP > 0 && a.perIP[ip] >= a.cfg.MaxPerIP {
+		a.stats.RejectedIP++
+		return nil, errTooManyPerIP
+	}
+	a.stats.Active++
+	a.stats.Accepted++
+	a.perIP[ip]++
+	return &admittedConn{Conn: conn, release: func() { a.release(ip) }}, nil
+}
+
+func (a *Admission) release(ip string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.stats.Active--
+	if a.perIP[ip] <= 1 {
+		delete(a.perIP, ip)
+		return
+	}
+	a.perIP[ip]--
+}
+
+//AdmitUser take one of the sessions allowed for the user
+func (a *Admission) AdmitUser(name string) bool {
+	if a == nil {
+		return true
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cfg.MaxPerUser <= 0 {
+		return true
+	}
+	if a.perUser[name] >= a.cfg.MaxPerUser {
+		a.stats.RejectedUser++
+		return false
+	}
+	a.perUser[name]++
+	return true
+}
+
+//ReleaseUser give back a session taken by AdmitUser. It doesn't look at the
+//limit, the sessions taken before a reload removing it are still given back
+func (a *Admission) ReleaseUser(name string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.perUser[name] <= 1 {
+		delete(a.perUser, name)
+		return
+	}
+	a.perUser[name]--
+}
+
+//HandshakeFailed count a failure of the source, it's banned when there are too many
+func (a *Admission) HandshakeFailed(addr net.Addr) bool {
+	if a == nil {
+		return false
+	}
+	ip := AddrIP(addr)
+	now := time.Now()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.cfg.BanThreshold <= 0 {
+		return false
+	}
+	window := time.Duration(a.cfg.BanWindow) * time.Second
+	if len(a.failures)+len(a.banned) > purgeThreshold {
+		a.purge(now)
+	}
+	r, ok := a.failures[ip]
+	if !ok || now.Sub(r.first) > window {
+		r = &failureRecord{first: now}
+		a.failures[ip] = r
+	}
+	r.count++
+	if r.count < a.cfg.BanThreshold {
+		return false
+	}
+	delete(a.failures, ip)
+	a.banned[ip] = now.Add(time.Duration(a.cfg.BanTime) * time.Second)
+	a.stats.Bans++
+	return true
+}
+
+//purge drop the expired records, the lock must be held
+func (a *Admission) purge(now time.Time) {
+	window := time.Duration(a.cfg.BanWindow) * time.Second
+	for ip, r := range a.failures {
+		if now.Sub(r.first) > window {
+			delete(a.failures, ip)
+		}
+	}
+	for ip, until := range a.banned {
+		if now.After(until) {
+			delete(a.banned, ip)
+		}
+	}
+}
+
+//Stats return a copy of the counters
+func (a *Admission) Stats() AdmissionStats {
+	if a == nil {
+		return AdmissionStats{}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.purge(time.Now())
+	st := a.stats
+	st.Banned = len(a.banned)
+	return st
+}
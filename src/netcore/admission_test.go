@@ -0,0 +1,100 @@
+package netcore
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+//tcpPair a connected pair of tcp connections on loopback
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, server
+}
+
+//TestAdmittedCloseWrite an admitted connection shuts down its sending side
+//only, the peer can still send, and closing it releases the slot
+func TestAdmittedCloseWrite(t *testing.T) {
+	a := NewAdmission(&AdmissionConfig{MaxPerIP: 1})
+	client, server := tcpPair(t)
+	conn, err := a.Admit(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Admit(server); err != errTooManyPerIP {
+		t.Fatalf("second connection err:%v", err)
+	}
+	if tcp, ok := TCPConn(conn); !ok || tcp != server {
+		t.Fatal("the tcp connection under the admitted one not found")
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("no CloseWrite on the admitted connection")
+	}
+	conn.Write([]byte("bye"))
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(client); err != nil || string(data) != "bye" {
+		t.Fatalf("the peer read %q err:%v", data, err)
+	}
+	client.Write([]byte("still open"))
+	client.CloseWrite()
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "still open" {
+		t.Fatalf("read %q after the half close err:%v", data, err)
+	}
+	conn.Close()
+	conn.Close()
+	if s := a.Stats(); s.Active != 0 || s.Accepted != 1 || s.RejectedIP != 1 {
+		t.Fatalf("stats %+v", s)
+	}
+}
+
+//TestAdmissionUpdate the limits change under the sessions checking them, the
+//users admitted before a reload are released after it
+func TestAdmissionUpdate(t *testing.T) {
+	a := NewAdmission(&AdmissionConfig{MaxPerUser: 1, BanThreshold: 1000})
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			a.Update(&AdmissionConfig{MaxPerUser: 1 + i%2, BanThreshold: 1000})
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		if a.AdmitUser("alice") {
+			a.ReleaseUser("alice")
+		}
+		a.HandshakeFailed(addr)
+	}
+	<-done
+	if !a.AdmitUser("alice") {
+		t.Fatal("the slot of the user is still taken")
+	}
+	a.Update(&AdmissionConfig{})
+	a.ReleaseUser("alice")
+	a.Update(&AdmissionConfig{MaxPerUser: 1})
+	if !a.AdmitUser("alice") || a.AdmitUser("alice") {
+		t.Fatal("the slot taken before the reload wasn't given back")
+	}
+}
@@ -3,7 +3,9 @@ package netcore
 import (
 	"core"
 	"errors"
+	"io"
 	"net"
+	"sync/atomic"
 	"time"
 	"utility"
 )
@@ -17,7 +19,7 @@ type Connection struct {
 	//conn          *net.TCPConn
 	conn 		  net.Conn
 	rbuf          *DataBuffer
-	wbuf          *DataBuffer
+	readSize      int //the size of the next receive buffer taken from the pool
 	addr          string
 	err           error
 	state         int
@@ -28,20 +30,27 @@ type Connection struct {
 	recvTimeout   time.Duration
 	protocol      core.Protocol
 	closeSignal   chan bool
+	readClosed    bool  //the peer shut down its sending side
+	writeClosed   bool  //our sending side is shut down
+	reset         bool  //the connection exits with a reset
+	abort         int32 //Abort is called
+	detached      bool  //the session took over the connection
 }
 
 const (
 	maxBufferSize      = 16384 * 2
 	maxRequestSize     = 16384
+	initialReadSize    = 4096
 	DefaultRecvTimeout = 50
 )
 
 func NewConnection(conn net.Conn, session core.Session, log *utility.LogContext) *Connection {
-	//conn.SetNoDelay(true)
+	//the nodelay, the keepalive and the buffers of conn are set by its listener
+	//or its dialer, go enables the nodelay by default
 	myConn := &Connection{
 		conn:        conn,
-		rbuf:        &DataBuffer{make([]byte, maxBufferSize), maxBufferSize, 0},
-		wbuf:        &DataBuffer{make([]byte, maxBufferSize), maxBufferSize, 0},
+		rbuf:        &DataBuffer{},
+		readSize:    initialReadSize,
 		addr:        conn.RemoteAddr().String(),
 		state:       0,
 		session:     session,
@@ -74,11 +83,28 @@ func logErrFrame(data []byte, ctx *Client) {
 //return false when encouter some error
 func (conn *Connection) handleReply(data []byte, err error) bool {
 	log := conn.log
-	if err != nil {
+	if err == core.ErrReset {
+		log.LogInfo("reset connection:%s", conn.addr)
+		conn.reset = true
+		return false
+	}
+	if err != nil && err != core.ErrCloseWrite {
 		log.LogWarn("err:%v", err)
 		return false
 	}
-	if data == nil {
+	if data != nil && !conn.write(data) {
+		return false
+	}
+	if err == core.ErrCloseWrite {
+		return conn.closeWrite()
+	}
+	return true
+}
+
+func (conn *Connection) write(data []byte) bool {
+	log := conn.log
+	if conn.writeClosed {
+		log.LogWarn("drop %d bytes after the sending side is shut down", len(data))
 		return true
 	}
 	c := conn.conn
@@ -89,12 +115,102 @@ func (conn *Connection) handleReply(data []byte, err error) bool {
 		return false
 	} else if err != nil {
 		log.LogWarn("%s", err.Error())
-		return true
+		conn.notifyReset()
+		return false
 	}
 	log.LogDebug("Write bytes:%d", wBytes)
 	return true
 }
 
+//closeWrite shut down the sending side, it returns false when both sides are closed
+func (conn *Connection) closeWrite() bool {
+	if conn.writeClosed {
+		return !conn.readClosed
+	}
+	conn.writeClosed = true
+	cw, ok := conn.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return false
+	}
+	if err := cw.CloseWrite(); err != nil {
+		conn.log.LogWarn("close write on connection:%s err:%v", conn.addr, err)
+		return false
+	}
+	conn.log.LogDebug("shut down the sending side of connection:%s", conn.addr)
+	return !conn.readClosed
+}
+
+//shutdownRead handle the EOF from the peer, it returns false when the connection
+//should exit. The session is told even when the sending side is already shut
+//down, so the data it got from the peer still reaches the other end
+func (conn *Connection) shutdownRead() bool {
+	halfCloser, ok := conn.session.(core.SessionHalfCloser)
+	if !ok {
+		return false
+	}
+	conn.readClosed = true
+	if err := halfCloser.ShutdownProc(); err != nil {
+		conn.log.LogInfo("close connection:%s after shutdown err:%v", conn.addr, err)
+		return false
+	}
+	return !conn.writeClosed
+}
+
+//detach hand the connection over to the session
+func (conn *Connection) detach(buffered []byte) {
+	detacher, ok := conn.session.(core.SessionDetacher)
+	if !ok {
+		conn.log.LogWarn("session on connection:%s can't be detached", conn.addr)
+		return
+	}
+	conn.conn.SetDeadline(time.Time{})
+	conn.detached = true
+	rest := make([]byte, len(buffered))
+	copy(rest, buffered)
+	go detacher.DetachProc(conn.conn, rest)
+}
+
+//readBuffer return the receive buffer with free space. It's taken from the pool
+//when needed and grows up to maxBufferSize when the data arrives fast
+func (conn *Connection) readBuffer() *DataBuffer {
+	rBuf := conn.rbuf
+	if rBuf.data == nil {
+		rBuf.data = utility.GetBuffer(conn.readSize)
+	} else if rBuf.dataLen == len(rBuf.data) && len(rBuf.data) < maxBufferSize {
+		data := utility.GetBuffer(maxBufferSize)
+		copy(data, rBuf.data[:rBuf.dataLen])
+		utility.PutBuffer(rBuf.data)
+		rBuf.data = data
+	}
+	rBuf.size = len(rBuf.data)
+	return rBuf
+}
+
+//adjustReadSize pick the size of the next receive buffer after reading n bytes
+func (conn *Connection) adjustReadSize(n int, free int) {
+	if n == free {
+		conn.readSize = maxBufferSize
+	} else if n <= initialReadSize/2 {
+		conn.readSize = initialReadSize
+	}
+}
+
+//releaseBuffer give the receive buffer back to the pool when it's empty
+func (conn *Connection) releaseBuffer() {
+	rBuf := conn.rbuf
+	if rBuf.data != nil && rBuf.dataLen == 0 {
+		utility.PutBuffer(rBuf.data)
+		rBuf.data = nil
+	}
+}
+
+//notifyReset tell the session the peer reset the connection
+func (conn *Connection) notifyReset() {
+	if resetter, ok := conn.session.(core.SessionResetter); ok {
+		resetter.ResetProc()
+	}
+}
+
 func (conn *Connection) UpdateRecvTimeout(timeout int) {
 	conn.recvTimeout = time.Duration(timeout) * time.Millisecond
 }
@@ -119,8 +235,18 @@ func (conn *Connection) Input(){
 
 }
 
+//Close ask the io goroutine to exit, it's safe to call more than once
 func (conn *Connection) Close(){
-	conn.closeSignal <- true
+	select {
+	case conn.closeSignal <- true:
+	default:
+	}
+}
+
+//Abort close the connection with a reset
+func (conn *Connection) Abort(){
+	atomic.StoreInt32(&conn.abort, 1)
+	conn.Close()
 }
 
 
@@ -128,13 +254,20 @@ func (conn *Connection) Close(){
 func (conn *Connection) IOHandler() {
 	log := conn.log
 	onExit := func() {
+		conn.rbuf.dataLen = 0
+		conn.releaseBuffer()
+		if conn.detached {
+			log.LogDebug("connection:%s detached", conn.addr)
+			return
+		}
+		if tcpConn, ok := TCPConn(conn.conn); ok && (conn.reset || atomic.LoadInt32(&conn.abort) == 1) {
+			tcpConn.SetLinger(0)
+		}
 		conn.conn.Close()
 		conn.err = errors.New("")
-		/*
-		if conn.session.Clean != nil {
-			conn.session.Clean(conn.session.GetPrivData())
+		if closer, ok := conn.session.(core.SessionCloser); ok {
+			closer.CloseProc()
 		}
-		*/
 
 		log.LogInfo("client exit:%s ", conn.addr)
 	}
@@ -144,29 +277,57 @@ func (conn *Connection) IOHandler() {
 		case <-conn.closeSignal:
 			return
 		default:
-			rBuf := conn.rbuf
+			if conn.readClosed {
+				select {
+				case <-conn.closeSignal:
+					return
+				case <-time.After(conn.recvTimeout):
+				}
+				if !conn.handleReply(conn.session.UpdateProc()) {
+					return
+				}
+				continue
+			}
+			rBuf := conn.readBuffer()
 			conn.conn.SetReadDeadline(time.Now().Add(conn.recvTimeout))
 			rBytes, err := conn.conn.Read(rBuf.data[rBuf.dataLen:])
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				conn.releaseBuffer()
 				if !conn.handleReply(conn.session.UpdateProc()){
 					return
 				}
 				continue
 			}
 
+		if err == io.EOF {
+			log.LogInfo("client shut down the connection:%s", conn.addr)
+			if !conn.shutdownRead() {
+				return
+			}
+			conn.releaseBuffer()
+			continue
+		}
 		if rBytes == 0 || err != nil {
 			log.LogInfo("client close the connection read bytes:%d err:%v", rBytes, err)
+			conn.notifyReset()
 			return
 		}
 
 		log.LogInfo("read %d bytes", rBytes)
 
+		conn.adjustReadSize(rBytes, len(rBuf.data)-rBuf.dataLen)
 		rBuf.dataLen += rBytes
 		left := rBuf.dataLen
 		totalDecode := 0
 		for left > 0 {
 			decodeLen, resp, err := conn.session.ReadProc(rBuf.data[totalDecode:rBuf.dataLen])
 			log.LogDebug("decode len:%d", decodeLen)
+			if err == core.ErrDetach {
+				if conn.handleReply(resp, nil) {
+					conn.detach(rBuf.data[totalDecode+decodeLen : rBuf.dataLen])
+				}
+				return
+			}
 			if err != nil {
 				log.LogWarn("Decode error on connection:%s err:%s", conn.addr, err.Error())
 				return
@@ -186,6 +347,7 @@ func (conn *Connection) IOHandler() {
 		}
 		rBuf.dataLen -= totalDecode
 		log.LogDebug("buf len:%d. data size in recv buffer:%d", len(rBuf.data), rBuf.dataLen)
+		conn.releaseBuffer()
 		}
 		
 	}
@@ -0,0 +1,52 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+)
+
+//proxiedConn a connection relayed by a proxy which told the addresses of the
+//client. The bytes read while looking for the header of the proxy come first
+type proxiedConn struct {
+	net.Conn
+	remote  net.Addr
+	local   net.Addr
+	pending []byte
+}
+
+//NewProxiedConn wrap a connection whose addresses are the ones given by the
+//proxy in front, nil keeps the address of conn. pending is read before conn
+func NewProxiedConn(conn net.Conn, remote, local net.Addr, pending []byte) net.Conn {
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	if local == nil {
+		local = conn.LocalAddr()
+	}
+	return &proxiedConn{Conn: conn, remote: remote, local: local, pending: pending}
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+//CloseWrite shut down the sending side of the connection under it
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("close write unsupported")
+}
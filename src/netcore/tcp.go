@@ -1,26 +1,109 @@
-
 package netcore
 import (
+	"errors"
 	"net"
+	"time"
 	"utility"
 )
 
 type ClientInitHandler func(net.Conn, *utility.LogModule)
+
+//the pause after an accept error like running out of descriptors doubles up to
+//maxAcceptDelay until a connection is accepted again, like net/http does
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+//TCPConn return the tcp connection under the wrappers of netcore
+func TCPConn(conn net.Conn) (*net.TCPConn, bool){
+	switch c := conn.(type){
+	case *net.TCPConn:
+		return c, true
+	case *admittedConn:
+		return TCPConn(c.Conn)
+	case *proxiedConn:
+		//the bytes still pending would be skipped by a reader of the tcp connection
+		if len(c.pending) > 0{
+			return nil, false
+		}
+		return TCPConn(c.Conn)
+	}
+	return nil, false
+}
+
 func TcpServer(addr string, port int, log *utility.LogContext, clientInitHandler ClientInitHandler){
-	ip := net.ParseIP(addr)
-	servAddr := net.TCPAddr{IP:ip, Port: port}
-	listener, err := net.ListenTCP("tcp", &servAddr)
+	TcpServerWithAdmission(addr, port, log, nil, clientInitHandler)
+}
+
+//TcpServerWithAdmission accept the connections allowed by the admission controller
+func TcpServerWithAdmission(addr string, port int, log *utility.LogContext, admission *Admission, clientInitHandler ClientInitHandler){
+	listener, err := ListenTCP(addr, port)
 	if err != nil{
 		panic(err.Error())
 	}
+	ServeTCP(listener, log, admission, clientInitHandler)
+}
+
+//ListenTCP listen on addr:port
+func ListenTCP(addr string, port int) (*net.TCPListener, error){
+	ip := net.ParseIP(addr)
+	return net.ListenTCP("tcp", &net.TCPAddr{IP:ip, Port: port})
+}
+
+//ServeTCP accept the connections allowed by the admission controller until the
+//listener is closed, admission may be nil
+func ServeTCP(listener net.Listener, log *utility.LogContext, admission *Admission, clientInitHandler ClientInitHandler){
+	serveTCP(listener, log, admission, true, clientInitHandler)
+}
+
+//ServeTCPThrottled accept the connections at the accept rate of admission and
+//leave its other limits to the handler, which calls Admit once it knows the
+//source of the connection, like after the PROXY protocol header of a balancer
+func ServeTCPThrottled(listener net.Listener, log *utility.LogContext, admission *Admission, clientInitHandler ClientInitHandler){
+	serveTCP(listener, log, admission, false, clientInitHandler)
+}
+
+func serveTCP(listener net.Listener, log *utility.LogContext, admission *Admission, admit bool, clientInitHandler ClientInitHandler){
+	servAddr := listener.Addr()
 	log.LogInfo("listen on addr:%s sucessfully", servAddr.String())
 	defer utility.CatchPanic(log, nil)
+	var delay time.Duration
 	for {
+		admission.waitAccept()
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed){
+			log.LogInfo("stop accepting on addr:%s", servAddr.String())
+			return
+		}
 		if err != nil{
-			log.LogWarn("accept error on addr:%v", err)
+			delay = acceptDelay(delay)
+			log.LogWarn("accept error on addr:%s err:%v, retry in %v", servAddr.String(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if admit{
+			admitted, err := admission.Admit(conn)
+			if err != nil{
+				log.LogInfo("reject connection:%s on addr:%s reason:%v", conn.RemoteAddr().String(), servAddr.String(), err)
+				conn.Close()
+				continue
+			}
+			conn = admitted
 		}
 		log.LogInfo("new connection:%s arrived on addr:%s", conn.RemoteAddr().String(), servAddr.String())
-		clientInitHandler(conn, log.GetHandle())	
+		clientInitHandler(conn, log.GetHandle())
+	}
+}
+
+//acceptDelay return the pause after another accept error
+func acceptDelay(delay time.Duration) time.Duration{
+	if delay == 0{
+		return minAcceptDelay
+	}
+	if delay *= 2; delay > maxAcceptDelay{
+		return maxAcceptDelay
 	}
+	return delay
 }
@@ -0,0 +1,51 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utility"
+)
+
+//failingListener fail the accepts a number of times, then it's closed
+type failingListener struct {
+	net.Listener
+	fails int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.fails, -1) >= 0 {
+		return nil, errors.New("too many open files")
+	}
+	return nil, net.ErrClosed
+}
+
+func TestAcceptDelay(t *testing.T) {
+	var delay time.Duration
+	for _, want := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000} {
+		if delay = acceptDelay(delay); delay != want*time.Millisecond {
+			t.Fatalf("delay %v, %v expected", delay, want*time.Millisecond)
+		}
+	}
+}
+
+//TestServeTCPAcceptError the loop pauses after the accept errors instead of
+//spinning on them
+func TestServeTCPAcceptError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	logHandle := utility.NewLog("tcp", "WARN", 0, t.TempDir())
+	defer logHandle.Exit()
+	start := time.Now()
+	ServeTCP(&failingListener{Listener: ln, fails: 4}, utility.NewLogContext(0, logHandle), nil, func(conn net.Conn, _ *utility.LogModule) {
+		t.Error("connection handled after an accept error")
+	})
+	if elapsed := time.Since(start); elapsed < (5+10+20+40)*time.Millisecond {
+		t.Fatalf("4 accept errors in %v", elapsed)
+	}
+}
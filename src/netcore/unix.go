@@ -0,0 +1,41 @@
+package netcore
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+//ListenUnix listen on the unix socket at path. The socket file left by a process
+//which is gone is replaced, one still accepting is an error. mode sets the
+//permissions of the file when it's not 0, uid and gid its owner when not -1.
+//Closing the listener removes the file
+func ListenUnix(path string, mode os.FileMode, uid, gid int) (*net.UnixListener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("not a socket:" + path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("socket in use:" + path)
+		}
+		os.Remove(path)
+	}
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,265 @@
+package opensock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"utility"
+)
+
+const (
+	accessFormatJSON      = "json"
+	defaultAccessLogFile  = "access.log"
+	defaultAccessLogSize  = 100
+	defaultAccessLogFiles = 5
+	accessLogQueueSize    = 4096
+)
+
+//AccessLogConfig one record per session written when it ends. Format is json
+//for json lines or a text/template over AccessRecord. The file is rotated when
+//it grows over MaxSize MB, MaxFiles old files are kept as File.1, File.2 ...
+type AccessLogConfig struct {
+	File     string `json:"file"`
+	Format   string `json:"format"`
+	MaxSize  int    `json:"maxsize"`
+	MaxFiles int    `json:"maxfiles"`
+}
+
+//AccessRecord the access log record of a session. Route is how the traffic
+//leaves the process: the tag of an outbound or listen for a reverse tunnel
+//binding. Domain is the one sniffed from the first bytes of the client
+type AccessRecord struct {
+	ID       uint64    `json:"id"`
+	Trace    string    `json:"trace"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	Client   string    `json:"client"`
+	User     string    `json:"user"`
+	Inbound  string    `json:"inbound"`
+	Host     string    `json:"host"`
+	Domain   string    `json:"domain"`
+	IP       string    `json:"ip"`
+	Port     string    `json:"port"`
+	Route    string    `json:"route"`
+	Upload   uint64    `json:"upload"`
+	Download uint64    `json:"download"`
+	Reason   string    `json:"reason"`
+}
+
+func (c *AccessLogConfig) validate() error {
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return errors.New("negative access log rotation")
+	}
+	_, err := c.template()
+	return err
+}
+
+//template parse the format, it returns nil for json
+func (c *AccessLogConfig) template() (*template.Template, error) {
+	if c.Format == "" || c.Format == accessFormatJSON {
+		return nil, nil
+	}
+	tmpl, err := template.New("access").Parse(c.Format)
+	if err != nil {
+		return nil, errors.New("invalid access log format:" + err.Error())
+	}
+	return tmpl, nil
+}
+
+//accessLogger write the records in its own goroutine, the records are dropped
+//when the queue is full so a slow disk never stalls the sessions
+type accessLogger struct {
+	path       string
+	maxSize    int64
+	maxFiles   int
+	tmpl       *template.Template
+	records    chan *AccessRecord
+	reopenChan chan struct{}
+	closeChan  chan struct{}
+	done       chan struct{}
+	file       *os.File
+	size       int64
+	dropped    uint64
+	log        *utility.LogContext
+}
+
+//accessLog is nil when the access log is disabled
+var accessLog *accessLogger
+
+func newAccessLogger(cfg *AccessLogConfig, log *utility.LogContext) (*accessLogger, error) {
+	tmpl, err := cfg.template()
+	if err != nil {
+		return nil, err
+	}
+	a := &accessLogger{
+		path:       cfg.File,
+		maxSize:    int64(cfg.MaxSize) << 20,
+		maxFiles:   cfg.MaxFiles,
+		tmpl:       tmpl,
+		records:    make(chan *AccessRecord, accessLogQueueSize),
+		reopenChan: make(chan struct{}, 1),
+		closeChan:  make(chan struct{}),
+		done:       make(chan struct{}),
+		log:        log,
+	}
+	if a.path == "" {
+		a.path = defaultAccessLogFile
+	}
+	if a.maxSize == 0 {
+		a.maxSize = defaultAccessLogSize << 20
+	}
+	if a.maxFiles == 0 {
+		a.maxFiles = defaultAccessLogFiles
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	go a.run()
+	return a, nil
+}
+
+//record queue the record of a session which just ended
+func (a *accessLogger) record(info *sessionInfo) {
+	if a == nil {
+		return
+	}
+	select {
+	case a.records <- info.record(time.Now()):
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+//reopen switch to a new file after it's moved away by logrotate
+func (a *accessLogger) reopen() {
+	if a == nil {
+		return
+	}
+	select {
+	case a.reopenChan <- struct{}{}:
+	default:
+	}
+}
+
+//close write the queued records and close the file, the records of the
+//sessions ending afterwards are dropped
+func (a *accessLogger) close() {
+	if a == nil {
+		return
+	}
+	close(a.closeChan)
+	<-a.done
+}
+
+func (a *accessLogger) droppedRecords() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func (a *accessLogger) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = st.Size()
+	return nil
+}
+
+//rotate shift File.n to File.n+1 and start a new file
+func (a *accessLogger) rotate() {
+	a.file.Close()
+	a.file = nil
+	for i := a.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		a.log.LogWarn("rotate access log err:%v", err)
+	}
+	if err := a.open(); err != nil {
+		a.log.LogWarn("open access log err:%v", err)
+	}
+}
+
+func (a *accessLogger) format(rec *AccessRecord) ([]byte, error) {
+	if a.tmpl == nil {
+		data, err := json.Marshal(rec)
+		return append(data, '\n'), err
+	}
+	var buf bytes.Buffer
+	if err := a.tmpl.Execute(&buf, rec); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+func (a *accessLogger) write(rec *AccessRecord) {
+	data, err := a.format(rec)
+	if err != nil {
+		a.log.LogWarn("format access record err:%v", err)
+		return
+	}
+	if a.file == nil {
+		return
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		a.log.LogWarn("write access log err:%v", err)
+	}
+	if a.size >= a.maxSize {
+		a.rotate()
+	}
+}
+
+func (a *accessLogger) run() {
+	defer utility.CatchPanic(a.log, nil)
+	for {
+		select {
+		case rec := <-a.records:
+			a.write(rec)
+		case <-a.closeChan:
+			for len(a.records) > 0 {
+				a.write(<-a.records)
+			}
+			if a.file != nil {
+				a.file.Close()
+			}
+			close(a.done)
+			return
+		case <-a.reopenChan:
+			if a.file != nil {
+				a.file.Close()
+				a.file = nil
+			}
+			if err := a.open(); err != nil {
+				a.log.LogWarn("reopen access log err:%v", err)
+			}
+		}
+	}
+}
+
+//splitDest split host:port, a dest without a port is all host
+func splitDest(dest string) (string, string) {
+	i := strings.LastIndex(dest, ":")
+	if i < 0 {
+		return dest, ""
+	}
+	return strings.Trim(dest[:i], "[]"), dest[i+1:]
+}
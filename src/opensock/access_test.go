@@ -0,0 +1,146 @@
+package opensock
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"utility"
+)
+
+func testAccessRecord(id uint64) *AccessRecord {
+	return &AccessRecord{ID: id, Trace: "0a1b", Start: time.Unix(1700000000, 0).UTC(), Duration: 1.5, Client: "203.0.113.7:4242",
+		User: "alice", Inbound: "socks", Host: "example.com", Port: "443", Route: "direct", Upload: 10, Download: 20, Reason: "closed"}
+}
+
+func testAccessLogger(t *testing.T, cfg *AccessLogConfig) *accessLogger {
+	logHandle := utility.NewLog("access", "WARN", 0, t.TempDir())
+	t.Cleanup(logHandle.Exit)
+	a, err := newAccessLogger(cfg, utility.NewLogContext(0, logHandle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func readLines(t *testing.T, path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestAccessLogFormat(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		line   string
+	}{
+		{"template", "{{.Client}} {{.User}} {{.Host}}:{{.Port}} up:{{.Upload}} down:{{.Download}} {{.Reason}}", "203.0.113.7:4242 alice example.com:443 up:10 down:20 closed"},
+		{"template with newline", "{{.ID}} {{.Trace}}\n", "1 0a1b"},
+		{"json", "json", ""},
+		{"default", "", ""},
+	}
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "access.log")
+		a := testAccessLogger(t, &AccessLogConfig{File: path, Format: c.format})
+		a.records <- testAccessRecord(1)
+		a.close()
+		lines := readLines(t, path)
+		if len(lines) != 1 {
+			t.Errorf("%s: %q", c.name, lines)
+			continue
+		}
+		if c.line != "" {
+			if lines[0] != c.line {
+				t.Errorf("%s: %q, %q expected", c.name, lines[0], c.line)
+			}
+			continue
+		}
+		rec := &AccessRecord{}
+		if err := json.Unmarshal([]byte(lines[0]), rec); err != nil || *rec != *testAccessRecord(1) {
+			t.Errorf("%s: %q err:%v", c.name, lines[0], err)
+		}
+	}
+	if err := (&AccessLogConfig{Format: "{{.Client"}).validate(); err == nil {
+		t.Fatal("invalid template accepted")
+	}
+}
+
+//TestAccessLogRotate the file is shifted to File.1 when it's over the size and
+//the oldest files over MaxFiles are dropped
+func TestAccessLogRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	logHandle := utility.NewLog("access", "WARN", 0, dir)
+	defer logHandle.Exit()
+	//without the goroutine of the logger, the size is below the MB of the config
+	a := &accessLogger{path: path, maxSize: 100, maxFiles: 2, tmpl: nil, log: utility.NewLogContext(0, logHandle)}
+	if err := a.open(); err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(1); id <= 5; id++ {
+		a.write(testAccessRecord(id))
+	}
+	a.file.Close()
+	//each record is over the size, so it's alone in its file and a new one is
+	//started after it
+	if st, err := os.Stat(path); err != nil || st.Size() != 0 {
+		t.Fatalf("the access log after the rotation err:%v", err)
+	}
+	for file, id := range map[string]uint64{path + ".1": 5, path + ".2": 4} {
+		lines := readLines(t, file)
+		rec := &AccessRecord{}
+		if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), rec) != nil || rec.ID != id {
+			t.Errorf("%s: %q, record %d expected", file, lines, id)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more than 2 old files kept, err:%v", err)
+	}
+}
+
+//TestAccessLogReopen the records go to a new file once the old one is moved
+//away and the logger reopens it, like on SIGUSR1 after logrotate
+func TestAccessLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	a := testAccessLogger(t, &AccessLogConfig{File: path})
+	waitFile := func(path string) {
+		deadline := time.Now().Add(testTimeout)
+		for {
+			if st, err := os.Stat(path); err == nil && st.Size() > 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("nothing written to %s", path)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	a.records <- testAccessRecord(1)
+	waitFile(path)
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	a.reopen()
+	deadline := time.Now().Add(testTimeout)
+	for _, err := os.Stat(path); os.IsNotExist(err); _, err = os.Stat(path) {
+		if time.Now().After(deadline) {
+			t.Fatal("the access log isn't reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.records <- testAccessRecord(2)
+	a.close()
+	for file, id := range map[string]uint64{path + ".old": 1, path: 2} {
+		lines := readLines(t, file)
+		rec := &AccessRecord{}
+		if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), rec) != nil || rec.ID != id {
+			t.Errorf("%s: %q, record %d expected", file, lines, id)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package opensock
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"netcore"
+	"strconv"
+	"strings"
+	"time"
+	"utility"
+)
+
+const (
+	defaultAdminListen = "127.0.0.1:7080"
+	adminSessionsPath  = "/sessions/"
+	redacted           = "******"
+	adminAuthScheme    = "Bearer "
+)
+
+//AdminConfig the admin http api. Every request must carry the token as a bearer
+//token, the api listens on localhost unless Listen names another host
+type AdminConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+func (c *AdminConfig) validate() error {
+	if c.Token == "" {
+		return errors.New("admin token required")
+	}
+	if _, _, err := net.SplitHostPort(c.address()); err != nil {
+		return errors.New("invalid admin listen address:" + c.Listen)
+	}
+	return nil
+}
+
+//address return the listen address, an empty host means localhost
+func (c *AdminConfig) address() string {
+	if c.Listen == "" {
+		return defaultAdminListen
+	}
+	if strings.HasPrefix(c.Listen, ":") {
+		return "127.0.0.1" + c.Listen
+	}
+	return c.Listen
+}
+
+//adminStats the aggregate stats of the process
+type adminStats struct {
+	Uptime    float64                `json:"uptime"`
+	Sessions  int                    `json:"sessions"`
+	Traffic   serverStats            `json:"traffic"`
+	Admission netcore.AdmissionStats `json:"admission"`
+}
+
+type adminServer struct {
+	token   string
+	server  *SockServer
+	start   time.Time
+	log     *utility.LogContext
+	handler *http.ServeMux
+}
+
+func startAdmin(cfg *AdminConfig, serv *SockServer) {
+	a := &adminServer{
+		token:   cfg.Token,
+		server:  serv,
+		start:   time.Now(),
+		log:     utility.NewLogContext(0, serv.log),
+		handler: http.NewServeMux(),
+	}
+	a.handler.HandleFunc("/sessions", a.handleSessions)
+	a.handler.HandleFunc(adminSessionsPath, a.handleKill)
+	a.handler.HandleFunc("/stats", a.handleStats)
+	a.handler.HandleFunc("/config", a.handleConfig)
+	a.handler.HandleFunc("/reload", a.handleReload)
+	a.handler.HandleFunc("/log/reopen", a.handleLogReopen)
+	a.handler.HandleFunc("/metrics", a.handleMetrics)
+	ln, err := net.Listen("tcp", cfg.address())
+	if err != nil {
+		a.log.LogWarn("admin api exit:%v", err)
+		return
+	}
+	//closed at shutdown with the other listeners, with its connections
+	srv := &http.Server{Handler: a}
+	if !listeners.add(srv) {
+		ln.Close()
+		return
+	}
+	a.log.LogInfo("admin api listen on addr:%s", cfg.address())
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		a.log.LogWarn("admin api exit:%v", err)
+	}
+}
+
+//ServeHTTP check the bearer token before dispatching the request, the token
+//without the scheme is refused
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, adminAuthScheme) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(adminAuthScheme):]), []byte(a.token)) != 1 {
+		a.log.LogWarn("admin request from:%s refused", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	a.handler.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+//allowMethod reply 405 unless the request uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	return false
+}
+
+func (a *adminServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, sessions.list())
+	}
+}
+
+//handleKill close the session of DELETE /sessions/<id>
+func (a *adminServer) handleKill(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, adminSessionsPath), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+	if !sessions.kill(id) {
+		writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+	a.log.LogInfo("admin kill session:%d", id)
+	writeJSON(w, map[string]uint64{"killed": id})
+}
+
+func (a *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, &adminStats{
+		Uptime:    time.Since(a.start).Seconds(),
+		Sessions:  sessions.count(),
+		Traffic:   stats.snapshot(),
+		Admission: admission.Stats(),
+	})
+}
+
+func (a *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, currentState().cfg.redacted())
+	}
+}
+
+func (a *adminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if err := a.server.Reload(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, map[string]bool{"reloaded": true})
+}
+
+func (a *adminServer) handleLogReopen(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	a.server.log.SendSignal()
+	accessLog.reopen()
+	writeJSON(w, map[string]bool{"reopened": true})
+}
+
+func (a *adminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+//redact hide a secret, an empty one stays empty to show it's not set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+//redactUsers copy users without their passwords
+func redactUsers(users []*UserConfig) []*UserConfig {
+	var out []*UserConfig
+	for _, u := range users {
+		user := *u
+		user.Password = redact(u.Password)
+		out = append(out, &user)
+	}
+	return out
+}
+
+//redacted return a copy of the config without the secrets, the users of the
+//inbounds and the outbounds are copied too
+func (cfg *ServerConfig) redacted() *ServerConfig {
+	c := *cfg
+	c.Key = redact(cfg.Key)
+	c.Password = redact(cfg.Password)
+	c.Users = redactUsers(cfg.Users)
+	if cfg.Admin != nil {
+		admin := *cfg.Admin
+		admin.Token = redact(cfg.Admin.Token)
+		c.Admin = &admin
+	}
+	c.Inbounds, c.Outbounds = nil, nil
+	for _, in := range cfg.Inbounds {
+		inbound := *in
+		inbound.Users = redactUsers(in.Users)
+		c.Inbounds = append(c.Inbounds, &inbound)
+	}
+	for _, out := range cfg.Outbounds {
+		outbound := *out
+		outbound.Key = redact(out.Key)
+		outbound.Password = redact(out.Password)
+		c.Outbounds = append(c.Outbounds, &outbound)
+	}
+	return &c
+}
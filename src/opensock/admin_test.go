@@ -0,0 +1,76 @@
+package opensock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"utility"
+)
+
+func TestAdminToken(t *testing.T) {
+	logHandle := utility.NewLog("admin", "WARN", 0, t.TempDir())
+	defer logHandle.Exit()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	a := &adminServer{token: "secret", log: utility.NewLogContext(0, logHandle), handler: mux}
+	cases := []struct {
+		auth string
+		code int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"Bearer  secret", http.StatusUnauthorized},
+		{"bearer secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer ", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if c.auth != "" {
+			r.Header.Set("Authorization", c.auth)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%q: status %d, %d expected", c.auth, w.Code, c.code)
+		}
+	}
+}
+
+func TestAdminConfigRedacted(t *testing.T) {
+	secrets := []string{"tunnel-key", "client-pw", "user-pw", "admin-token", "inbound-pw", "outbound-key", "outbound-pw"}
+	cfg := &ServerConfig{
+		Key:      "tunnel-key",
+		Password: "client-pw",
+		Users:    []*UserConfig{{Name: "alice", Password: "user-pw"}},
+		Admin:    &AdminConfig{Listen: "127.0.0.1:0", Token: "admin-token"},
+		Inbounds: []*InboundConfig{{Tag: "in", Type: inboundSocks, Users: []*UserConfig{{Name: "bob", Password: "inbound-pw"}}}},
+		Outbounds: []*OutboundConfig{
+			{Tag: "tunnel", Type: outboundTunnel, Key: "outbound-key", User: "carol", Password: "outbound-pw"},
+			{Tag: "direct", Type: outboundDirect},
+		},
+	}
+	prev := currentState()
+	setState(cfg)
+	defer activeState.Store(prev)
+	w := httptest.NewRecorder()
+	(&adminServer{}).handleConfig(w, httptest.NewRequest(http.MethodGet, "/config", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, "carol") {
+		t.Fatalf("status %d body %s", w.Code, body)
+	}
+	for _, secret := range secrets {
+		if strings.Contains(body, secret) {
+			t.Errorf("%s in the config: %s", secret, body)
+		}
+	}
+	if cfg.Inbounds[0].Users[0].Password != "inbound-pw" || cfg.Outbounds[0].Key != "outbound-key" {
+		t.Fatal("the running config was redacted")
+	}
+	if strings.Count(body, redacted) != len(secrets) {
+		t.Fatalf("%d secrets redacted: %s", strings.Count(body, redacted), body)
+	}
+}
@@ -0,0 +1,327 @@
+package opensock
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"utility"
+)
+
+const (
+	defaultCaptureDir  = "capture"
+	defaultCaptureSize = 64
+)
+
+//CaptureConfig record the plain streams of the selected sessions to pcapng
+//files in Dir, one file per session. A session is selected when it matches
+//every list which is not empty: Clients are ips or cidrs, Users are names,
+//Dests are domains, which match their subdomains and the sniffed domain too, ips
+//or cidrs with an optional port like "example.com:443" or "[::1]:80". A file stops growing at
+//MaxSize MB
+type CaptureConfig struct {
+	Dir     string   `json:"dir"`
+	Clients []string `json:"clients"`
+	Users   []string `json:"users"`
+	Dests   []string `json:"dests"`
+	MaxSize int      `json:"maxsize"`
+	clients []*net.IPNet
+	dests   []*captureDest
+}
+
+//captureDest a parsed entry of Dests, a port of 0 matches any port
+type captureDest struct {
+	domain string
+	ipNet  *net.IPNet
+	port   int
+}
+
+func (c *CaptureConfig) validate() error {
+	if c.MaxSize < 0 {
+		return errors.New("negative capture size")
+	}
+	if len(c.Clients) == 0 && len(c.Users) == 0 && len(c.Dests) == 0 {
+		return errors.New("capture without clients, users or dests")
+	}
+	c.clients = c.clients[:0]
+	for _, s := range c.Clients {
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			return errors.New("invalid capture client:" + s)
+		}
+		c.clients = append(c.clients, ipNet)
+	}
+	c.dests = c.dests[:0]
+	for _, s := range c.Dests {
+		d, err := parseCaptureDest(s)
+		if err != nil {
+			return err
+		}
+		c.dests = append(c.dests, d)
+	}
+	return nil
+}
+
+//parseIPNet parse an ip or a cidr, an ip is a network of one address
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("invalid ip:" + s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func parseCaptureDest(s string) (*captureDest, error) {
+	d := &captureDest{}
+	host := s
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, errors.New("invalid capture dest:" + s)
+		}
+		host, d.port = h, port
+	}
+	if host == "" {
+		return nil, errors.New("invalid capture dest:" + s)
+	}
+	if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+		ipNet, err := parseIPNet(host)
+		if err != nil {
+			return nil, errors.New("invalid capture dest:" + s)
+		}
+		d.ipNet = ipNet
+		return d, nil
+	}
+	d.domain = normalizeDomain(host)
+	return d, nil
+}
+
+//match check the destination asked by the client, its sniffed domain and the
+//address dialed for it
+func (d *captureDest) match(dest, domain string, remote net.IP) bool {
+	host, port := splitDest(dest)
+	if d.port != 0 && port != strconv.Itoa(d.port) {
+		return false
+	}
+	if d.ipNet != nil {
+		ip := net.ParseIP(host)
+		return (ip != nil && d.ipNet.Contains(ip)) || (remote != nil && d.ipNet.Contains(remote))
+	}
+	return matchDomain(host, d.domain) || (domain != "" && matchDomain(domain, d.domain))
+}
+
+//selects check whether the session is captured
+func (c *CaptureConfig) selects(req *DialRequest, remote net.IP) bool {
+	if len(c.clients) > 0 && !containsIP(c.clients, addrIP(req.Client)) {
+		return false
+	}
+	if len(c.Users) > 0 {
+		found := false
+		for _, u := range c.Users {
+			found = found || u == req.User
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(c.dests) > 0 {
+		found := false
+		for _, d := range c.dests {
+			found = found || d.match(req.Dest, req.Domain, remote)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//addrIP the ip of a tcp address, nil for the other kinds
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	return nil
+}
+
+//sessionCapture the capture file of a session. The client flow goes from the
+//client to the inbound, the upstream flow from this process to the address
+//dialed by the outbound, both carry the plain data of the session
+type sessionCapture struct {
+	lock     sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	pcap     *utility.PcapWriter
+	client   *utility.TCPFlow
+	upstream *utility.TCPFlow
+	size     int64
+	limit    int64
+	closed   bool
+	log      *utility.LogContext
+}
+
+//startCapture open the capture of a session whose destination is connected
+//when the config selects it
+func startCapture(cfg *ServerConfig, req *DialRequest, info *sessionInfo, conn net.Conn, log *utility.LogContext) {
+	c := cfg.Capture
+	if c == nil || !c.selects(req, addrIP(conn.RemoteAddr())) {
+		return
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir = defaultCaptureDir
+	}
+	size := c.MaxSize
+	if size == 0 {
+		size = defaultCaptureSize
+	}
+	name := filepath.Join(dir, fmt.Sprintf("capture-%s-%d.pcapng", time.Now().Format("20060102-150405"), info.id))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.LogWarn("failed to create capture dir:%s err:%v", dir, err)
+		return
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.LogWarn("failed to create capture:%s err:%v", name, err)
+		return
+	}
+	s := &sessionCapture{
+		file:     file,
+		buf:      bufio.NewWriter(file),
+		client:   utility.NewTCPFlow(tcpAddr(req.Client), tcpAddr(req.Local)),
+		upstream: utility.NewTCPFlow(tcpAddr(conn.LocalAddr()), tcpAddr(conn.RemoteAddr())),
+		limit:    int64(size) * 1024 * 1024,
+		log:      log,
+	}
+	if s.pcap, err = utility.NewPcapWriter(s.buf); err != nil {
+		file.Close()
+		return
+	}
+	now := time.Now()
+	s.write(now, s.client.Open())
+	s.write(now, s.upstream.Open())
+	log.LogInfo("capture session:%d to:%s", info.id, name)
+	info.setCapture(s)
+}
+
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	tcpAddr, _ := addr.(*net.TCPAddr)
+	return tcpAddr
+}
+
+//write add the packets until the file is full, the caller holds the lock
+func (s *sessionCapture) write(ts time.Time, packets [][]byte) {
+	for _, pkt := range packets {
+		if s.size >= s.limit {
+			if !s.closed {
+				s.log.LogWarn("capture:%s is full", s.file.Name())
+				s.closed = true
+			}
+			return
+		}
+		n, err := s.pcap.WritePacket(ts, pkt)
+		s.size += int64(n)
+		if err != nil {
+			s.log.LogWarn("write capture:%s err:%v", s.file.Name(), err)
+			s.closed = true
+			return
+		}
+	}
+}
+
+//upload record data sent by the client, it passes the client flow then the upstream
+func (s *sessionCapture) upload(data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	now := time.Now()
+	s.write(now, s.client.Data(0, data))
+	s.write(now, s.upstream.Data(0, data))
+}
+
+//download record data sent by the destination
+func (s *sessionCapture) download(data []byte) {
+	if s == nil || len(data) == 0 {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	now := time.Now()
+	s.write(now, s.upstream.Data(1, data))
+	s.write(now, s.client.Data(1, data))
+}
+
+//close end both flows the way the session ended and close the file
+func (s *sessionCapture) close(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		now := time.Now()
+		switch reason {
+		case "client_reset":
+			s.write(now, s.client.Reset(0))
+			s.write(now, s.upstream.Reset(0))
+		case "upstream_reset":
+			s.write(now, s.upstream.Reset(1))
+			s.write(now, s.client.Reset(1))
+		default:
+			s.write(now, s.client.Close(0))
+			s.write(now, s.upstream.Close(0))
+		}
+	}
+	s.closed = true
+	if err := s.buf.Flush(); err != nil {
+		s.log.LogWarn("write capture:%s err:%v", s.file.Name(), err)
+	}
+	s.file.Close()
+}
+
+//captureConn record what is read from the connection of a direct relay
+type captureConn struct {
+	net.Conn
+	capture *sessionCapture
+	upload  bool
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if c.upload {
+		c.capture.upload(p[:n])
+	} else {
+		c.capture.download(p[:n])
+	}
+	return n, err
+}
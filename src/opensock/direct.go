@@ -0,0 +1,197 @@
+package opensock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"netcore"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utility"
+)
+
+const (
+	//directChunk the most bytes copied before the traffic is accounted
+	directChunk         = 32 * 1024
+	directCheckInterval = time.Second
+)
+
+//directRelay copy the data between the client and the destination without the
+//polling of netcore. io.Copy uses splice(2) between two tcp connections on linux
+type directRelay struct {
+	client     net.Conn //as accepted, closing it releases the admission slot
+	rawClient  net.Conn
+	dest       net.Conn //the stream of the outbound
+	timeouts   *TimeoutConfig
+	limiter    *sessionLimiter
+	info       *sessionInfo
+	lastActive int64
+	uploadDone int32
+	downDone   int32
+	closeOnce  sync.Once
+	log        *utility.LogContext
+}
+
+func newDirectRelay(client net.Conn, dest net.Conn, timeouts *TimeoutConfig, limiter *sessionLimiter, log *utility.LogContext) *directRelay {
+	if timeouts == nil {
+		timeouts = defaultTimeouts
+	}
+	r := &directRelay{
+		client:     client,
+		rawClient:  client,
+		dest:       dest,
+		timeouts:   timeouts,
+		limiter:    limiter,
+		lastActive: time.Now().UnixNano(),
+		log:        log,
+	}
+	if tcpConn, ok := netcore.TCPConn(client); ok {
+		r.rawClient = tcpConn
+	}
+	return r
+}
+
+//dialDirect connect the first reachable address of the destination, leaving
+//by the egress of the outbound when it's not nil
+func dialDirect(addrs []*net.TCPAddr, e *egress, req *DialRequest, log *utility.LogContext) (*net.TCPConn, error) {
+	err := errors.New("no address to connect")
+	for _, addr := range addrs {
+		var conn *net.TCPConn
+		conn, err = e.dialTCP(addr, req, 0)
+		if err == nil {
+			return conn, nil
+		}
+		log.LogWarn("%s", err.Error())
+	}
+	return nil, err
+}
+
+//run relay until both directions are finished, buffered is the data read from
+//the client after the socks request
+func (r *directRelay) run(buffered []byte) {
+	defer utility.CatchPanic(r.log, nil)
+	if len(buffered) > 0 {
+		r.limiter.uploadData(buffered)
+		if _, err := r.dest.Write(buffered); err != nil {
+			r.log.LogWarn("write to destination err:%v", err)
+			r.info.setReason("upstream_reset")
+			r.close(true)
+			return
+		}
+	}
+	//a captured session is read through the capture, which gives up splice(2)
+	clientSrc, destSrc := r.rawClient, r.dest
+	if c := r.info.captured(); c != nil {
+		clientSrc = &captureConn{Conn: r.rawClient, capture: c, upload: true}
+		destSrc = &captureConn{Conn: r.dest, capture: c}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer utility.CatchPanic(r.log, nil)
+		r.copy(r.dest, clientSrc, true)
+		close(done)
+	}()
+	r.copy(r.rawClient, destSrc, false)
+	<-done
+	r.close(false)
+	r.log.LogInfo("direct relay of client:%s exit", r.client.RemoteAddr().String())
+}
+
+//copy one direction, the EOF is passed on with a half-close
+func (r *directRelay) copy(dst, src net.Conn, upload bool) {
+	for {
+		src.SetReadDeadline(time.Now().Add(directCheckInterval))
+		n, err := io.CopyN(dst, src, directChunk)
+		if n > 0 {
+			atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+			if upload {
+				r.limiter.uploadBytes(int(n))
+			} else {
+				r.limiter.downloadBytes(int(n))
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			r.finish(dst, upload)
+			return
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			if !r.expired() {
+				continue
+			}
+			r.log.LogInfo("close idle direct relay of client:%s", r.client.RemoteAddr().String())
+			r.info.setReason("idle_timeout")
+			r.close(false)
+			return
+		}
+		r.log.LogInfo("direct relay of client:%s err:%v", r.client.RemoteAddr().String(), err)
+		if upload {
+			r.info.setReason("client_reset")
+		} else {
+			r.info.setReason("upstream_reset")
+		}
+		r.close(true)
+		return
+	}
+}
+
+//finish shut down the sending side of dst after src is drained
+func (r *directRelay) finish(dst net.Conn, upload bool) {
+	if upload {
+		atomic.StoreInt32(&r.uploadDone, 1)
+	} else {
+		atomic.StoreInt32(&r.downDone, 1)
+	}
+	atomic.StoreInt64(&r.lastActive, time.Now().UnixNano())
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	r.close(false)
+}
+
+func (r *directRelay) expired() bool {
+	var limit int
+	upload := atomic.LoadInt32(&r.uploadDone) == 1
+	download := atomic.LoadInt32(&r.downDone) == 1
+	switch {
+	case upload && download:
+		return false
+	case download:
+		limit = r.timeouts.UplinkOnly
+	case upload:
+		limit = r.timeouts.DownlinkOnly
+	default:
+		limit = r.timeouts.Idle
+	}
+	idle := time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&r.lastActive))
+	return limit > 0 && idle > time.Duration(limit)*time.Second
+}
+
+//close both connections, a reset is passed on to both sides
+func (r *directRelay) close(reset bool) {
+	r.closeOnce.Do(func() {
+		if reset {
+			if tcpConn, ok := streamTCP(r.dest); ok {
+				tcpConn.SetLinger(0)
+			}
+			if tcpConn, ok := r.rawClient.(*net.TCPConn); ok {
+				tcpConn.SetLinger(0)
+			}
+		}
+		r.dest.Close()
+		r.client.Close()
+	})
+}
+
+//streamTCP return the tcp connection under the stream of an outbound
+func streamTCP(conn net.Conn) (*net.TCPConn, bool) {
+	if s, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = s.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
@@ -0,0 +1,126 @@
+package opensock
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"utility"
+)
+
+const benchChunk = 32 * 1024
+
+//startStandard run a standard mode proxy, it returns the proxy address
+func startStandard(b *testing.B, noDirectCopy bool) string {
+	log := utility.NewLog("bench", "WARN", 0, b.TempDir())
+	cfg := &ServerConfig{Mode: "standard", NoDirectCopy: noDirectCopy}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			NewSock5Session(conn, log, cfg)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+//startDest run a destination which serve each connection with handler
+func startDest(b testing.TB, handler func(net.Conn)) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+//dialSocks connect dest through the socks proxy
+func dialSocks(b *testing.B, proxy string, dest *net.TCPAddr) net.Conn {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := []byte{5, 1, 0, 5, 1, 0, 1}
+	req = append(req, dest.IP.To4()...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(dest.Port))
+	if _, err := conn.Write(req); err != nil {
+		b.Fatal(err)
+	}
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		b.Fatal(err)
+	}
+	if resp[3] != 0 {
+		b.Fatalf("socks request failed:%d", resp[3])
+	}
+	return conn
+}
+
+func benchThroughput(b *testing.B, noDirectCopy bool) {
+	proxy := startStandard(b, noDirectCopy)
+	size := int64(b.N) * benchChunk
+	dest := startDest(b, func(conn net.Conn) {
+		defer conn.Close()
+		chunk := make([]byte, benchChunk)
+		for left := size; left > 0; left -= benchChunk {
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	conn := dialSocks(b, proxy, dest)
+	defer conn.Close()
+	b.SetBytes(benchChunk)
+	b.ResetTimer()
+	n, err := io.Copy(io.Discard, conn)
+	if err != nil || n != size {
+		b.Fatalf("received %d of %d bytes err:%v", n, size, err)
+	}
+}
+
+func benchLatency(b *testing.B, noDirectCopy bool) {
+	proxy := startStandard(b, noDirectCopy)
+	dest := startDest(b, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+	})
+	conn := dialSocks(b, proxy, dest)
+	defer conn.Close()
+	buf := make([]byte, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkStandardThroughput(b *testing.B) {
+	b.Run("poll", func(b *testing.B) { benchThroughput(b, true) })
+	b.Run("direct", func(b *testing.B) { benchThroughput(b, false) })
+}
+
+func BenchmarkStandardLatency(b *testing.B) {
+	b.Run("poll", func(b *testing.B) { benchLatency(b, true) })
+	b.Run("direct", func(b *testing.B) { benchLatency(b, false) })
+}
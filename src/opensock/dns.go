@@ -0,0 +1,461 @@
+package opensock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"protocol/dns"
+	"protocol/tunnel"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utility"
+)
+
+const (
+	dnsQueryTimeout    = 5 * time.Second
+	dnsTCPIdleTimeout  = 30 * time.Second
+	dnsNegativeTTL     = 30
+	dnsMaxTTL          = 3600
+	dnsDefaultCache    = 1024
+	dnsMaxMessageSize  = 65535
+	dnsTunnelBufferLen = 16384 * 2
+)
+
+//DNSConfig the dns server of the client. Queries are resolved by Remote through the
+//tunnel, except the names under the Local zones which are sent to LocalResolver
+type DNSConfig struct {
+	Listen        string   `json:"listen"`
+	Remote        string   `json:"remote"`
+	Local         []string `json:"local"`
+	LocalResolver string   `json:"localresolver"`
+	CacheSize     int      `json:"cachesize"`
+}
+
+func (c *DNSConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return errors.New("invalid dns listen address:" + c.Listen)
+	}
+	if _, _, err := net.SplitHostPort(c.Remote); err != nil {
+		return errors.New("invalid dns remote resolver:" + c.Remote)
+	}
+	if len(c.Local) > 0 {
+		if _, _, err := net.SplitHostPort(c.LocalResolver); err != nil {
+			return errors.New("invalid dns local resolver:" + c.LocalResolver)
+		}
+	}
+	for i, zone := range c.Local {
+		c.Local[i] = strings.ToLower(strings.Trim(zone, "."))
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = dnsDefaultCache
+	}
+	return nil
+}
+
+func (c *DNSConfig) isLocal(name string) bool {
+	for _, zone := range c.Local {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+type dnsCacheEntry struct {
+	data   []byte
+	msg    *dns.Message
+	stored time.Time
+	expire time.Time
+}
+
+type dnsServer struct {
+	cfg    *DNSConfig
+	log    *utility.LogContext
+	lock   sync.Mutex
+	cache  map[string]*dnsCacheEntry
+	tunnel *dnsTunnel
+	hits   uint64
+	misses uint64
+}
+
+//activeDNS the dns server of the process for the metrics
+var activeDNS atomic.Value
+
+//dnsCacheStats return the cache hits and misses of the dns server
+func dnsCacheStats() (uint64, uint64) {
+	s, ok := activeDNS.Load().(*dnsServer)
+	if !ok {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses)
+}
+
+//dnsTunnel carry dns over tcp to the remote resolver, the queries are pipelined
+//on one tunnel connection and matched by id
+type dnsTunnel struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	codec   *tunnel.Codec
+	waiters map[uint16]chan []byte
+	nextID  uint16
+	cfg     *ServerConfig
+	remote  string
+	log     *utility.LogContext
+}
+
+//startDNS serve dns on udp and tcp
+func startDNS(cfg *DNSConfig, server *ServerConfig, logHandle *utility.LogModule) {
+	log := utility.NewLogContext(0, logHandle)
+	s := &dnsServer{
+		cfg:   cfg,
+		log:   log,
+		cache: make(map[string]*dnsCacheEntry),
+		tunnel: &dnsTunnel{
+			waiters: make(map[uint16]chan []byte),
+			cfg:     server,
+			remote:  cfg.Remote,
+			log:     log,
+		},
+	}
+	udpConn, err := net.ListenPacket("udp", cfg.Listen)
+	if err != nil {
+		log.LogWarn("failed to listen dns on udp:%s err:%v", cfg.Listen, err)
+		return
+	}
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		log.LogWarn("failed to listen dns on tcp:%s err:%v", cfg.Listen, err)
+		udpConn.Close()
+		return
+	}
+	if !listeners.add(udpConn) || !listeners.add(listener) {
+		listener.Close()
+		return
+	}
+	log.LogInfo("dns listen on addr:%s remote resolver:%s", cfg.Listen, cfg.Remote)
+	activeDNS.Store(s)
+	go s.serveTCP(listener)
+	s.serveUDP(udpConn)
+}
+
+func (s *dnsServer) serveUDP(conn net.PacketConn) {
+	defer utility.CatchPanic(s.log, nil)
+	for {
+		buf := make([]byte, dnsMaxMessageSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.log.LogWarn("dns udp listener exit:%v", err)
+			return
+		}
+		go func() {
+			resp := s.resolve(buf[:n], false)
+			if resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *dnsServer) serveTCP(listener net.Listener) {
+	defer utility.CatchPanic(s.log, nil)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.log.LogWarn("dns tcp listener exit:%v", err)
+			return
+		}
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *dnsServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetReadDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.resolve(query, true)
+		if resp == nil {
+			return
+		}
+		if _, err := conn.Write(tcpMessage(resp)); err != nil {
+			return
+		}
+	}
+}
+
+//readTCPMessage read one dns message prefixed by its 2 bytes length
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	_, size := utility.ReadUint16(head)
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func tcpMessage(msg []byte) []byte {
+	data := make([]byte, 2+len(msg))
+	utility.WriteUint16(data, uint16(len(msg)))
+	copy(data[2:], msg)
+	return data
+}
+
+//resolve answer a query, nil is returned when there is no answer
+func (s *dnsServer) resolve(query []byte, tcp bool) []byte {
+	m, err := dns.Parse(query)
+	if err != nil || m.IsResponse() {
+		s.log.LogWarn("invalid dns query:%v", err)
+		return nil
+	}
+	var resp []byte
+	if s.cfg.isLocal(m.Name) {
+		resp, err = exchangeLocal(s.cfg.LocalResolver, query, tcp)
+	} else if resp = s.lookupCache(m); resp == nil {
+		resp, err = s.tunnel.exchange(query)
+		if err == nil {
+			s.store(m, resp)
+		}
+	}
+	if err != nil {
+		s.log.LogWarn("failed to resolve name:%s type:%d err:%v", m.Name, m.Type, err)
+		return nil
+	}
+	s.log.LogDebug("resolve name:%s type:%d", m.Name, m.Type)
+	if tcp {
+		return resp
+	}
+	limit := dns.DefaultUDPLen
+	if int(m.UDPSize) > limit {
+		limit = int(m.UDPSize)
+	}
+	if len(resp) > limit {
+		if rm, err := dns.Parse(resp); err == nil {
+			return rm.Truncate(resp)
+		}
+	}
+	return resp
+}
+
+func (s *dnsServer) lookupCache(m *dns.Message) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	e, ok := s.cache[m.Key()]
+	if !ok || now.After(e.expire) {
+		atomic.AddUint64(&s.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&s.hits, 1)
+	resp := make([]byte, len(e.data))
+	copy(resp, e.data)
+	dns.SetID(resp, m.ID)
+	e.msg.AgeTTL(resp, uint32(now.Sub(e.stored)/time.Second))
+	return resp
+}
+
+func (s *dnsServer) store(m *dns.Message, resp []byte) {
+	rm, err := dns.Parse(resp)
+	if err != nil || rm.Truncated() {
+		return
+	}
+	if rm.Rcode() != dns.RcodeSuccess && rm.Rcode() != dns.RcodeNXDomain {
+		return
+	}
+	ttl := rm.MinTTL
+	if rm.Records == 0 {
+		ttl = dnsNegativeTTL
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.cache) >= s.cfg.CacheSize {
+		for k, e := range s.cache {
+			if now.After(e.expire) {
+				delete(s.cache, k)
+			}
+		}
+		for k := range s.cache {
+			if len(s.cache) < s.cfg.CacheSize {
+				break
+			}
+			delete(s.cache, k)
+		}
+	}
+	s.cache[m.Key()] = &dnsCacheEntry{
+		data:   resp,
+		msg:    rm,
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+//exchangeLocal send the query to the local resolver with the transport of the client
+func exchangeLocal(resolver string, query []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, resolver, dnsQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsQueryTimeout))
+	if tcp {
+		if _, err := conn.Write(tcpMessage(query)); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+//exchange send the query through the tunnel and wait for the response
+func (t *dnsTunnel) exchange(query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	t.lock.Lock()
+	if t.conn == nil {
+		conn, codec, err := t.cfg.tunnelServer().dial(tunnel.CmdConnect, t.remote, "")
+		if err != nil {
+			t.lock.Unlock()
+			return nil, err
+		}
+		t.conn, t.codec = conn, codec
+		go t.readLoop(conn, codec)
+	}
+	for {
+		t.nextID++
+		if _, ok := t.waiters[t.nextID]; !ok {
+			break
+		}
+	}
+	id := t.nextID
+	t.waiters[id] = ch
+	msg := tcpMessage(query)
+	dns.SetID(msg[2:], id)
+	conn := t.conn
+	_, err := conn.Write(t.codec.Encode(msg))
+	t.lock.Unlock()
+	if err != nil {
+		t.closeConn(conn, err)
+		return nil, err
+	}
+
+	_, origID := utility.ReadUint16(query)
+	select {
+	case resp := <-ch:
+		if resp == nil {
+			return nil, errors.New("dns tunnel closed")
+		}
+		dns.SetID(resp, origID)
+		return resp, nil
+	case <-time.After(dnsQueryTimeout):
+		t.lock.Lock()
+		delete(t.waiters, id)
+		t.lock.Unlock()
+		return nil, errors.New("dns query timeout")
+	}
+}
+
+//closeConn drop the tunnel connection and wake up all the waiting queries
+func (t *dnsTunnel) closeConn(conn net.Conn, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.conn != conn {
+		return
+	}
+	t.log.LogInfo("dns tunnel closed:%v", err)
+	conn.Close()
+	t.conn = nil
+	for id, ch := range t.waiters {
+		ch <- nil
+		delete(t.waiters, id)
+	}
+}
+
+func (t *dnsTunnel) readLoop(conn net.Conn, codec *tunnel.Codec) {
+	defer utility.CatchPanic(t.log, nil)
+	buf := make([]byte, dnsTunnelBufferLen)
+	var stream []byte
+	dataLen := 0
+	waitStatus := true
+	for {
+		n, err := conn.Read(buf[dataLen:])
+		if err != nil {
+			t.closeConn(conn, err)
+			return
+		}
+		dataLen += n
+		total := 0
+		for {
+			size, payload, err := codec.Decode(buf[total:dataLen])
+			if err != nil {
+				t.closeConn(conn, err)
+				return
+			}
+			if size == 0 {
+				break
+			}
+			total += size
+			if waitStatus {
+				waitStatus = false
+				if err := checkStatus(payload); err != nil {
+					t.closeConn(conn, err)
+					return
+				}
+				payload = payload[1:]
+			}
+			stream = append(stream, payload...)
+		}
+		copy(buf, buf[total:dataLen])
+		dataLen -= total
+		for len(stream) >= 2 {
+			_, size := utility.ReadUint16(stream)
+			if len(stream) < 2+int(size) {
+				break
+			}
+			t.dispatch(stream[2 : 2+int(size)])
+			stream = stream[2+int(size):]
+		}
+		stream = append([]byte(nil), stream...)
+	}
+}
+
+func (t *dnsTunnel) dispatch(msg []byte) {
+	if len(msg) < 2 {
+		return
+	}
+	_, id := utility.ReadUint16(msg)
+	t.lock.Lock()
+	ch, ok := t.waiters[id]
+	delete(t.waiters, id)
+	t.lock.Unlock()
+	if ok {
+		resp := make([]byte, len(msg))
+		copy(resp, msg)
+		ch <- resp
+	}
+}
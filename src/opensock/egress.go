@@ -0,0 +1,140 @@
+package opensock
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	rotateConn = ""
+	rotateDest = "dest"
+	rotateUser = "user"
+)
+
+//egress where the connections of an outbound leave the host: the source
+//address, taken from a pool, the interface and the firewall mark, and the
+//options of their sockets
+type egress struct {
+	sources []net.IP
+	rotate  string
+	iface   string
+	mark    int
+	socket  *SocketConfig
+	next    uint32
+}
+
+//newEgress check the egress fields of an outbound, nil when none is set
+func newEgress(out *OutboundConfig) (*egress, error) {
+	if len(out.Bind) == 0 && out.Interface == "" && out.Mark == 0 && out.Socket == nil {
+		if out.Rotate != "" {
+			return nil, errors.New("rotate without bind addresses")
+		}
+		return nil, nil
+	}
+	e := &egress{rotate: out.Rotate, iface: out.Interface, mark: out.Mark, socket: out.Socket}
+	for _, s := range out.Bind {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("invalid bind address:" + s)
+		}
+		e.sources = append(e.sources, ip)
+	}
+	switch e.rotate {
+	case rotateConn, rotateDest, rotateUser:
+	default:
+		return nil, errors.New("invalid rotate:" + e.rotate)
+	}
+	if e.mark < 0 {
+		return nil, errors.New("invalid mark:" + strconv.Itoa(e.mark))
+	}
+	if e.iface != "" || e.mark != 0 {
+		if err := socketControlSupported(); err != nil {
+			return nil, err
+		}
+	}
+	if e.socket != nil {
+		if err := e.socket.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+//dialer the dialer of a connection to dest for the session, req is nil for the
+//tunnels not carrying a session. The source is the next of the pool, or the one
+//the destination host or the user hashes to so they keep leaving by the same
+//address. Only the sources in the family of dest are taken
+func (e *egress) dialer(dest *net.TCPAddr, req *DialRequest, timeout time.Duration) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if e == nil {
+		return d, nil
+	}
+	if len(e.sources) > 0 {
+		v4 := dest.IP.To4() != nil
+		var pool []net.IP
+		for _, ip := range e.sources {
+			if (ip.To4() != nil) == v4 {
+				pool = append(pool, ip)
+			}
+		}
+		if len(pool) == 0 {
+			return nil, errors.New("no bind address in the family of:" + dest.String())
+		}
+		var i uint32
+		switch e.rotate {
+		case rotateDest:
+			key := dest.IP.String()
+			if req != nil {
+				key, _ = splitDest(req.Dest)
+			}
+			i = hashKey(key)
+		case rotateUser:
+			if req != nil {
+				i = hashKey(req.User)
+			}
+		default:
+			i = atomic.AddUint32(&e.next, 1)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: pool[i%uint32(len(pool))]}
+	}
+	if e.iface != "" || e.mark != 0 {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return controlSocket(c, e.control)
+		}
+	}
+	if e.socket != nil {
+		e.socket.dialer(d)
+	}
+	return d, nil
+}
+
+//dialTCP connect addr from the egress, e may be nil
+func (e *egress) dialTCP(addr *net.TCPAddr, req *DialRequest, timeout time.Duration) (*net.TCPConn, error) {
+	d, err := e.dialer(addr, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	tcp := conn.(*net.TCPConn)
+	if e != nil && e.socket != nil {
+		if err := e.socket.apply(tcp); err != nil {
+			tcp.Close()
+			return nil, errors.New("socket options:" + err.Error())
+		}
+	}
+	return tcp, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,20 @@
+package opensock
+
+import "syscall"
+
+func socketControlSupported() error {
+	return nil
+}
+
+//control bind the socket to the interface and set its mark, before it connects
+func (e *egress) control(fd uintptr) error {
+	if e.iface != "" {
+		if err := syscall.BindToDevice(int(fd), e.iface); err != nil {
+			return err
+		}
+	}
+	if e.mark != 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, e.mark)
+	}
+	return nil
+}
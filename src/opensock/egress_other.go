@@ -0,0 +1,15 @@
+// +build !linux
+
+package opensock
+
+import "errors"
+
+var errNoSocketControl = errors.New("the interface and the mark of an outbound are only supported on linux")
+
+func socketControlSupported() error {
+	return errNoSocketControl
+}
+
+func (e *egress) control(fd uintptr) error {
+	return errNoSocketControl
+}
@@ -0,0 +1,62 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"protocol/tunnel"
+	"strconv"
+)
+
+//ForwardConfig forward LocalPort on the client to Remote through the tunnel
+type ForwardConfig struct {
+	LocalPort int    `json:"localport"`
+	Remote    string `json:"remote"`
+}
+
+func (f *ForwardConfig) validate() error {
+	if f.LocalPort <= 0 || f.LocalPort > 65535 {
+		return errors.New("invalid forward local port:" + strconv.Itoa(f.LocalPort))
+	}
+	if _, _, err := net.SplitHostPort(f.Remote); err != nil {
+		return errors.New("invalid forward remote:" + f.Remote)
+	}
+	return nil
+}
+
+//resolveAddrs resolve host:port to all the addresses of the host
+func resolveAddrs(addr string) ([]*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return addrs, nil
+}
+
+//connectForward handle the CmdConnect handshake on the server
+func (t *tunnelSession) connectForward(arg string) (byte, error) {
+	if _, _, err := net.SplitHostPort(arg); err != nil {
+		return tunnel.StatusBadRequest, err
+	}
+	t.info.setDest("forward", arg)
+	req := &DialRequest{Dest: arg, Client: t.remote, Local: t.local, User: t.user.userName(), Trace: t.info.traceID()}
+	conn, err := dialRoute(t.cfg, req, t.info, t.log)
+	if err != nil {
+		return dialStatus(err), errors.New("failed to connect forward target:" + arg + " err:" + err.Error())
+	}
+	t.log.LogInfo("forward connection to:%s", arg)
+	up := NewUpstreamWithConn(conn, t.log)
+	t.delegate = newTunnelRelay(t.codec, up, true, t.limiter, t.cfg.Timeouts, t.log)
+	return tunnel.StatusOK, nil
+}
@@ -0,0 +1,155 @@
+package opensock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"utility"
+)
+
+//httpHeaderTimeout how long the client has to send the request headers
+const httpHeaderTimeout = 30 * time.Second
+
+//hopHeaders the headers of the proxy hop which are not passed on
+var hopHeaders = []string{"Proxy-Authorization", "Proxy-Connection", "Connection", "Keep-Alive", "Te", "Trailer", "Upgrade"}
+
+func init() {
+	RegisterInbound(inboundHTTP, newHTTPInbound)
+}
+
+//httpInbound an http proxy
+type httpInbound struct {
+	in *InboundConfig
+}
+
+func newHTTPInbound(in *InboundConfig) (Inbound, error) {
+	return &httpInbound{in: in}, nil
+}
+
+func (i *httpInbound) Accept(conn net.Conn, logHandle *utility.LogModule) {
+	go serveHTTP(conn, logHandle, i.in)
+}
+
+//serveHTTP handle one request of an http proxy client. CONNECT opens a tunnel
+//to the destination, any other request is passed on with Connection: close so
+//each connection carries one request
+func serveHTTP(conn net.Conn, logHandle *utility.LogModule, in *InboundConfig) {
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	conn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		log.LogWarn("invalid http request from:%s err:%v", conn.RemoteAddr().String(), err)
+		metrics.handshakeFailure("http_request")
+		replyHTTP(conn, http.StatusBadRequest, "")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	user, ok := in.session.authenticateHTTP(req)
+	if !ok {
+		log.LogWarn("http proxy auth failed from:%s", conn.RemoteAddr().String())
+		handshakeFailed(nil, conn.RemoteAddr(), "http_auth", log)
+		replyHTTP(conn, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"opensock\"\r\n")
+		return
+	}
+	release, ok := admitUser(user)
+	if !ok {
+		replyHTTP(conn, http.StatusServiceUnavailable, "")
+		return
+	}
+	c := &inboundConn{conn: conn, kind: inboundHTTP, user: user, release: release}
+	if req.Method == http.MethodConnect {
+		c.dest = withPort(req.Host, "443")
+		c.reply = func(err error) error {
+			if err != nil {
+				replyHTTP(conn, http.StatusBadGateway, "")
+				return nil
+			}
+			_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+			return err
+		}
+	} else {
+		if req.URL.Host == "" {
+			replyHTTP(conn, http.StatusBadRequest, "")
+			if release != nil {
+				release()
+			}
+			return
+		}
+		c.dest = withPort(req.URL.Host, "80")
+		c.buffered = originRequest(req)
+		c.reply = func(err error) error {
+			if err != nil {
+				replyHTTP(conn, http.StatusBadGateway, "")
+			}
+			return nil
+		}
+	}
+	//the body and what the client sent after the headers are still buffered
+	if n := reader.Buffered(); n > 0 {
+		rest, _ := reader.Peek(n)
+		c.buffered = append(c.buffered, rest...)
+	}
+	log.LogInfo("http %s %s from:%s", req.Method, c.dest, conn.RemoteAddr().String())
+	routeConn(c, logHandle, in.session)
+}
+
+//authenticateHTTP check the basic credentials of Proxy-Authorization when the
+//inbound has users
+func (cfg *ServerConfig) authenticateHTTP(req *http.Request) (*UserConfig, bool) {
+	if len(cfg.Users) == 0 {
+		return nil, true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return nil, false
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return nil, false
+	}
+	pair := strings.SplitN(string(data), ":", 2)
+	if len(pair) != 2 {
+		return nil, false
+	}
+	return cfg.authenticate(pair[0], pair[1])
+}
+
+//originRequest the request headers as sent to the destination, the request
+//line uses the origin form
+func originRequest(req *http.Request) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	if req.ContentLength > 0 && len(req.TransferEncoding) == 0 {
+		req.Header.Set("Content-Length", fmt.Sprint(req.ContentLength))
+	}
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", strings.Join(req.TransferEncoding, ", "))
+	}
+	req.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+//withPort add the default port to a host without one
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func replyHTTP(conn net.Conn, code int, header string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+	conn.Close()
+}
@@ -0,0 +1,392 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"netcore"
+	"strconv"
+	"utility"
+)
+
+const (
+	inboundSocks       = "socks"
+	inboundHTTP        = "http"
+	inboundTunnel      = "tunnel"
+	inboundForward     = "forward"
+	inboundTransparent = "transparent"
+)
+
+const (
+	routeDirect = "direct"
+	routeTunnel = "tunnel"
+	routeBlock  = "block"
+)
+
+//InboundConfig one listener of the process. Type is socks, http, tunnel (the
+//server end of the tunnel), forward or transparent. Users replace the users of
+//the config for this inbound: the socks username/password, the http basic auth
+//or the tunnel handshake. Route is direct or tunnel through serverip, Remote is
+//the target of a forward. Sniff makes the socks, http and transparent sessions
+//look for the domain in the first bytes of the client before the destination
+//is connected. ProxyProtocol reads the header of a load balancer in front.
+//Listen is ip:port or unix:path, SocketMode (octal) and SocketOwner (user,
+//user:group or :group) set the file of a unix socket
+type InboundConfig struct {
+	Tag           string               `json:"tag"`
+	Type          string               `json:"type"`
+	Listen        string               `json:"listen"`
+	Users         []*UserConfig        `json:"users"`
+	Route         string               `json:"route"`
+	Remote        string               `json:"remote"`
+	Sniff         bool                 `json:"sniff"`
+	ProxyProtocol *ProxyProtocolConfig `json:"proxyprotocol"`
+	SocketMode    string               `json:"socketmode"`
+	SocketOwner   string               `json:"socketowner"`
+	Socket        *SocketConfig        `json:"socket"`
+	legacy        bool                 //the socks listener of the client mode, the raw socks goes through the tunnel
+	session       *ServerConfig        //the config of the sessions accepted by the inbound
+	inbound       Inbound
+	unix          *unixSocket //the listener is a unix socket
+}
+
+//Inbound the protocol spoken by the clients of a listener. Accept takes over a
+//new connection, reads the request of the client until its destination is known
+//and reaches it through the outbound of the route with dialRoute. It runs on the
+//accept loop, so it must not block
+type Inbound interface {
+	Accept(conn net.Conn, logHandle *utility.LogModule)
+}
+
+//InboundFactory create the inbound of a config, it checks the fields of its type
+type InboundFactory func(in *InboundConfig) (Inbound, error)
+
+var inboundTypes = make(map[string]InboundFactory)
+
+//RegisterInbound add a type of inbound, the file implementing it calls it from init
+func RegisterInbound(typ string, factory InboundFactory) {
+	inboundTypes[typ] = factory
+}
+
+func init() {
+	RegisterInbound(inboundForward, newForwardInbound)
+}
+
+func (in *InboundConfig) validate(cfg *ServerConfig) error {
+	factory, ok := inboundTypes[in.Type]
+	if !ok {
+		return errors.New("invalid inbound type:" + in.Type)
+	}
+	if path, ok := unixPath(in.Listen); ok {
+		if in.Type == inboundTransparent {
+			return errors.New("transparent inbound on a unix socket:" + in.Listen)
+		}
+		var err error
+		if in.unix, err = parseUnixSocket(path, in.SocketMode, in.SocketOwner); err != nil {
+			return err
+		}
+	} else if _, _, err := splitListen(in.Listen); err != nil {
+		return errors.New("invalid inbound listen address:" + in.Listen)
+	} else if in.SocketMode != "" || in.SocketOwner != "" {
+		return errors.New("socketmode and socketowner need a unix socket:" + in.Listen)
+	}
+	if in.Socket != nil {
+		if in.unix != nil {
+			return errors.New("socket options need a tcp listen:" + in.Listen)
+		}
+		if err := in.Socket.validate(); err != nil {
+			return errors.New("inbound " + in.Listen + ":" + err.Error())
+		}
+	}
+	if in.Route == "" {
+		in.Route = routeDirect
+	}
+	if _, ok := cfg.outbounds[in.Route]; !ok {
+		if in.Route == routeTunnel {
+			return errors.New("serverip required by the inbound:" + in.Listen)
+		}
+		return errors.New("unknown route of inbound " + in.Listen + ":" + in.Route)
+	}
+	if _, ok := unixPath(in.Remote); ok && in.Type == inboundForward {
+		if _, direct := cfg.outbounds[in.Route].(*directOutbound); !direct {
+			return errors.New("the unix socket remote " + in.Remote + " needs a direct route")
+		}
+	}
+	for _, u := range in.Users {
+		if err := u.validate(); err != nil {
+			return err
+		}
+	}
+	if in.ProxyProtocol != nil {
+		if err := in.ProxyProtocol.validate(); err != nil {
+			return err
+		}
+	}
+	if in.Tag == "" {
+		in.Tag = in.Type + "@" + in.Listen
+	}
+	inbound, err := factory(in)
+	if err != nil {
+		return errors.New("inbound " + in.Tag + ":" + err.Error())
+	}
+	in.inbound = inbound
+	return nil
+}
+
+//splitListen split ip:port for netcore.ListenTCP
+func splitListen(listen string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, errors.New("invalid port:" + portStr)
+	}
+	return host, port, nil
+}
+
+//legacyInbounds the listeners implied by mode and bindaddr, and the forwards of the client mode
+func (cfg *ServerConfig) legacyInbounds() []*InboundConfig {
+	var inbounds []*InboundConfig
+	switch cfg.Mode {
+	case "standard":
+		inbounds = append(inbounds, &InboundConfig{Type: inboundSocks, Listen: cfg.BindAddr, Route: routeDirect, Sniff: cfg.Sniff, ProxyProtocol: cfg.ProxyProtocol, Socket: cfg.Socket})
+	case "server":
+		inbounds = append(inbounds, &InboundConfig{Type: inboundTunnel, Listen: cfg.BindAddr, Sniff: cfg.Sniff, ProxyProtocol: cfg.ProxyProtocol, Socket: cfg.Socket})
+	case "client":
+		inbounds = append(inbounds, &InboundConfig{Type: inboundSocks, Listen: cfg.BindAddr, Route: routeTunnel, ProxyProtocol: cfg.ProxyProtocol, Socket: cfg.Socket, legacy: true})
+		host, _, _ := net.SplitHostPort(cfg.BindAddr)
+		for _, f := range cfg.Forwards {
+			inbounds = append(inbounds, &InboundConfig{
+				Type:   inboundForward,
+				Listen: net.JoinHostPort(host, strconv.Itoa(f.LocalPort)),
+				Route:  routeTunnel,
+				Remote: f.Remote,
+				Socket: cfg.Socket,
+			})
+		}
+	}
+	return inbounds
+}
+
+//buildInbounds check the mode and collect all the inbounds with the config of
+//their sessions
+func (cfg *ServerConfig) buildInbounds() error {
+	switch cfg.Mode {
+	case "client":
+		if cfg.ServerIP == "" {
+			return errors.New("serverip required in client mode")
+		}
+	case "server", "standard":
+	case "":
+		if len(cfg.Inbounds) == 0 {
+			return errors.New("mode or inbounds required")
+		}
+	default:
+		return errors.New("invalid mode:" + cfg.Mode)
+	}
+	if cfg.Mode != "" {
+		if _, _, err := splitListen(cfg.BindAddr); err != nil {
+			return errors.New("invalid bindaddr:" + cfg.BindAddr)
+		}
+	}
+	inbounds := append(cfg.legacyInbounds(), cfg.Inbounds...)
+	tags := make(map[string]bool)
+	for _, in := range inbounds {
+		if err := in.validate(cfg); err != nil {
+			return err
+		}
+		if tags[in.Tag] {
+			return errors.New("duplicate inbound tag:" + in.Tag)
+		}
+		tags[in.Tag] = true
+	}
+	for _, in := range inbounds {
+		in.session = cfg.sessionConfig(in)
+	}
+	cfg.inbounds = inbounds
+	return nil
+}
+
+//sessionConfig derive the config of the sessions of an inbound
+func (cfg *ServerConfig) sessionConfig(in *InboundConfig) *ServerConfig {
+	c := *cfg
+	c.BindAddr = in.Listen
+	c.route = in.Route
+	c.sniff = in.Sniff
+	if in.Users != nil {
+		c.Users = in.Users
+		c.socksAuth = in.Type == inboundSocks
+	}
+	return &c
+}
+
+//listenerKey identify the listeners of the inbounds, they can't change without restart
+func (cfg *ServerConfig) listenerKey() string {
+	key := ""
+	for _, in := range cfg.inbounds {
+		key += in.Tag + " " + in.Type + " " + in.Listen + " " + strconv.FormatBool(in.legacy) + " " + in.Socket.listenKey() + "\n"
+	}
+	return key
+}
+
+//listenInbounds open the listeners of all the inbounds, none is left open on error
+func (serv *SockServer) listenInbounds(cfg *ServerConfig) ([]net.Listener, error) {
+	lns := make([]net.Listener, 0, len(cfg.inbounds))
+	for _, in := range cfg.inbounds {
+		var ln net.Listener
+		var err error
+		if in.unix != nil {
+			ln, err = in.unix.listen()
+		} else {
+			host, port, _ := splitListen(in.Listen)
+			ln, err = in.Socket.listen(host, port)
+		}
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, errors.New("inbound " + in.Tag + ":" + err.Error())
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+//inboundHandler serve the connections of an inbound with its current config
+func inboundHandler(tag string) netcore.ClientInitHandler {
+	return func(conn net.Conn, logHandle *utility.LogModule) {
+		metrics.acceptConn()
+		in := currentState().inbound(tag)
+		if in == nil {
+			conn.Close()
+			return
+		}
+		in.accept(conn, logHandle)
+	}
+}
+
+//accept hand a new connection to the inbound, after the header of the proxy in front
+func (in *InboundConfig) accept(conn net.Conn, logHandle *utility.LogModule) {
+	if in.Socket != nil {
+		if tcp, ok := netcore.TCPConn(conn); ok {
+			if err := in.Socket.apply(tcp); err != nil {
+				utility.NewLogContext(0, logHandle).LogWarn("socket options of connection:%s on inbound:%s err:%v", conn.RemoteAddr().String(), in.Tag, err)
+			}
+		}
+	}
+	if in.ProxyProtocol != nil {
+		go acceptProxied(conn, logHandle, in)
+		return
+	}
+	in.admit(conn, logHandle)
+}
+
+//admit check the limits of the admission control for the client of conn, the
+//one of the PROXY protocol header when there is one, before the inbound takes it
+func (in *InboundConfig) admit(conn net.Conn, logHandle *utility.LogModule) {
+	admitted, err := admission.Admit(conn)
+	if err != nil {
+		utility.NewLogContext(0, logHandle).LogInfo("reject connection:%s on inbound:%s reason:%v", conn.RemoteAddr().String(), in.Tag, err)
+		conn.Close()
+		return
+	}
+	in.inbound.Accept(admitted, logHandle)
+}
+
+//inboundConn a connection accepted by an inbound whose destination is known
+type inboundConn struct {
+	conn     net.Conn
+	kind     string
+	dest     string
+	network  string //unix when dest is a unix socket, empty for tcp
+	user     *UserConfig
+	buffered []byte           //read from the client after the request
+	reply    func(error) error //tell the client whether the destination is connected
+	release  func()           //called when the session ends
+}
+
+//routeConn carry the connection to its destination through the outbound of
+//the route and relay until both sides finish
+func routeConn(c *inboundConn, logHandle *utility.LogModule, cfg *ServerConfig) {
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	info := sessions.add(c.kind, c.conn.RemoteAddr().String(), log)
+	info.setDest(c.kind, c.dest)
+	info.setUser(c.user.userName())
+	defer sessions.remove(info)
+	if c.release != nil {
+		//before the session is removed, like the other sessions
+		defer c.release()
+	}
+	req := &DialRequest{Dest: c.dest, Network: c.network, Client: c.conn.RemoteAddr(), Local: c.conn.LocalAddr(), User: c.user.userName(), Trace: info.traceID()}
+	if cfg.sniff && !c.sniff(req, cfg) {
+		info.setReason("client_reset")
+		c.conn.Close()
+		return
+	}
+	dest, err := dialRoute(cfg, req, info, log)
+	if c.reply != nil {
+		if replyErr := c.reply(err); err == nil && replyErr != nil {
+			info.setReason("client_reset")
+			dest.Close()
+			err = replyErr
+		}
+	}
+	if err != nil {
+		log.LogWarn("failed to connect:%s err:%v", c.dest, err)
+		c.conn.Close()
+		return
+	}
+	limiter := currentState().limits.newSessionLimiter(c.user, info)
+	relay := newDirectRelay(c.conn, dest, cfg.Timeouts, limiter, log)
+	relay.info = info
+	info.setKill(func() { relay.close(false) })
+	relay.run(c.buffered)
+}
+
+//sniff grant the request of the client, then read its first bytes to find the
+//domain of the destination. A failure to connect can't be replied afterwards
+func (c *inboundConn) sniff(req *DialRequest, cfg *ServerConfig) bool {
+	if c.reply != nil {
+		err := c.reply(nil)
+		c.reply = nil
+		if err != nil {
+			return false
+		}
+	}
+	var err error
+	req.Domain, c.buffered, err = sniffConn(c.conn, c.buffered, cfg.SniffTimeout)
+	return err == nil
+}
+
+//forwardInbound carry every connection to the remote of the config
+type forwardInbound struct {
+	in *InboundConfig
+}
+
+func newForwardInbound(in *InboundConfig) (Inbound, error) {
+	if !validAddr(in.Remote) {
+		return nil, errors.New("invalid forward remote:" + in.Remote)
+	}
+	return &forwardInbound{in: in}, nil
+}
+
+func (i *forwardInbound) Accept(conn net.Conn, logHandle *utility.LogModule) {
+	c := &inboundConn{conn: conn, kind: inboundForward, dest: i.in.Remote}
+	if _, ok := unixPath(i.in.Remote); ok {
+		c.network = networkUnix
+	}
+	go routeConn(c, logHandle, i.in.session)
+}
+
+//admitUser take a session slot of the user, release gives it back
+func admitUser(user *UserConfig) (release func(), ok bool) {
+	if user == nil {
+		return nil, true
+	}
+	if !admission.AdmitUser(user.Name) {
+		return nil, false
+	}
+	return func() { admission.ReleaseUser(user.Name) }, true
+}
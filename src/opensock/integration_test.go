@@ -0,0 +1,1032 @@
+package opensock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"netcore"
+	"os"
+	"path/filepath"
+	"protocol/proxyproto"
+	"protocol/socks"
+	"protocol/tunnel"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"utility"
+)
+
+const (
+	testKey     = "integration"
+	testTimeout = 10 * time.Second
+)
+
+var errSocksAuth = errors.New("socks auth failed")
+
+//startNode build cfg and serve its inbounds on loopback like Main does, without
+//the signals, the admin and the stats. The listen addresses take port 0, it
+//returns the address each inbound got
+func startNode(t testing.TB, name string, cfg *ServerConfig) []string {
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.buildOutbounds(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.buildRules(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.buildInbounds(); err != nil {
+		t.Fatal(err)
+	}
+	logHandle := utility.NewLog(name, "WARN", 0, t.TempDir())
+	t.Cleanup(logHandle.Exit)
+	log := utility.NewLogContext(0, logHandle)
+	lns, err := (&SockServer{}).listenInbounds(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := make([]string, 0, len(lns))
+	for i, in := range cfg.inbounds {
+		ln := lns[i]
+		t.Cleanup(func() { ln.Close() })
+		addrs = append(addrs, ln.Addr().String())
+		go netcore.ServeTCPThrottled(ln, log, admission, in.accept)
+	}
+	return addrs
+}
+
+//withAdmission enable the admission control of the nodes started after it
+//until the end of the test
+func withAdmission(t testing.TB, cfg *netcore.AdmissionConfig) {
+	admission = netcore.NewAdmission(cfg)
+	t.Cleanup(func() {
+		//the sessions give their slots back before they are removed
+		if !waitSessions(testTimeout, nil) {
+			t.Errorf("%d sessions left", sessions.count())
+		}
+		admission = nil
+	})
+}
+
+//testMode start the proxies of a mode, the rules go to the node reaching the
+//destinations. It returns the address of the socks listener of the clients
+type testMode struct {
+	name  string
+	start func(t testing.TB, rules []*RuleConfig) string
+}
+
+var testModes = []testMode{
+	{"standard", func(t testing.TB, rules []*RuleConfig) string {
+		return startNode(t, "standard", &ServerConfig{Mode: "standard", BindAddr: "127.0.0.1:0", Rules: rules})[0]
+	}},
+	{"standard_poll", func(t testing.TB, rules []*RuleConfig) string {
+		return startNode(t, "standard", &ServerConfig{Mode: "standard", BindAddr: "127.0.0.1:0", NoDirectCopy: true, Rules: rules})[0]
+	}},
+	{"client_server", func(t testing.TB, rules []*RuleConfig) string {
+		server := startServer(t, rules)
+		return startNode(t, "client", &ServerConfig{Mode: "client", BindAddr: "127.0.0.1:0", ServerIP: server, Key: testKey})[0]
+	}},
+	{"socks_tunnel", func(t testing.TB, rules []*RuleConfig) string {
+		server := startServer(t, rules)
+		cfg := &ServerConfig{
+			ServerIP: server,
+			Key:      testKey,
+			Inbounds: []*InboundConfig{{Type: inboundSocks, Listen: "127.0.0.1:0", Route: routeTunnel}},
+		}
+		return startNode(t, "client", cfg)[0]
+	}},
+}
+
+//startServer start the server end of the tunnel
+func startServer(t testing.TB, rules []*RuleConfig) string {
+	return startNode(t, "server", &ServerConfig{Mode: "server", BindAddr: "127.0.0.1:0", Key: testKey, Rules: rules})[0]
+}
+
+//socksConnect run the handshake of a socks5 client on conn, user is empty
+//without authentication. dest is ip:port or domain:port
+func socksConnect(conn net.Conn, dest, user, password string) error {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	method := byte(0)
+	if user != "" {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[1] != method {
+		return errors.New("socks method refused")
+	}
+	if user != "" {
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errSocksAuth
+		}
+	}
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, 1), ip...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("socks reply:" + strconv.Itoa(int(reply[1])))
+	}
+	addrLen := net.IPv4len
+	switch reply[3] {
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		addrLen = int(size[0])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+//dialTest connect dest through the socks proxy
+func dialTest(proxy, dest, user, password string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if err := socksConnect(conn, dest, user, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//echoDest a destination sending back what it receives, it closes its side
+//after the EOF of the client
+func echoDest(t testing.TB) string {
+	return startDest(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(conn, conn)
+		conn.(*net.TCPConn).CloseWrite()
+	}).String()
+}
+
+//closedAddr an address nothing listens on
+func closedAddr(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+//checkCleanup fail when the sessions and their goroutines started since it
+//was called are still running. The sessions end asynchronously after the
+//clients close, so it waits a little
+func checkCleanup(t testing.TB) func() {
+	base := runtime.NumGoroutine()
+	return func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for runtime.NumGoroutine() > base || sessions.count() > 0 {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<20)
+				buf = buf[:runtime.Stack(buf, true)]
+				t.Fatalf("%d goroutines and %d sessions left, %d goroutines before\n%s",
+					runtime.NumGoroutine(), sessions.count(), base, buf)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+//echoData stream size random bytes through conn and check they come back
+//untouched, the half close of the client must reach the destination
+func echoData(conn net.Conn, size int) error {
+	data := make([]byte, size)
+	rand.Read(data)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		if err == nil {
+			err = conn.(interface{ CloseWrite() error }).CloseWrite()
+		}
+		errc <- err
+	}()
+	got, err := io.ReadAll(conn)
+	if werr := <-errc; werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, data) {
+		return errors.New("received " + strconv.Itoa(len(got)) + " bytes differing from the " + strconv.Itoa(size) + " sent")
+	}
+	return nil
+}
+
+func TestIntegrationEcho(t *testing.T) {
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			dest := echoDest(t)
+			defer checkCleanup(t)()
+			sizes := []int{1, 1000, 64 * 1024, 1 << 20, 3<<20 + 7}
+			var wg sync.WaitGroup
+			for _, size := range sizes {
+				wg.Add(1)
+				go func(size int) {
+					defer wg.Done()
+					conn, err := dialTest(proxy, dest, "", "")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer conn.Close()
+					if err := echoData(conn, size); err != nil {
+						t.Errorf("echo of %d bytes:%v", size, err)
+					}
+				}(size)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestIntegrationHTTP(t *testing.T) {
+	body := make([]byte, 256*1024)
+	rand.Read(body)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Host", r.Host)
+		w.Write(body)
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			defer checkCleanup(t)()
+			transport := &http.Transport{
+				Proxy:             http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxy}),
+				DisableKeepAlives: true,
+			}
+			defer transport.CloseIdleConnections()
+			client := &http.Client{Transport: transport, Timeout: testTimeout}
+			//the proxy resolves localhost, the socks request carries the domain
+			for _, host := range []string{"127.0.0.1", "localhost"} {
+				resp, err := client.Get("http://" + net.JoinHostPort(host, port) + "/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusOK || !bytes.Equal(got, body) {
+					t.Fatalf("get through %s: status %d with %d bytes", host, resp.StatusCode, len(got))
+				}
+				if h := resp.Header.Get("X-Host"); h != net.JoinHostPort(host, port) {
+					t.Fatalf("the target saw host %s", h)
+				}
+			}
+		})
+	}
+}
+
+//TestIntegrationErrors the clients asking for a destination that can't be
+//reached get the reply telling why, the proxy keeps serving. The tunnel modes
+//reply once the server connected, so they fail the same way
+func TestIntegrationErrors(t *testing.T) {
+	rules := []*RuleConfig{{Domains: []string{"blocked.test"}, Outbound: routeBlock}}
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, rules)
+			dest := echoDest(t)
+			defer checkCleanup(t)()
+			cases := []struct {
+				dest  string
+				reply int
+			}{
+				{closedAddr(t), socks.RepConnRefused},
+				{"blocked.test:80", socks.RepNotAllowed},
+				{"www.blocked.test:443", socks.RepNotAllowed},
+				{"unresolvable.invalid:80", socks.RepHostUnreachable},
+			}
+			for _, c := range cases {
+				conn, err := dialTest(proxy, c.dest, "", "")
+				if err == nil {
+					conn.Close()
+					t.Fatalf("connect %s: granted", c.dest)
+				}
+				if want := "socks reply:" + strconv.Itoa(c.reply); err.Error() != want {
+					t.Errorf("connect %s: err:%v, %s expected", c.dest, err, want)
+				}
+			}
+			conn, err := dialTest(proxy, dest, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := echoData(conn, 4096); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIntegrationSocksAuth(t *testing.T) {
+	users := []*UserConfig{{Name: "alice", Password: "secret"}}
+	cfg := &ServerConfig{Inbounds: []*InboundConfig{{Type: inboundSocks, Listen: "127.0.0.1:0", Users: users}}}
+	proxy := startNode(t, "auth", cfg)[0]
+	dest := echoDest(t)
+	defer checkCleanup(t)()
+	for _, password := range []string{"wrong", ""} {
+		conn, err := dialTest(proxy, dest, "alice", password)
+		if err != errSocksAuth {
+			if conn != nil {
+				conn.Close()
+			}
+			t.Fatalf("password %q: err:%v, the auth failure reply expected", password, err)
+		}
+	}
+	if _, err := dialTest(proxy, dest, "", ""); err == nil {
+		t.Fatal("connected without auth")
+	}
+	conn, err := dialTest(proxy, dest, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := echoData(conn, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//TestIntegrationClientClose the sessions end with their relays when the clients
+//go away in the middle of a transfer
+func TestIntegrationClientClose(t *testing.T) {
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			dest := startDest(t, func(conn net.Conn) {
+				defer conn.Close()
+				chunk := make([]byte, 32*1024)
+				for {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}).String()
+			defer checkCleanup(t)()
+			for i := 0; i < 4; i++ {
+				conn, err := dialTest(proxy, dest, "", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := io.ReadFull(conn, make([]byte, 256*1024)); err != nil {
+					t.Fatal(err)
+				}
+				if i%2 == 1 {
+					//reset instead of a clean close
+					conn.(*net.TCPConn).SetLinger(0)
+				}
+				conn.Close()
+			}
+		})
+	}
+}
+
+//TestIntegrationProxyProtocol a socks inbound behind a load balancer takes the
+//client from the header, and its outbound tells the destination
+func TestIntegrationProxyProtocol(t *testing.T) {
+	dest := startDest(t, func(conn net.Conn) {
+		defer conn.Close()
+		h, _, err := proxyproto.Read(conn)
+		if err != nil || h == nil || h.Source == nil {
+			return
+		}
+		io.WriteString(conn, h.Source.String()+" "+h.Dest.String()+"\n")
+		io.Copy(conn, conn)
+	}).String()
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	balancer := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}
+	for _, version := range []int{1, 2} {
+		t.Run("v"+strconv.Itoa(version), func(t *testing.T) {
+			cfg := &ServerConfig{
+				Inbounds: []*InboundConfig{
+					{Tag: "required", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "pp", ProxyProtocol: &ProxyProtocolConfig{Required: true, Trusted: []string{"127.0.0.0/8"}}},
+					{Tag: "any", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "pp", ProxyProtocol: &ProxyProtocolConfig{Trusted: []string{"0.0.0.0/0", "::/0"}}},
+					{Tag: "other", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "pp", ProxyProtocol: &ProxyProtocolConfig{Trusted: []string{"192.0.2.1"}}},
+				},
+				Outbounds: []*OutboundConfig{{Tag: "pp", Type: outboundDirect, ProxyProtocol: version}},
+			}
+			addrs := startNode(t, "proxyprotocol", cfg)
+			defer checkCleanup(t)()
+			header := (&proxyproto.Header{Source: client, Dest: balancer}).Format(version)
+			//the destination sees the client of the header, or the test itself
+			//without header and when the source isn't trusted
+			proxied := client.String() + " " + balancer.String() + "\n"
+			cases := []struct {
+				addr   string
+				header []byte
+			}{
+				{addrs[0], header},
+				{addrs[1], header},
+				{addrs[1], nil},
+				{addrs[2], nil},
+			}
+			for _, c := range cases {
+				conn, err := net.Dial("tcp", c.addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(testTimeout))
+				conn.Write(c.header)
+				if err := socksConnect(conn, dest, "", ""); err != nil {
+					conn.Close()
+					t.Fatal(err)
+				}
+				direct := conn.LocalAddr().String() + " " + c.addr + "\n"
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				conn.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.header != nil && line != proxied || c.header == nil && line != direct {
+					t.Fatalf("the destination of %s saw %q", c.addr, line)
+				}
+			}
+			conn, err := net.Dial("tcp", addrs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(testTimeout))
+			if err := socksConnect(conn, dest, "", ""); err == nil {
+				t.Fatal("connected without the required header")
+			}
+		})
+	}
+}
+
+//TestIntegrationProxyAdmission the admission control of an inbound behind a load
+//balancer counts and bans the clients of the headers, not the balancer
+func TestIntegrationProxyAdmission(t *testing.T) {
+	withAdmission(t, &netcore.AdmissionConfig{MaxPerIP: 1, BanThreshold: 1, BanTime: 60})
+	cfg := &ServerConfig{Inbounds: []*InboundConfig{{
+		Tag:           "pp",
+		Type:          inboundSocks,
+		Listen:        "127.0.0.1:0",
+		Users:         []*UserConfig{{Name: "alice", Password: "secret"}},
+		ProxyProtocol: &ProxyProtocolConfig{Required: true, Trusted: []string{"127.0.0.0/8"}},
+	}}}
+	proxy := startNode(t, "proxyadmission", cfg)[0]
+	dest := echoDest(t)
+	defer checkCleanup(t)()
+	dial := func(client, password string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(testTimeout))
+		h := &proxyproto.Header{Source: &net.TCPAddr{IP: net.ParseIP(client), Port: 4242}, Dest: conn.RemoteAddr().(*net.TCPAddr)}
+		conn.Write(h.Format(2))
+		if err := socksConnect(conn, dest, "alice", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	first, err := dial("203.0.113.1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := dial("203.0.113.2", "secret")
+	if err != nil {
+		t.Fatalf("the second client counted with the first, err:%v", err)
+	}
+	defer second.Close()
+	if conn, err := dial("203.0.113.1", "secret"); err == nil {
+		conn.Close()
+		t.Fatal("a second connection of the first client accepted")
+	}
+	if conn, err := dial("203.0.113.3", "wrong"); err == nil {
+		conn.Close()
+		t.Fatal("connected with a wrong password")
+	}
+	if conn, err := dial("203.0.113.3", "secret"); err == nil {
+		conn.Close()
+		t.Fatal("the banned client connected")
+	}
+	conn, err := dial("203.0.113.4", "secret")
+	if err != nil {
+		t.Fatalf("the ban of a client hit the balancer, err:%v", err)
+	}
+	conn.Close()
+	if stats := admission.Stats(); stats.RejectedIP != 1 || stats.RejectedBanned != 1 {
+		t.Fatalf("admission stats %+v", stats)
+	}
+}
+
+//TestIntegrationUnix the inbounds listen on unix sockets, a forward reaches a
+//unix socket and a client reaches its server by one
+func TestIntegrationUnix(t *testing.T) {
+	dir := t.TempDir()
+	echo := filepath.Join(dir, "echo.sock")
+	ln, err := net.Listen("unix", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+				conn.(*net.UnixConn).CloseWrite()
+			}()
+		}
+	}()
+	tcpEcho := echoDest(t)
+	server := filepath.Join(dir, "server.sock")
+	startNode(t, "server", &ServerConfig{Key: testKey, Inbounds: []*InboundConfig{{Type: inboundTunnel, Listen: "unix:" + server}}})
+	socks := filepath.Join(dir, "socks.sock")
+	cfg := &ServerConfig{
+		ServerIP: "unix:" + server,
+		Key:      testKey,
+		Inbounds: []*InboundConfig{
+			{Type: inboundSocks, Listen: "unix:" + socks, Route: routeTunnel, SocketMode: "0600"},
+			{Type: inboundForward, Listen: "127.0.0.1:0", Remote: "unix:" + echo},
+		},
+	}
+	addrs := startNode(t, "client", cfg)
+	defer checkCleanup(t)()
+	if fi, err := os.Stat(socks); err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket file %v err:%v", fi.Mode(), err)
+	}
+	conn, err := net.Dial("unix", socks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if err := socksConnect(conn, tcpEcho, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	err = echoData(conn, 1<<20)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = net.Dial("tcp", addrs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	err = echoData(conn, 1<<20)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//TestIntegrationEgress the outbounds leave from the sources of their pool, in
+//turn or kept by user and by destination, and by the interface they name
+func TestIntegrationEgress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the loopback addresses besides 127.0.0.1 and the interface are linux only")
+	}
+	dest := startDest(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.WriteString(conn, addrIP(conn.RemoteAddr()).String()+"\n")
+	}).String()
+	bind := []string{"127.0.0.1", "127.0.0.2"}
+	users := []*UserConfig{{Name: "alice", Password: "secret"}, {Name: "bob", Password: "secret"}}
+	cfg := &ServerConfig{
+		Inbounds: []*InboundConfig{
+			{Tag: "conn", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "conn"},
+			{Tag: "user", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "user", Users: users},
+			{Tag: "dest", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "dest"},
+			{Tag: "lo", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "lo"},
+			{Tag: "none", Type: inboundSocks, Listen: "127.0.0.1:0", Route: "none"},
+		},
+		Outbounds: []*OutboundConfig{
+			{Tag: "conn", Type: outboundDirect, Bind: bind},
+			{Tag: "user", Type: outboundDirect, Bind: bind, Rotate: rotateUser},
+			{Tag: "dest", Type: outboundDirect, Bind: bind, Rotate: rotateDest},
+			{Tag: "lo", Type: outboundDirect, Bind: bind[1:], Interface: "lo"},
+			{Tag: "none", Type: outboundDirect, Interface: "opensock-none"},
+		},
+	}
+	if os.Geteuid() == 0 {
+		//setting the mark takes CAP_NET_ADMIN
+		cfg.Outbounds[3].Mark = 7
+	}
+	addrs := startNode(t, "egress", cfg)
+	defer checkCleanup(t)()
+	source := func(proxy, user string) string {
+		conn, err := dialTest(proxy, dest, user, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line[:len(line)-1]
+	}
+	first := source(addrs[0], "")
+	for i := 1; i < 4; i++ {
+		if s := source(addrs[0], ""); (s == first) != (i%2 == 0) {
+			t.Fatalf("connection %d left from %s after %s", i, s, first)
+		}
+	}
+	for _, c := range []struct{ proxy, user string }{{addrs[1], "alice"}, {addrs[1], "bob"}, {addrs[2], ""}} {
+		first := source(c.proxy, c.user)
+		for i := 0; i < 3; i++ {
+			if s := source(c.proxy, c.user); s != first {
+				t.Fatalf("%s %q left from %s then %s", c.proxy, c.user, first, s)
+			}
+		}
+	}
+	if s := source(addrs[3], ""); s != bind[1] {
+		t.Fatalf("left lo from %s", s)
+	}
+	conn, err := dialTest(addrs[4], dest, "", "")
+	if err == nil {
+		conn.Close()
+		t.Fatal("connected through a missing interface")
+	}
+}
+
+//TestIntegrationSocketOptions the sessions go through a listener and an outbound
+//with all their socket options, and the invalid ones are refused
+func TestIntegrationSocketOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fastopen and mptcp are linux only")
+	}
+	noDelay := false
+	socket := &SocketConfig{
+		NoDelay:           &noDelay,
+		KeepAliveIdle:     30,
+		KeepAliveInterval: 5,
+		KeepAliveCount:    3,
+		SendBuffer:        256 * 1024,
+		RecvBuffer:        256 * 1024,
+		FastOpen:          true,
+		MultipathTCP:      true,
+	}
+	cfg := &ServerConfig{
+		Inbounds:  []*InboundConfig{{Type: inboundSocks, Listen: "127.0.0.1:0", Route: "tuned", Socket: socket}},
+		Outbounds: []*OutboundConfig{{Tag: "tuned", Type: outboundDirect, Socket: socket}},
+	}
+	proxy := startNode(t, "socket", cfg)[0]
+	dest := echoDest(t)
+	defer checkCleanup(t)()
+	for i := 0; i < 2; i++ {
+		conn, err := dialTest(proxy, dest, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = echoData(conn, 1<<20)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := []*SocketConfig{
+		{KeepAliveIdle: -2},
+		{KeepAliveIdle: -1, KeepAliveCount: 3},
+		{KeepAliveCount: maxKeepAliveCount + 1},
+		{RecvBuffer: -1},
+	}
+	for _, s := range invalid {
+		cfg := &ServerConfig{Mode: "standard", BindAddr: "127.0.0.1:0", Socket: s}
+		if err := cfg.validate(); err == nil {
+			t.Fatalf("socket options %s accepted", s)
+		}
+	}
+	cfg = &ServerConfig{Inbounds: []*InboundConfig{{Type: inboundSocks, Listen: "unix:" + filepath.Join(t.TempDir(), "s"), Socket: &SocketConfig{}}}}
+	if err := cfg.buildOutbounds(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.buildInbounds(); err == nil {
+		t.Fatal("socket options accepted on a unix socket")
+	}
+}
+
+//TestIntegrationTunnelReplay a captured tunnel connection sent again is refused
+//before the handshake is answered
+func TestIntegrationTunnelReplay(t *testing.T) {
+	server := startServer(t, nil)
+	dest := echoDest(t)
+	defer checkCleanup(t)()
+	codec, hello, err := tunnel.NewClientCodec(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := &tunnel.Handshake{Cmd: tunnel.CmdConnect, Arg: dest}
+	captured := append(hello, codec.Encode(hs.Marshal())...)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(testTimeout))
+		conn.Write(captured)
+		reply, err := io.ReadAll(io.LimitReader(conn, 1))
+		conn.Close()
+		if i == 0 && len(reply) == 0 {
+			t.Fatalf("first connection err:%v", err)
+		}
+		if i == 1 && len(reply) != 0 {
+			t.Fatal("the replayed handshake was answered")
+		}
+	}
+}
+
+//TestIntegrationAdmission the sessions accepted by the admission control relay
+//with their half close and give their slots back
+func TestIntegrationAdmission(t *testing.T) {
+	withAdmission(t, &netcore.AdmissionConfig{MaxSessions: 100, MaxPerIP: 100})
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			dest := echoDest(t)
+			defer checkCleanup(t)()
+			conn, err := dialTest(proxy, dest, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = echoData(conn, 256*1024)
+			conn.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	deadline := time.Now().Add(testTimeout)
+	for admission.Stats().Active > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("admission stats %+v", admission.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//TestIntegrationHalfClose the destination shuts down its side first and keeps
+//receiving, on connections accepted by the admission control
+func TestIntegrationHalfClose(t *testing.T) {
+	withAdmission(t, &netcore.AdmissionConfig{MaxSessions: 100, MaxPerIP: 100})
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			received := make(chan int, 1)
+			dest := startDest(t, func(conn net.Conn) {
+				defer conn.Close()
+				io.WriteString(conn, "banner")
+				conn.(*net.TCPConn).CloseWrite()
+				n, _ := io.Copy(io.Discard, conn)
+				received <- int(n)
+			}).String()
+			defer checkCleanup(t)()
+			conn, err := dialTest(proxy, dest, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			banner, err := io.ReadAll(conn)
+			if err != nil || string(banner) != "banner" {
+				t.Fatalf("banner %q err:%v", banner, err)
+			}
+			if _, err := conn.Write(make([]byte, 64*1024)); err != nil {
+				t.Fatal(err)
+			}
+			conn.(*net.TCPConn).CloseWrite()
+			select {
+			case n := <-received:
+				if n != 64*1024 {
+					t.Fatalf("the destination received %d bytes after its half close", n)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("the half close of the client didn't reach the destination")
+			}
+			if _, err := io.ReadAll(conn); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+//TestIntegrationReset a reset by the destination reaches the client through
+//connections accepted by the admission control
+func TestIntegrationReset(t *testing.T) {
+	withAdmission(t, &netcore.AdmissionConfig{MaxSessions: 100, MaxPerIP: 100})
+	for _, mode := range testModes {
+		t.Run(mode.name, func(t *testing.T) {
+			proxy := mode.start(t, nil)
+			dest := startDest(t, func(conn net.Conn) {
+				io.WriteString(conn, "banner")
+				io.ReadFull(conn, make([]byte, 4))
+				conn.(*net.TCPConn).SetLinger(0)
+				conn.Close()
+			}).String()
+			defer checkCleanup(t)()
+			conn, err := dialTest(proxy, dest, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.ReadFull(conn, make([]byte, len("banner"))); err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, "quit")
+			conn.SetReadDeadline(time.Now().Add(testTimeout))
+			if _, err := io.ReadAll(conn); !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("err:%v, a reset expected", err)
+			}
+		})
+	}
+}
+
+//TestIntegrationUserSlot a user limited to one session gets its slot back when
+//the direct relay ends, and when the destination of a sniffed request fails
+func TestIntegrationUserSlot(t *testing.T) {
+	withAdmission(t, &netcore.AdmissionConfig{MaxPerUser: 1})
+	users := []*UserConfig{{Name: "alice", Password: "secret"}}
+	cfg := &ServerConfig{Inbounds: []*InboundConfig{
+		{Tag: "relay", Type: inboundSocks, Listen: "127.0.0.1:0", Users: users},
+		{Tag: "sniff", Type: inboundSocks, Listen: "127.0.0.1:0", Users: users, Sniff: true},
+	}}
+	proxies := startNode(t, "user", cfg)
+	dest, closed := echoDest(t), closedAddr(t)
+	defer checkCleanup(t)()
+	//the slot of the previous session is given back once its relay exits
+	connect := func(proxy, dest string) net.Conn {
+		deadline := time.Now().Add(testTimeout)
+		for {
+			conn, err := dialTest(proxy, dest, "alice", "secret")
+			if err == nil {
+				return conn
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the slot of the user isn't released, err:%v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		conn := connect(proxies[0], dest)
+		if other, err := dialTest(proxies[0], dest, "alice", "secret"); err == nil {
+			other.Close()
+			t.Fatal("a second session of the user accepted")
+		}
+		err := echoData(conn, 64*1024)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		//granted before the destination is dialed with the sniffed domain
+		conn := connect(proxies[1], closed)
+		io.WriteString(conn, "hello")
+		io.ReadAll(conn)
+		conn.Close()
+	}
+	connect(proxies[0], dest).Close()
+}
+
+//TestIntegrationReload the sessions after a reload follow the rules of the new
+//config, a reload changing the listeners is refused and keeps the running one
+func TestIntegrationReload(t *testing.T) {
+	prev := currentState()
+	defer activeState.Store(prev)
+	path := filepath.Join(t.TempDir(), "opensock.cfg")
+	writeConfig := func(bind, rules string) {
+		cfg := `{"mode":"standard", "bindaddr":"` + bind + `", "outbounds":[{"tag":"deny", "type":"block"}], "rules":[` + rules + `]}`
+		if err := os.WriteFile(path, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("127.0.0.1:0", "")
+	logHandle := utility.NewLog("reload", "WARN", 0, t.TempDir())
+	t.Cleanup(logHandle.Exit)
+	serv := NewSockServerWithOptions(logHandle, &Options{Config: path})
+	cfg, err := serv.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lns, err := serv.listenInbounds(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setState(cfg)
+	for i, in := range cfg.inbounds {
+		ln := lns[i]
+		t.Cleanup(func() { ln.Close() })
+		go netcore.ServeTCPThrottled(ln, serv.logCtx, admission, inboundHandler(in.Tag))
+	}
+	proxy := lns[0].Addr().String()
+	_, port, _ := net.SplitHostPort(echoDest(t))
+	dest := net.JoinHostPort("localhost", port)
+	defer checkCleanup(t)()
+	connect := func() error {
+		conn, err := dialTest(proxy, dest, "", "")
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return echoData(conn, 1024)
+	}
+	if err := connect(); err != nil {
+		t.Fatal(err)
+	}
+	writeConfig("127.0.0.1:0", `{"domains":["localhost"], "outbound":"deny"}`)
+	if err := serv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(); err == nil {
+		t.Fatal("connected after the reload adding a block rule")
+	}
+	writeConfig("127.0.0.1:1", "")
+	if err := serv.Reload(); err == nil {
+		t.Fatal("the listeners changed without restart")
+	}
+	if err := connect(); err == nil {
+		t.Fatal("the refused reload replaced the rules")
+	}
+}
+
+//TestIntegrationSpeedTest the server answers the ping, the download and the
+//upload streams of a speed test through the tunnel
+func TestIntegrationSpeedTest(t *testing.T) {
+	server := startServer(t, nil)
+	defer checkCleanup(t)()
+	for _, size := range []int64{1, tunnel.MaxPayload + 1, 256 * 1024} {
+		res, err := SpeedTest(&SpeedTestOptions{Server: server, Key: testKey, Pings: 3, Bytes: size})
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if res.Bytes != size || res.Trace == "" || res.RTTMin <= 0 || res.RTTMin > res.RTTAvg || res.RTTAvg > res.RTTMax ||
+			res.Download <= 0 || res.Upload <= 0 {
+			t.Fatalf("%d bytes: result %+v", size, res)
+		}
+	}
+	if _, err := SpeedTest(&SpeedTestOptions{Server: server, Key: testKey, Bytes: maxSpeedTestBytes + 1}); err == nil {
+		t.Fatal("a test over the max size accepted")
+	}
+	if _, err := SpeedTest(&SpeedTestOptions{Server: server, Key: "wrong", Bytes: 1}); err == nil {
+		t.Fatal("a test with the wrong key accepted")
+	}
+	out, err := (&SpeedTestOptions{Server: server, Key: testKey}).tunnel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range []string{"download:0", "download:1073741825", "download", "flood"} {
+		if stream, err := out.open(tunnel.CmdTest, arg, "", nil); err == nil {
+			stream.Close()
+			t.Errorf("speed test %q accepted", arg)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package opensock
+
+import (
+	"core"
+	"errors"
+	"io"
+	"time"
+)
+
+//TimeoutConfig the idle timeouts of a session in seconds, 0 disables a timeout.
+//Idle applies while both directions are open, UplinkOnly after the destination
+//shut down its side and DownlinkOnly after the client shut down its side
+type TimeoutConfig struct {
+	Idle         int `json:"idle"`
+	UplinkOnly   int `json:"uplinkonly"`
+	DownlinkOnly int `json:"downlinkonly"`
+}
+
+var defaultTimeouts = &TimeoutConfig{Idle: 300, UplinkOnly: 2, DownlinkOnly: 5}
+
+var errIdleTimeout = errors.New("idle timeout")
+
+func (c *TimeoutConfig) validate() error {
+	if c.Idle < 0 || c.UplinkOnly < 0 || c.DownlinkOnly < 0 {
+		return errors.New("negative timeout")
+	}
+	return nil
+}
+
+//flowState track both directions of a session between the client and the
+//upstream. Upload is the direction from the client to the destination
+type flowState struct {
+	timeouts       *TimeoutConfig
+	lastActive     time.Time
+	uploadClosed   bool //the client shut down its sending side
+	downloadClosed bool //the destination shut down its sending side
+	reset          bool //the client reset the connection
+}
+
+func newFlowState(timeouts *TimeoutConfig) *flowState {
+	if timeouts == nil {
+		timeouts = defaultTimeouts
+	}
+	return &flowState{timeouts: timeouts, lastActive: time.Now()}
+}
+
+func (f *flowState) active() {
+	f.lastActive = time.Now()
+}
+
+//expired check the idle timeout of the directions still open
+func (f *flowState) expired() bool {
+	var limit int
+	switch {
+	case f.uploadClosed && f.downloadClosed:
+		return false
+	case f.downloadClosed:
+		limit = f.timeouts.UplinkOnly
+	case f.uploadClosed:
+		limit = f.timeouts.DownlinkOnly
+	default:
+		limit = f.timeouts.Idle
+	}
+	return limit > 0 && time.Since(f.lastActive) > time.Duration(limit)*time.Second
+}
+
+//recv receive the data of the upstream and map its state to the result of UpdateProc
+func (f *flowState) recv(up *Upstream) ([]byte, error) {
+	msg, err := up.RecvMsg()
+	switch err {
+	case nil:
+		f.active()
+		return msg, nil
+	case io.EOF:
+		f.downloadClosed = true
+		return nil, core.ErrCloseWrite
+	case errTimeout:
+		if f.expired() {
+			return nil, errIdleTimeout
+		}
+		return nil, nil
+	}
+	return nil, err
+}
+
+//shutdown propagate the EOF of the client to the upstream
+func (f *flowState) shutdown(up *Upstream) error {
+	f.uploadClosed = true
+	f.active()
+	up.CloseWrite()
+	return nil
+}
+
+//release close the upstream unless both directions are finished, then it
+//exits by itself after the queued data is sent
+func (f *flowState) release(up *Upstream) {
+	if f.uploadClosed && f.downloadClosed {
+		return
+	}
+	if f.reset {
+		up.Abort()
+		return
+	}
+	up.Close()
+}
@@ -0,0 +1,140 @@
+package opensock
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"utility"
+)
+
+//RateConfig bandwidth limit in bytes per second, 0 means unlimited.
+//Upload is the traffic from the client to the destination
+type RateConfig struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Burst    int64 `json:"burst"`
+}
+
+//LimitConfig the limits applied to every session. User is the default of the
+//users without their own limit
+type LimitConfig struct {
+	Global     *RateConfig `json:"global"`
+	User       *RateConfig `json:"user"`
+	Connection *RateConfig `json:"connection"`
+}
+
+func (r *RateConfig) validate() error {
+	if r != nil && (r.Upload < 0 || r.Download < 0 || r.Burst < 0) {
+		return errors.New("negative rate limit")
+	}
+	return nil
+}
+
+func (c *LimitConfig) validate() error {
+	for _, r := range []*RateConfig{c.Global, c.User, c.Connection} {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//rateBuckets one bucket for each direction
+type rateBuckets struct {
+	upload   *utility.TokenBucket
+	download *utility.TokenBucket
+}
+
+func newRateBuckets(r *RateConfig) *rateBuckets {
+	if r == nil {
+		return &rateBuckets{}
+	}
+	return &rateBuckets{
+		upload:   utility.NewTokenBucket(r.Upload, r.Burst),
+		download: utility.NewTokenBucket(r.Download, r.Burst),
+	}
+}
+
+//rateLimits hold the buckets shared by the sessions
+type rateLimits struct {
+	cfg    *LimitConfig
+	global *rateBuckets
+	lock   sync.Mutex
+	users  map[string]*rateBuckets
+}
+
+func newRateLimits(cfg *LimitConfig) *rateLimits {
+	if cfg == nil {
+		cfg = &LimitConfig{}
+	}
+	return &rateLimits{
+		cfg:    cfg,
+		global: newRateBuckets(cfg.Global),
+		users:  make(map[string]*rateBuckets),
+	}
+}
+
+func (l *rateLimits) userBuckets(user *UserConfig) *rateBuckets {
+	if user == nil {
+		return &rateBuckets{}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b, ok := l.users[user.Name]
+	if !ok {
+		r := l.cfg.User
+		if user.Limit != nil {
+			r = user.Limit
+		}
+		b = newRateBuckets(r)
+		l.users[user.Name] = b
+	}
+	return b
+}
+
+//sessionLimiter account and throttle the traffic of one session
+type sessionLimiter struct {
+	upload   []*utility.TokenBucket
+	download []*utility.TokenBucket
+	info     *sessionInfo
+}
+
+func (l *rateLimits) newSessionLimiter(user *UserConfig, info *sessionInfo) *sessionLimiter {
+	conn := newRateBuckets(l.cfg.Connection)
+	u := l.userBuckets(user)
+	return &sessionLimiter{
+		upload:   []*utility.TokenBucket{l.global.upload, u.upload, conn.upload},
+		download: []*utility.TokenBucket{l.global.download, u.download, conn.download},
+		info:     info,
+	}
+}
+
+//uploadBytes wait until n bytes from the client may be forwarded
+func (s *sessionLimiter) uploadBytes(n int) {
+	atomic.AddUint64(&stats.UploadBytes, uint64(n))
+	s.info.addUpload(n)
+	if wait := utility.WaitTokens(n, s.upload...); wait > 0 {
+		atomic.AddInt64(&stats.UploadThrottle, int64(wait))
+	}
+}
+
+//uploadData capture the data from the client and wait until it may be forwarded
+func (s *sessionLimiter) uploadData(data []byte) {
+	s.info.captured().upload(data)
+	s.uploadBytes(len(data))
+}
+
+//downloadData capture the data to the client and wait until it may be forwarded
+func (s *sessionLimiter) downloadData(data []byte) {
+	s.info.captured().download(data)
+	s.downloadBytes(len(data))
+}
+
+//downloadBytes wait until n bytes to the client may be forwarded
+func (s *sessionLimiter) downloadBytes(n int) {
+	atomic.AddUint64(&stats.DownloadBytes, uint64(n))
+	s.info.addDownload(n)
+	if wait := utility.WaitTokens(n, s.download...); wait > 0 {
+		atomic.AddInt64(&stats.DownloadThrottle, int64(wait))
+	}
+}
@@ -0,0 +1,179 @@
+package opensock
+
+import (
+	"bufio"
+	"core"
+	"fmt"
+	"io"
+	"protocol/tunnel"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//dialBuckets the upper bounds of the dial latency histogram in seconds
+var dialBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//histogram a prometheus histogram
+type histogram struct {
+	bounds []float64
+	counts []uint64 //not cumulative, the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	var total uint64
+	for i, bound := range h.bounds {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, total)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+//metricsRegistry the counters which only exist for monitoring
+type metricsRegistry struct {
+	accepted          uint64
+	lock              sync.Mutex
+	handshakeFailures map[string]uint64
+	dialLatency       map[string]*histogram
+	dialErrors        map[string]uint64
+}
+
+var metrics = &metricsRegistry{
+	handshakeFailures: make(map[string]uint64),
+	dialLatency:       make(map[string]*histogram),
+	dialErrors:        make(map[string]uint64),
+}
+
+func (m *metricsRegistry) acceptConn() {
+	atomic.AddUint64(&m.accepted, 1)
+}
+
+func (m *metricsRegistry) handshakeFailure(reason string) {
+	m.lock.Lock()
+	m.handshakeFailures[reason]++
+	m.lock.Unlock()
+}
+
+//observeDial record the latency of a dial started at start, kind is destination or tunnel
+func (m *metricsRegistry) observeDial(kind string, start time.Time, failed bool) {
+	elapsed := time.Since(start).Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if failed {
+		m.dialErrors[kind]++
+		return
+	}
+	h, ok := m.dialLatency[kind]
+	if !ok {
+		h = newHistogram(dialBuckets)
+		m.dialLatency[kind] = h
+	}
+	h.observe(elapsed)
+}
+
+//statusReason turn a tunnel status into a label value
+func statusReason(status byte) string {
+	return strings.Replace(tunnel.StatusText(status), " ", "_", -1)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetric(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+//writeMetrics dump the metrics in the prometheus text format
+func writeMetrics(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	writeMetric(w, "opensock_sessions", "gauge", "Active sessions by kind.")
+	kinds := sessions.countByKind()
+	for _, kind := range sortedKeys(kinds) {
+		fmt.Fprintf(w, "opensock_sessions{kind=%q} %d\n", kind, kinds[kind])
+	}
+
+	writeMetric(w, "opensock_connections_accepted_total", "counter", "Connections accepted by the inbound listeners.")
+	fmt.Fprintf(w, "opensock_connections_accepted_total %d\n", atomic.LoadUint64(&metrics.accepted))
+	adm := admission.Stats()
+	writeMetric(w, "opensock_connections_rejected_total", "counter", "Connections refused by the admission control.")
+	fmt.Fprintf(w, "opensock_connections_rejected_total{reason=\"max_sessions\"} %d\n", adm.RejectedMax)
+	fmt.Fprintf(w, "opensock_connections_rejected_total{reason=\"per_ip\"} %d\n", adm.RejectedIP)
+	fmt.Fprintf(w, "opensock_connections_rejected_total{reason=\"per_user\"} %d\n", adm.RejectedUser)
+	fmt.Fprintf(w, "opensock_connections_rejected_total{reason=\"banned\"} %d\n", adm.RejectedBanned)
+	writeMetric(w, "opensock_accept_throttled_total", "counter", "Accepts delayed by the accept rate.")
+	fmt.Fprintf(w, "opensock_accept_throttled_total %d\n", adm.Throttled)
+	writeMetric(w, "opensock_bans_total", "counter", "Addresses banned for handshake failures.")
+	fmt.Fprintf(w, "opensock_bans_total %d\n", adm.Bans)
+	writeMetric(w, "opensock_banned_addresses", "gauge", "Addresses banned now.")
+	fmt.Fprintf(w, "opensock_banned_addresses %d\n", adm.Banned)
+
+	metrics.lock.Lock()
+	writeMetric(w, "opensock_handshake_failures_total", "counter", "Failed tunnel and socks handshakes by reason.")
+	for _, reason := range sortedKeys(metrics.handshakeFailures) {
+		fmt.Fprintf(w, "opensock_handshake_failures_total{reason=%q} %d\n", reason, metrics.handshakeFailures[reason])
+	}
+	writeMetric(w, "opensock_dial_duration_seconds", "histogram", "Latency of the successful dials.")
+	dialKinds := make([]string, 0, len(metrics.dialLatency))
+	for kind := range metrics.dialLatency {
+		dialKinds = append(dialKinds, kind)
+	}
+	sort.Strings(dialKinds)
+	for _, kind := range dialKinds {
+		metrics.dialLatency[kind].write(w, "opensock_dial_duration_seconds", fmt.Sprintf("kind=%q", kind))
+	}
+	writeMetric(w, "opensock_dial_errors_total", "counter", "Failed dials.")
+	for _, kind := range sortedKeys(metrics.dialErrors) {
+		fmt.Fprintf(w, "opensock_dial_errors_total{kind=%q} %d\n", kind, metrics.dialErrors[kind])
+	}
+	metrics.lock.Unlock()
+
+	st := stats.snapshot()
+	writeMetric(w, "opensock_bytes_total", "counter", "Bytes relayed, upload is from the client to the destination.")
+	fmt.Fprintf(w, "opensock_bytes_total{direction=\"upload\"} %d\n", st.UploadBytes)
+	fmt.Fprintf(w, "opensock_bytes_total{direction=\"download\"} %d\n", st.DownloadBytes)
+	writeMetric(w, "opensock_throttle_seconds_total", "counter", "Time spent waiting for the bandwidth limits.")
+	fmt.Fprintf(w, "opensock_throttle_seconds_total{direction=\"upload\"} %g\n", time.Duration(st.UploadThrottle).Seconds())
+	fmt.Fprintf(w, "opensock_throttle_seconds_total{direction=\"download\"} %g\n", time.Duration(st.DownloadThrottle).Seconds())
+
+	hits, misses := dnsCacheStats()
+	writeMetric(w, "opensock_dns_cache_lookups_total", "counter", "DNS cache lookups by result.")
+	fmt.Fprintf(w, "opensock_dns_cache_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "opensock_dns_cache_lookups_total{result=\"miss\"} %d\n", misses)
+
+	writeMetric(w, "opensock_access_log_dropped_total", "counter", "Access log records dropped because the writer fell behind.")
+	fmt.Fprintf(w, "opensock_access_log_dropped_total %d\n", accessLog.droppedRecords())
+
+	route := core.GetRouteStats()
+	writeMetric(w, "opensock_route_queue_length", "gauge", "Length of the core route queues.")
+	fmt.Fprintf(w, "opensock_route_queue_length{queue=\"cmd\"} %d\n", route.CmdQueue)
+	fmt.Fprintf(w, "opensock_route_queue_length{queue=\"register\"} %d\n", route.RegisterQueue)
+	writeMetric(w, "opensock_cmdlist_buffered", "gauge", "Cmds buffered by the core CmdList.")
+	fmt.Fprintf(w, "opensock_cmdlist_buffered %d\n", route.CmdBuffered)
+	writeMetric(w, "opensock_cmdlist_discarded_total", "counter", "Cmds discarded by the core CmdList after their ttl.")
+	fmt.Fprintf(w, "opensock_cmdlist_discarded_total %d\n", route.CmdDiscarded)
+}
@@ -0,0 +1,349 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"protocol/socks"
+	"protocol/tunnel"
+	"strconv"
+	"syscall"
+	"time"
+	"utility"
+)
+
+const (
+	outboundDirect = "direct"
+	outboundTunnel = "tunnel"
+	outboundBlock  = "block"
+)
+
+//OutboundConfig a named way to reach the destinations, the route of an inbound
+//is the tag of an outbound. Type is direct, or tunnel through Server which is
+//authenticated with Key, User and Password, or block which refuses the sessions.
+//ProxyProtocol is the version of the PROXY protocol header a direct outbound
+//sends the destinations, 0 sends none. The connections of direct and tunnel
+//outbounds leave from the Bind addresses, taken in turn or by the hash of the
+//destination or of the user as Rotate says, through Interface with the Mark,
+//and their sockets are tuned by Socket
+type OutboundConfig struct {
+	Tag           string        `json:"tag"`
+	Type          string        `json:"type"`
+	Server        string        `json:"server"`
+	Key           string        `json:"key"`
+	User          string        `json:"user"`
+	Password      string        `json:"password"`
+	ProxyProtocol int           `json:"proxyprotocol"`
+	Bind          []string      `json:"bind"`
+	Rotate        string        `json:"rotate"`
+	Interface     string        `json:"interface"`
+	Mark          int           `json:"mark"`
+	Socket        *SocketConfig `json:"socket"`
+}
+
+//DialRequest the session asking an outbound for a stream, Dest is host:port.
+//Network is unix when Dest is unix:path, a forward to a unix socket, empty for
+//tcp. Local is the address of the inbound the client connected, Domain the one
+//sniffed from the first bytes of the client, empty when unknown. Trace is the
+//trace id of the session, passed on by the tunnel
+type DialRequest struct {
+	Dest    string
+	Network string
+	Domain  string
+	Client  net.Addr
+	Local   net.Addr
+	User    string
+	Trace   string
+}
+
+//Outbound reach the destination of the sessions. Dial returns a stream carrying
+//the plain data of the session, closing it closes the connection under it
+type Outbound interface {
+	Dial(req *DialRequest, log *utility.LogContext) (net.Conn, error)
+}
+
+//OutboundFactory create the outbound of a config, it checks the fields of its type
+type OutboundFactory func(out *OutboundConfig) (Outbound, error)
+
+var outboundTypes = make(map[string]OutboundFactory)
+
+//RegisterOutbound add a type of outbound, the file implementing it calls it from init
+func RegisterOutbound(typ string, factory OutboundFactory) {
+	outboundTypes[typ] = factory
+}
+
+func init() {
+	RegisterOutbound(outboundDirect, newDirectOutbound)
+	RegisterOutbound(outboundTunnel, newTunnelOutbound)
+	RegisterOutbound(outboundBlock, newBlockOutbound)
+}
+
+//buildOutbounds create the outbounds of the config. direct, block and tunnel, to
+//the serverip, are implied unless an outbound of the config takes their tag
+func (cfg *ServerConfig) buildOutbounds() error {
+	outs := []*OutboundConfig{{Tag: routeDirect, Type: outboundDirect, Socket: cfg.Socket}, {Tag: routeBlock, Type: outboundBlock}}
+	if cfg.ServerIP != "" {
+		outs = append(outs, cfg.tunnelOutboundConfig())
+	}
+	tags := make(map[string]bool)
+	for _, out := range cfg.Outbounds {
+		if out.Tag == "" {
+			return errors.New("outbound tag required")
+		}
+		if tags[out.Tag] {
+			return errors.New("duplicate outbound tag:" + out.Tag)
+		}
+		tags[out.Tag] = true
+	}
+	cfg.outbounds = make(map[string]Outbound)
+	for _, out := range append(outs, cfg.Outbounds...) {
+		factory, ok := outboundTypes[out.Type]
+		if !ok {
+			return errors.New("invalid outbound type:" + out.Type)
+		}
+		o, err := factory(out)
+		if err != nil {
+			return errors.New("outbound " + out.Tag + ":" + err.Error())
+		}
+		cfg.outbounds[out.Tag] = o
+	}
+	return nil
+}
+
+func (cfg *ServerConfig) tunnelOutboundConfig() *OutboundConfig {
+	return &OutboundConfig{
+		Tag:      routeTunnel,
+		Type:     outboundTunnel,
+		Server:   cfg.ServerIP,
+		Key:      cfg.Key,
+		User:     cfg.User,
+		Password: cfg.Password,
+		Socket:   cfg.Socket,
+	}
+}
+
+//tunnelServer the tunnel to the serverip, used by the reverse tunnels, the dns
+//and the socks listener of the client mode
+func (cfg *ServerConfig) tunnelServer() *tunnelOutbound {
+	out := cfg.tunnelOutboundConfig()
+	//checked by buildOutbounds with the implied tunnel
+	e, _ := newEgress(out)
+	return &tunnelOutbound{server: out.Server, key: out.Key, user: out.User, password: out.Password, egress: e}
+}
+
+//dialRoute connect the destination of a session with the outbound of the first
+//matching rule or of its route. A config without outbounds, as used by the
+//benchmarks, goes direct
+func dialRoute(cfg *ServerConfig, req *DialRequest, info *sessionInfo, log *utility.LogContext) (net.Conn, error) {
+	tag := cfg.route
+	if tag == "" {
+		tag = routeDirect
+	}
+	if req.Domain != "" {
+		log.LogInfo("sniffed domain:%s of:%s", req.Domain, req.Dest)
+		info.setDomain(req.Domain)
+	}
+	if rule := cfg.matchRule(req); rule != nil {
+		tag = rule.Outbound
+	}
+	out, ok := cfg.outbounds[tag]
+	if !ok && tag == routeDirect {
+		out, ok = &directOutbound{}, true
+	}
+	if !ok {
+		info.setReason("dial_failed")
+		return nil, errors.New("unknown outbound:" + tag)
+	}
+	conn, err := out.Dial(req, log)
+	if err != nil {
+		if _, refused := err.(tunnelRefused); refused {
+			info.setReason("tunnel_refused")
+		} else if err == errBlocked {
+			info.setReason("blocked")
+		} else {
+			info.setReason("dial_failed")
+		}
+		return nil, err
+	}
+	info.setRoute(tag, conn.RemoteAddr().String())
+	startCapture(cfg, req, info, conn, log)
+	return conn, nil
+}
+
+//dialStatus the tunnel status telling why a dial failed, a tunnel server
+//refusing the dial tells it already
+func dialStatus(err error) byte {
+	var refused tunnelRefused
+	switch {
+	case errors.As(err, &refused):
+		return byte(refused)
+	case err == errBlocked:
+		return tunnel.StatusNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return tunnel.StatusRefused
+	}
+	return tunnel.StatusUnreachable
+}
+
+//socksReply the reply code of a socks request whose dial failed
+func socksReply(err error) byte {
+	switch dialStatus(err) {
+	case tunnel.StatusNotAllowed:
+		return socks.RepNotAllowed
+	case tunnel.StatusRefused:
+		return socks.RepConnRefused
+	case tunnel.StatusUnreachable:
+		return socks.RepHostUnreachable
+	}
+	return socks.RepFailure
+}
+
+//directOutbound connect the destination from this process
+type directOutbound struct {
+	proxyProtocol int
+	egress        *egress
+}
+
+func newDirectOutbound(out *OutboundConfig) (Outbound, error) {
+	if out.ProxyProtocol < 0 || out.ProxyProtocol > 2 {
+		return nil, errors.New("invalid proxy protocol version:" + strconv.Itoa(out.ProxyProtocol))
+	}
+	e, err := newEgress(out)
+	if err != nil {
+		return nil, err
+	}
+	return &directOutbound{proxyProtocol: out.ProxyProtocol, egress: e}, nil
+}
+
+func (o *directOutbound) Dial(req *DialRequest, log *utility.LogContext) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	var err error
+	if req.Network == networkUnix {
+		_, path := dialAddr(req.Dest)
+		conn, err = net.Dial(networkUnix, path)
+	} else {
+		var addrs []*net.TCPAddr
+		if addrs, err = resolveAddrs(req.Dest); err == nil {
+			conn, err = dialDirect(addrs, o.egress, req, log)
+		}
+	}
+	metrics.observeDial("destination", start, err != nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.proxyProtocol != 0 {
+		if err := sendProxyHeader(conn, req, o.proxyProtocol); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//tunnelRefused the status of a refused tunnel handshake
+type tunnelRefused byte
+
+func (s tunnelRefused) Error() string {
+	return "tunnel handshake refused:" + tunnel.StatusText(byte(s))
+}
+
+//tunnelOutbound carry the sessions through a tunnel server which connects
+//their destination
+type tunnelOutbound struct {
+	server   string
+	key      string
+	user     string
+	password string
+	egress   *egress
+}
+
+func newTunnelOutbound(out *OutboundConfig) (Outbound, error) {
+	if !validAddr(out.Server) {
+		return nil, errors.New("invalid tunnel server:" + out.Server)
+	}
+	if len(out.Key) > 256 {
+		return nil, errors.New("key longer than 256 bytes")
+	}
+	e, err := newEgress(out)
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelOutbound{server: out.Server, key: out.Key, user: out.User, password: out.Password, egress: e}, nil
+}
+
+//dial connect the server and send the handshake, trace may be empty
+func (o *tunnelOutbound) dial(cmd byte, arg, trace string) (net.Conn, *tunnel.Codec, error) {
+	return o.dialFor(cmd, arg, trace, nil)
+}
+
+//dialFor dial for the session of req, its user and destination may choose the
+//source address of the egress
+func (o *tunnelOutbound) dialFor(cmd byte, arg, trace string, req *DialRequest) (net.Conn, *tunnel.Codec, error) {
+	codec, hello, err := tunnel.NewClientCodec(o.key)
+	if err != nil {
+		return nil, nil, errors.New("invalid key:" + err.Error())
+	}
+	start := time.Now()
+	conn, err := o.connect(req)
+	metrics.observeDial("tunnel", start, err != nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs := &tunnel.Handshake{Cmd: cmd, User: o.user, Password: o.password, Arg: arg, Trace: trace}
+	if _, err := conn.Write(append(hello, codec.Encode(hs.Marshal())...)); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, codec, nil
+}
+
+//connect the server, from the egress when there's one
+func (o *tunnelOutbound) connect(req *DialRequest) (net.Conn, error) {
+	network, addr := dialAddr(o.server)
+	if o.egress == nil || network == networkUnix {
+		return net.DialTimeout(network, addr, tunnelDialTimeout)
+	}
+	addrs, err := resolveAddrs(addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var conn *net.TCPConn
+		if conn, err = o.egress.dialTCP(a, req, tunnelDialTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+//Dial ask the server to connect the destination and wait for its answer
+func (o *tunnelOutbound) Dial(req *DialRequest, log *utility.LogContext) (net.Conn, error) {
+	if req.Network == networkUnix {
+		return nil, errors.New("unix socket destination through a tunnel:" + req.Dest)
+	}
+	stream, err := o.open(tunnel.CmdConnect, req.Dest, req.Trace, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+//open send the handshake and wait for the status, the stream carries the rest
+func (o *tunnelOutbound) open(cmd byte, arg, trace string, req *DialRequest) (*tunnel.Conn, error) {
+	conn, codec, err := o.dialFor(cmd, arg, trace, req)
+	if err != nil {
+		return nil, err
+	}
+	stream := tunnel.NewConn(conn, codec)
+	conn.SetReadDeadline(time.Now().Add(tunnelDialTimeout))
+	status, err := stream.ReadStatus()
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && status != tunnel.StatusOK {
+		err = tunnelRefused(status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,97 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"netcore"
+	"protocol/proxyproto"
+	"time"
+	"utility"
+)
+
+//proxyHeaderTimeout how long a load balancer has to send its header
+const proxyHeaderTimeout = 5 * time.Second
+
+//ProxyProtocolConfig accept the PROXY protocol header, version 1 or 2, a load
+//balancer in front of an inbound sends first. The sessions then see the client
+//and the address it connected instead of the balancer. Trusted are the ips or
+//cidrs of the balancers, it can't be empty: any client of a trusted source can
+//fake its address, so trusting all of them is written out as 0.0.0.0/0 and ::/0.
+//Required refuses the connections without header and the ones of the other
+//sources, else these are taken as clients connecting directly
+type ProxyProtocolConfig struct {
+	Required bool     `json:"required"`
+	Trusted  []string `json:"trusted"`
+	trusted  []*net.IPNet
+}
+
+func (c *ProxyProtocolConfig) validate() error {
+	if len(c.Trusted) == 0 {
+		return errors.New("proxy protocol without trusted sources, trust every one with \"trusted\":[\"0.0.0.0/0\", \"::/0\"]")
+	}
+	c.trusted = c.trusted[:0]
+	for _, s := range c.Trusted {
+		ipNet, err := parseIPNet(s)
+		if err != nil {
+			return errors.New("invalid proxy protocol source:" + s)
+		}
+		c.trusted = append(c.trusted, ipNet)
+	}
+	return nil
+}
+
+//read the header of a trusted source, the connection returned has the
+//addresses it tells
+func (c *ProxyProtocolConfig) read(conn net.Conn) (net.Conn, error) {
+	if !containsIP(c.trusted, addrIP(conn.RemoteAddr())) {
+		if c.Required {
+			return nil, errors.New("untrusted source")
+		}
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	h, pending, err := proxyproto.Read(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if h == nil {
+		if c.Required {
+			return nil, errors.New("no proxy protocol header")
+		}
+		return netcore.NewProxiedConn(conn, nil, nil, pending), nil
+	}
+	if h.Source == nil {
+		return netcore.NewProxiedConn(conn, nil, nil, nil), nil
+	}
+	return netcore.NewProxiedConn(conn, h.Source, h.Dest, nil), nil
+}
+
+//acceptProxied read the header of the proxy before the inbound takes the
+//connection. It runs on its own goroutine so a slow header doesn't block the
+//accept loop
+func acceptProxied(conn net.Conn, logHandle *utility.LogModule, in *InboundConfig) {
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	proxied, err := in.ProxyProtocol.read(conn)
+	if err != nil {
+		log.LogWarn("proxy protocol of connection:%s on inbound:%s err:%v", conn.RemoteAddr().String(), in.Tag, err)
+		metrics.handshakeFailure("proxy_protocol")
+		conn.Close()
+		return
+	}
+	if proxied.RemoteAddr().String() != conn.RemoteAddr().String() {
+		log.LogInfo("connection:%s is client:%s by proxy protocol", conn.RemoteAddr().String(), proxied.RemoteAddr().String())
+	}
+	in.admit(proxied, logHandle)
+}
+
+//sendProxyHeader tell the destination the client of the session and the address
+//it connected, version is 1 or 2
+func sendProxyHeader(conn net.Conn, req *DialRequest, version int) error {
+	h := &proxyproto.Header{Source: tcpAddr(req.Client), Dest: tcpAddr(req.Local)}
+	conn.SetWriteDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetWriteDeadline(time.Time{})
+	_, err := conn.Write(h.Format(version))
+	return err
+}
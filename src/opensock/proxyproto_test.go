@@ -0,0 +1,23 @@
+package opensock
+
+import "testing"
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	cases := []struct {
+		trusted []string
+		ok      bool
+	}{
+		{nil, false},
+		{[]string{}, false},
+		{[]string{"10.0.0.0/8", "2001:db8::1"}, true},
+		{[]string{"0.0.0.0/0", "::/0"}, true},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{"balancer"}, false},
+	}
+	for _, c := range cases {
+		cfg := &ProxyProtocolConfig{Trusted: c.trusted}
+		if err := cfg.validate(); (err == nil) != c.ok {
+			t.Errorf("trusted %q: err:%v", c.trusted, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package opensock
+
+import (
+	"core"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utility"
+)
+
+//sessionInfo describe an active session for the admin api
+type sessionInfo struct {
+	id       uint64
+	trace    string //follows the session through the processes it crosses
+	kind     string
+	client   string
+	start    time.Time
+	upload   uint64
+	download uint64
+	lock     sync.Mutex
+	user     string
+	dest     string
+	domain   string //sniffed from the first bytes of the client
+	route    string
+	remote   string //the address dialed for the route
+	reason   string
+	kill     func()
+	capture  *sessionCapture
+}
+
+//SessionView the json view of a session, Age is in seconds
+type SessionView struct {
+	ID       uint64  `json:"id"`
+	Trace    string  `json:"trace"`
+	Kind     string  `json:"kind"`
+	Client   string  `json:"client"`
+	User     string  `json:"user"`
+	Dest     string  `json:"dest"`
+	Upload   uint64  `json:"upload"`
+	Download uint64  `json:"download"`
+	Age      float64 `json:"age"`
+}
+
+//setTrace adopt the trace id given by the client end of the tunnel
+func (i *sessionInfo) setTrace(trace string) {
+	i.lock.Lock()
+	i.trace = trace
+	i.lock.Unlock()
+}
+
+func (i *sessionInfo) traceID() string {
+	if i == nil {
+		return ""
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.trace
+}
+
+func (i *sessionInfo) setUser(user string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.user = user
+	i.lock.Unlock()
+}
+
+func (i *sessionInfo) setDest(kind, dest string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.kind = kind
+	i.dest = dest
+	i.lock.Unlock()
+}
+
+//setRoute record how the traffic leaves the process and the address dialed
+func (i *sessionInfo) setRoute(route, remote string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.route = route
+	i.remote = remote
+	i.lock.Unlock()
+}
+
+//setReason record why the session ends, the first reason wins
+func (i *sessionInfo) setReason(reason string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	if i.reason == "" {
+		i.reason = reason
+	}
+	i.lock.Unlock()
+}
+
+//closeWith record the error which ends the session
+func (i *sessionInfo) closeWith(err error) {
+	if err != nil && err != core.ErrCloseWrite {
+		i.setReason(closeReason(err))
+	}
+}
+
+func closeReason(err error) string {
+	switch err {
+	case errIdleTimeout:
+		return "idle_timeout"
+	case errUpstreamClosed:
+		return "upstream_closed"
+	case core.ErrReset:
+		return "upstream_reset"
+	}
+	return "error"
+}
+
+//close close the session for reason
+func (i *sessionInfo) close(reason string) {
+	i.setReason(reason)
+	i.lock.Lock()
+	kill := i.kill
+	i.lock.Unlock()
+	if kill != nil {
+		kill()
+	}
+}
+
+//setKill set how the session is closed by the admin or at shutdown
+func (i *sessionInfo) setKill(kill func()) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.kill = kill
+	i.lock.Unlock()
+}
+
+func (i *sessionInfo) setDomain(domain string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	i.domain = domain
+	i.lock.Unlock()
+}
+
+//setCapture set the capture recording the streams of the session
+func (i *sessionInfo) setCapture(c *sessionCapture) {
+	i.lock.Lock()
+	i.capture = c
+	i.lock.Unlock()
+}
+
+//captured return the capture of the session, nil when it isn't captured
+func (i *sessionInfo) captured() *sessionCapture {
+	if i == nil {
+		return nil
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.capture
+}
+
+func (i *sessionInfo) addUpload(n int) {
+	if i != nil {
+		atomic.AddUint64(&i.upload, uint64(n))
+	}
+}
+
+func (i *sessionInfo) addDownload(n int) {
+	if i != nil {
+		atomic.AddUint64(&i.download, uint64(n))
+	}
+}
+
+func (i *sessionInfo) view(now time.Time) SessionView {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return SessionView{
+		ID:       i.id,
+		Trace:    i.trace,
+		Kind:     i.kind,
+		Client:   i.client,
+		User:     i.user,
+		Dest:     i.dest,
+		Upload:   atomic.LoadUint64(&i.upload),
+		Download: atomic.LoadUint64(&i.download),
+		Age:      now.Sub(i.start).Seconds(),
+	}
+}
+
+//record the access log record of the session
+func (i *sessionInfo) record(now time.Time) *AccessRecord {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	host, port := splitDest(i.dest)
+	ip, _ := splitDest(i.remote)
+	reason := i.reason
+	if reason == "" {
+		reason = "closed"
+	}
+	return &AccessRecord{
+		ID:       i.id,
+		Trace:    i.trace,
+		Start:    i.start,
+		Duration: now.Sub(i.start).Seconds(),
+		Client:   i.client,
+		User:     i.user,
+		Inbound:  i.kind,
+		Host:     host,
+		Domain:   i.domain,
+		IP:       ip,
+		Port:     port,
+		Route:    i.route,
+		Upload:   atomic.LoadUint64(&i.upload),
+		Download: atomic.LoadUint64(&i.download),
+		Reason:   reason,
+	}
+}
+
+//sessionRegistry the sessions alive in the process
+type sessionRegistry struct {
+	lock     sync.Mutex
+	sessions map[uint64]*sessionInfo
+	idSrc    uint64
+}
+
+var sessions = &sessionRegistry{sessions: make(map[uint64]*sessionInfo)}
+
+//add register a new session with a new trace id, which tags the lines of log
+func (r *sessionRegistry) add(kind, client string, log *utility.LogContext) *sessionInfo {
+	info := &sessionInfo{
+		id:     atomic.AddUint64(&r.idSrc, 1),
+		trace:  utility.NewTraceID(),
+		kind:   kind,
+		client: client,
+		start:  time.Now(),
+	}
+	log.SetTrace(info.trace)
+	r.lock.Lock()
+	r.sessions[info.id] = info
+	r.lock.Unlock()
+	return info
+}
+
+func (r *sessionRegistry) remove(info *sessionInfo) {
+	if info == nil {
+		return
+	}
+	r.lock.Lock()
+	_, ok := r.sessions[info.id]
+	delete(r.sessions, info.id)
+	if ok {
+		//queued under the lock, the records of the sessions no longer counted
+		//are in the queue, it doesn't block
+		accessLog.record(info)
+	}
+	r.lock.Unlock()
+	if ok {
+		if c := info.captured(); c != nil {
+			info.lock.Lock()
+			reason := info.reason
+			info.lock.Unlock()
+			c.close(reason)
+		}
+	}
+}
+
+func (r *sessionRegistry) count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.sessions)
+}
+
+func (r *sessionRegistry) countByKind() map[string]uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	kinds := make(map[string]uint64)
+	for _, info := range r.sessions {
+		info.lock.Lock()
+		kinds[info.kind]++
+		info.lock.Unlock()
+	}
+	return kinds
+}
+
+//list return the sessions ordered by id
+func (r *sessionRegistry) list() []SessionView {
+	r.lock.Lock()
+	infos := make([]*sessionInfo, 0, len(r.sessions))
+	for _, info := range r.sessions {
+		infos = append(infos, info)
+	}
+	r.lock.Unlock()
+	now := time.Now()
+	views := make([]SessionView, 0, len(infos))
+	for _, info := range infos {
+		views = append(views, info.view(now))
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+	return views
+}
+
+//kill close a session, it returns false if the session doesn't exist
+func (r *sessionRegistry) kill(id uint64) bool {
+	r.lock.Lock()
+	info, ok := r.sessions[id]
+	r.lock.Unlock()
+	if !ok {
+		return false
+	}
+	info.close("admin_kill")
+	return true
+}
+
+//closeAll close the sessions of kind, all of them if kind is empty. It returns
+//how many are closed
+func (r *sessionRegistry) closeAll(kind, reason string) int {
+	r.lock.Lock()
+	infos := make([]*sessionInfo, 0, len(r.sessions))
+	for _, info := range r.sessions {
+		infos = append(infos, info)
+	}
+	r.lock.Unlock()
+	n := 0
+	for _, info := range infos {
+		info.lock.Lock()
+		match := kind == "" || info.kind == kind
+		info.lock.Unlock()
+		if match {
+			info.close(reason)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package opensock
+
+import (
+	"protocol/socks"
+	"protocol/tunnel"
+	"utility"
+)
+
+//maxSniffSize the most bytes kept to find the socks destination
+const maxSniffSize = 512
+
+//tunnelRelay forward data between a plain connection and a tunnel connection.
+//When ownFramed is true the connection driving the relay carries the tunnel
+//frames and the upstream is plain, otherwise it's the other way round
+type tunnelRelay struct {
+	codec      *tunnel.Codec
+	upstream   *Upstream
+	ownFramed  bool
+	waitStatus bool
+	pending    []byte
+	limiter    *sessionLimiter
+	flow       *flowState
+	info       *sessionInfo //set when the relay owns the session
+	sniff      []byte       //the start of the socks stream, kept until the destination is found
+	sniffing   bool
+	log        *utility.LogContext
+}
+
+func newTunnelRelay(codec *tunnel.Codec, up *Upstream, ownFramed bool, limiter *sessionLimiter, timeouts *TimeoutConfig, log *utility.LogContext) *tunnelRelay {
+	return &tunnelRelay{
+		codec:     codec,
+		upstream:  up,
+		ownFramed: ownFramed,
+		limiter:   limiter,
+		flow:      newFlowState(timeouts),
+		log:       log,
+	}
+}
+
+//checkStatus check the status frame which answers the handshake
+func checkStatus(payload []byte) error {
+	if len(payload) == 0 {
+		return tunnelRefused(tunnel.StatusBadRequest)
+	}
+	if payload[0] != tunnel.StatusOK {
+		return tunnelRefused(payload[0])
+	}
+	return nil
+}
+
+//deliver strip the status frame before the data
+func (r *tunnelRelay) deliver(payload []byte) ([]byte, error) {
+	if !r.waitStatus {
+		return payload, nil
+	}
+	r.waitStatus = false
+	if err := checkStatus(payload); err != nil {
+		r.info.setReason("tunnel_refused")
+		return nil, err
+	}
+	return payload[1:], nil
+}
+
+//ReadProc process the data from the connection owning the relay
+func (r *tunnelRelay) ReadProc(data []byte) (int, []byte, error) {
+	r.flow.active()
+	if !r.ownFramed {
+		if r.sniffing {
+			r.sniffDest(data)
+		}
+		r.limiter.uploadData(data)
+		r.upstream.SendMsg(r.codec.Encode(data))
+		return len(data), nil, nil
+	}
+	size, payload, err := r.codec.Decode(data)
+	if err != nil || size == 0 {
+		return size, nil, err
+	}
+	payload, err = r.deliver(payload)
+	if err != nil {
+		return size, nil, err
+	}
+	if len(payload) > 0 {
+		r.limiter.uploadData(payload)
+		msg := utility.GetBuffer(len(payload))
+		copy(msg, payload)
+		r.upstream.SendMsg(msg)
+	}
+	return size, nil, nil
+}
+
+//sniffDest record the destination of the socks stream carried by the tunnel
+func (r *tunnelRelay) sniffDest(data []byte) {
+	r.sniff = append(r.sniff, data...)
+	dest, done := socks.SniffDest(r.sniff)
+	if !done && len(r.sniff) < maxSniffSize {
+		return
+	}
+	if dest != "" {
+		r.info.setDest("socks", dest)
+	}
+	r.sniffing = false
+	r.sniff = nil
+}
+
+//UpdateProc return the data received by the upstream
+func (r *tunnelRelay) UpdateProc() ([]byte, error) {
+	msg, err := r.flow.recv(r.upstream)
+	r.info.closeWith(err)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	if r.ownFramed {
+		r.limiter.downloadData(msg)
+		return r.codec.Encode(msg), nil
+	}
+	r.pending = append(r.pending, msg...)
+	var out []byte
+	total := 0
+	for {
+		size, payload, err := r.codec.Decode(r.pending[total:])
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			break
+		}
+		total += size
+		payload, err = r.deliver(payload)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, payload...)
+	}
+	r.pending = append(r.pending[:0], r.pending[total:]...)
+	r.limiter.downloadData(out)
+	return out, nil
+}
+
+//ShutdownProc shut down the upstream after the connection owning the relay does
+func (r *tunnelRelay) ShutdownProc() error {
+	return r.flow.shutdown(r.upstream)
+}
+
+//ResetProc reset the upstream too when the connection exits
+func (r *tunnelRelay) ResetProc() {
+	r.info.setReason("client_reset")
+	r.flow.reset = true
+}
+
+//CloseProc release the upstream when the connection exits
+func (r *tunnelRelay) CloseProc() {
+	sessions.remove(r.info)
+	r.flow.release(r.upstream)
+}
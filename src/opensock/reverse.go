@@ -0,0 +1,298 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"netcore"
+	"protocol/tunnel"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utility"
+)
+
+const (
+	//reversePendingTimeout how long an inbound connection waits for the client to attach
+	reversePendingTimeout = 10 * time.Second
+	reverseRetryInterval  = 5 * time.Second
+	tunnelDialTimeout     = 10 * time.Second
+	reverseNotifyBacklog  = 128
+)
+
+//ReverseConfig expose Target, reachable from the client, on RemotePort of the server
+type ReverseConfig struct {
+	RemotePort int    `json:"remoteport"`
+	Target     string `json:"target"`
+}
+
+type reversePending struct {
+	conn  net.Conn
+	owner *reverseControl
+}
+
+//reverseTable hold the inbound connections waiting for the client to attach
+type reverseTable struct {
+	lock    sync.Mutex
+	pending map[uint32]*reversePending
+	idSrc   uint32
+}
+
+var reverseConns = &reverseTable{pending: make(map[uint32]*reversePending)}
+
+func (t *reverseTable) add(conn net.Conn, owner *reverseControl) uint32 {
+	id := atomic.AddUint32(&t.idSrc, 1)
+	t.lock.Lock()
+	t.pending[id] = &reversePending{conn: conn, owner: owner}
+	t.lock.Unlock()
+	time.AfterFunc(reversePendingTimeout, func() {
+		if p := t.take(id); p != nil {
+			p.owner.log.LogWarn("reverse connection:%d on port:%d not attached in time", id, p.owner.port)
+			p.conn.Close()
+		}
+	})
+	return id
+}
+
+func (t *reverseTable) take(id uint32) *reversePending {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p, ok := t.pending[id]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, id)
+	return p
+}
+
+//removeOwner drop all pending connections of a control session
+func (t *reverseTable) removeOwner(owner *reverseControl) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, p := range t.pending {
+		if p.owner == owner {
+			p.conn.Close()
+			delete(t.pending, id)
+		}
+	}
+}
+
+//reverseControl is the server side of a reverse tunnel control connection.
+//It owns the listener and tells the client about each inbound connection
+type reverseControl struct {
+	listener *net.TCPListener
+	codec    *tunnel.Codec
+	user     *UserConfig
+	port     int
+	notify   chan uint32
+	log      *utility.LogContext
+}
+
+func newReverseControl(ip string, port int, user *UserConfig, codec *tunnel.Codec, log *utility.LogContext) (*reverseControl, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip), Port: port}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &reverseControl{
+		listener: listener,
+		codec:    codec,
+		user:     user,
+		port:     port,
+		notify:   make(chan uint32, reverseNotifyBacklog),
+		log:      log,
+	}
+	log.LogInfo("user:%s bind reverse tunnel on addr:%s", user.Name, addr.String())
+	go c.acceptLoop()
+	return c, nil
+}
+
+func (c *reverseControl) acceptLoop() {
+	defer utility.CatchPanic(c.log, nil)
+	for {
+		conn, err := c.listener.AcceptTCP()
+		if err != nil {
+			c.log.LogInfo("reverse listener on port:%d exit:%v", c.port, err)
+			return
+		}
+		id := reverseConns.add(conn, c)
+		select {
+		case c.notify <- id:
+			c.log.LogDebug("new reverse connection:%d from:%s", id, conn.RemoteAddr().String())
+		default:
+			c.log.LogWarn("too many reverse connections waiting on port:%d", c.port)
+			if p := reverseConns.take(id); p != nil {
+				p.conn.Close()
+			}
+		}
+	}
+}
+
+//ReadProc the client sends nothing on the control connection except keepalive frames
+func (c *reverseControl) ReadProc(data []byte) (int, []byte, error) {
+	size, _, err := c.codec.Decode(data)
+	return size, nil, err
+}
+
+//UpdateProc tell the client the id of the new inbound connections
+func (c *reverseControl) UpdateProc() ([]byte, error) {
+	var out []byte
+	for {
+		select {
+		case id := <-c.notify:
+			msg := make([]byte, 4)
+			utility.WriteUint32(msg, id)
+			out = append(out, c.codec.Encode(msg)...)
+		default:
+			return out, nil
+		}
+	}
+}
+
+//CloseProc stop listening and drop the connections which are not attached yet
+func (c *reverseControl) CloseProc() {
+	c.listener.Close()
+	reverseConns.removeOwner(c)
+	c.log.LogInfo("user:%s release reverse tunnel on port:%d", c.user.Name, c.port)
+}
+
+//bindReverse handle the CmdBind handshake on the server
+func (t *tunnelSession) bindReverse(user *UserConfig, arg string) (byte, error) {
+	port, err := strconv.Atoi(arg)
+	if err != nil {
+		return tunnel.StatusBadRequest, err
+	}
+	if user == nil || !user.canBind(port) {
+		return tunnel.StatusNotAllowed, errors.New("bind port not allowed:" + arg)
+	}
+	host, _, _ := net.SplitHostPort(t.cfg.BindAddr)
+	ctrl, err := newReverseControl(host, port, user, t.codec, t.log)
+	if err != nil {
+		return tunnel.StatusFailed, err
+	}
+	t.info.setDest("bind", net.JoinHostPort(host, arg))
+	t.info.setRoute("listen", "")
+	t.delegate = ctrl
+	return tunnel.StatusOK, nil
+}
+
+//acceptReverse handle the CmdAccept handshake on the server
+func (t *tunnelSession) acceptReverse(user *UserConfig, arg string) (byte, error) {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return tunnel.StatusBadRequest, err
+	}
+	p := reverseConns.take(uint32(id))
+	if p == nil {
+		return tunnel.StatusFailed, errors.New("no pending reverse connection:" + arg)
+	}
+	if user == nil || p.owner.user.Name != user.Name {
+		p.conn.Close()
+		return tunnel.StatusNotAllowed, errors.New("reverse connection belongs to other user:" + arg)
+	}
+	t.info.setDest("reverse", p.conn.RemoteAddr().String())
+	up := NewUpstreamWithConn(p.conn, t.log)
+	t.info.setRoute("tunnel", "")
+	t.delegate = newTunnelRelay(t.codec, up, true, t.limiter, t.cfg.Timeouts, t.log)
+	return tunnel.StatusOK, nil
+}
+
+//runReverseTunnel keep the reverse tunnel registered on the server
+func runReverseTunnel(rc *ReverseConfig, cfg *ServerConfig, logHandle *utility.LogModule) {
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	for {
+		err := serveReverseTunnel(rc, cfg, log)
+		if listeners.stopping() {
+			log.LogInfo("reverse tunnel remote port:%d target:%s stopped", rc.RemotePort, rc.Target)
+			return
+		}
+		log.LogWarn("reverse tunnel remote port:%d target:%s exit:%v", rc.RemotePort, rc.Target, err)
+		time.Sleep(reverseRetryInterval)
+	}
+}
+
+func serveReverseTunnel(rc *ReverseConfig, cfg *ServerConfig, log *utility.LogContext) error {
+	conn, codec, err := cfg.tunnelServer().dial(tunnel.CmdBind, strconv.Itoa(rc.RemotePort), "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	//the control connection is closed at shutdown like a listener
+	if !listeners.add(conn) {
+		return errors.New("shutting down")
+	}
+	defer listeners.remove(conn)
+	buf := make([]byte, 4096)
+	dataLen := 0
+	waitStatus := true
+	for {
+		if dataLen == len(buf) {
+			return errors.New("control frame too large")
+		}
+		n, err := conn.Read(buf[dataLen:])
+		if err != nil {
+			return err
+		}
+		dataLen += n
+		total := 0
+		for {
+			size, payload, err := codec.Decode(buf[total:dataLen])
+			if err != nil {
+				return err
+			}
+			if size == 0 {
+				break
+			}
+			total += size
+			if waitStatus {
+				waitStatus = false
+				if err := checkStatus(payload); err != nil {
+					return err
+				}
+				log.LogInfo("reverse tunnel remote port:%d target:%s ready", rc.RemotePort, rc.Target)
+				continue
+			}
+			if len(payload) != 4 {
+				return errors.New("invalid reverse notify")
+			}
+			_, id := utility.ReadUint32(payload)
+			go attachReverse(id, rc, currentState().cfg, log.GetHandle())
+		}
+		copy(buf, buf[total:dataLen])
+		dataLen -= total
+	}
+}
+
+//attachReverse connect the local target and hand the inbound connection over to it
+func attachReverse(id uint32, rc *ReverseConfig, cfg *ServerConfig, logHandle *utility.LogModule) {
+	log := utility.NewLogContext(0, logHandle)
+	addr, err := net.ResolveTCPAddr("tcp", rc.Target)
+	if err != nil {
+		log.LogWarn("invalid reverse target:%s err:%v", rc.Target, err)
+		return
+	}
+	start := time.Now()
+	target := NewUpstream(0, []*net.TCPAddr{addr}, log)
+	metrics.observeDial("destination", start, target == nil)
+	if target == nil {
+		log.LogWarn("failed to connect reverse target:%s", rc.Target)
+		return
+	}
+	info := sessions.add("reverse", cfg.ServerIP, log)
+	conn, codec, err := cfg.tunnelServer().dial(tunnel.CmdAccept, strconv.FormatUint(uint64(id), 10), info.traceID())
+	if err != nil {
+		log.LogWarn("failed to attach reverse connection:%d err:%v", id, err)
+		info.setReason("dial_failed")
+		sessions.remove(info)
+		target.Close()
+		return
+	}
+	info.setDest("reverse", rc.Target)
+	info.setRoute("direct", target.RemoteAddr())
+	relay := newTunnelRelay(codec, target, true, currentState().limits.newSessionLimiter(nil, info), cfg.Timeouts, log)
+	relay.waitStatus = true
+	relay.info = info
+	con := netcore.NewConnection(conn, relay, log)
+	info.setKill(con.Close)
+}
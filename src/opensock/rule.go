@@ -0,0 +1,95 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"utility"
+)
+
+//RuleConfig send the sessions whose domain matches to another outbound than
+//the route of their inbound. Domains match their subdomains too. A session is
+//matched by the domain sniffed from its first bytes and by the host it asked for
+type RuleConfig struct {
+	Domains  []string `json:"domains"`
+	Outbound string   `json:"outbound"`
+}
+
+//buildRules check the rules against the outbounds
+func (cfg *ServerConfig) buildRules() error {
+	for _, r := range cfg.Rules {
+		if len(r.Domains) == 0 {
+			return errors.New("rule without domains")
+		}
+		for i, d := range r.Domains {
+			r.Domains[i] = normalizeDomain(d)
+		}
+		if _, ok := cfg.outbounds[r.Outbound]; !ok {
+			return errors.New("unknown outbound of rule:" + r.Outbound)
+		}
+	}
+	return nil
+}
+
+//matchRule return the rule of the session, nil when none matches. The rule of
+//the sniffed domain wins over the one of the host asked for, unless that one
+//blocks: a client can't get around a block by sending another domain
+func (cfg *ServerConfig) matchRule(req *DialRequest) *RuleConfig {
+	if req.Network == networkUnix {
+		return nil
+	}
+	host, _ := splitDest(req.Dest)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	sniffed, asked := cfg.firstRule(req.Domain), cfg.firstRule(host)
+	if sniffed == nil || asked != nil && cfg.blocks(asked) {
+		return asked
+	}
+	return sniffed
+}
+
+//firstRule return the first rule matching domain, nil when none does or
+//domain is empty
+func (cfg *ServerConfig) firstRule(domain string) *RuleConfig {
+	if domain == "" {
+		return nil
+	}
+	for _, r := range cfg.Rules {
+		for _, d := range r.Domains {
+			if matchDomain(domain, d) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+//blocks check whether r sends the sessions to a block outbound
+func (cfg *ServerConfig) blocks(r *RuleConfig) bool {
+	_, ok := cfg.outbounds[r.Outbound].(*blockOutbound)
+	return ok
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+//matchDomain check whether host is domain or one of its subdomains
+func matchDomain(host, domain string) bool {
+	host = normalizeDomain(host)
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+//blockOutbound refuse every session, a rule sending to it is an access control
+type blockOutbound struct{}
+
+var errBlocked = errors.New("blocked by rule")
+
+func newBlockOutbound(out *OutboundConfig) (Outbound, error) {
+	return &blockOutbound{}, nil
+}
+
+func (o *blockOutbound) Dial(req *DialRequest, log *utility.LogContext) (net.Conn, error) {
+	return nil, errBlocked
+}
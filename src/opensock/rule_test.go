@@ -0,0 +1,46 @@
+package opensock
+
+import "testing"
+
+func TestMatchRule(t *testing.T) {
+	cfg := &ServerConfig{
+		Rules: []*RuleConfig{
+			{Domains: []string{"Ads.Example.com."}, Outbound: routeBlock},
+			{Domains: []string{"example.com"}, Outbound: "proxy"},
+			{Domains: []string{"internal.corp"}, Outbound: routeDirect},
+		},
+		outbounds: map[string]Outbound{routeDirect: &directOutbound{}, routeBlock: &blockOutbound{}, "proxy": &directOutbound{}},
+	}
+	if err := cfg.buildRules(); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		dest     string
+		domain   string
+		network  string
+		outbound string
+	}{
+		{"host", "www.example.com:443", "", "", "proxy"},
+		{"subdomain case", "x.ADS.example.com.:80", "", "", routeBlock},
+		{"no rule", "example.org:443", "", "", ""},
+		{"ip", "10.0.0.1:443", "", "", ""},
+		{"ip sniffed", "10.0.0.1:443", "ads.example.com", "", routeBlock},
+		{"sniffed wins", "www.example.com:443", "db.internal.corp", "", routeDirect},
+		{"sniffed without rule", "www.example.com:443", "example.org", "", "proxy"},
+		{"host blocked", "ads.example.com:443", "www.example.com", "", routeBlock},
+		{"host blocked, sniffed without rule", "ads.example.com:443", "example.org", "", routeBlock},
+		{"sniffed blocked", "db.internal.corp:443", "ads.example.com", "", routeBlock},
+		{"unix", "unix:/run/ads.example.com", "", networkUnix, ""},
+	}
+	for _, c := range cases {
+		r := cfg.matchRule(&DialRequest{Dest: c.dest, Domain: c.domain, Network: c.network})
+		outbound := ""
+		if r != nil {
+			outbound = r.Outbound
+		}
+		if outbound != c.outbound {
+			t.Errorf("%s: outbound %q, %q expected", c.name, outbound, c.outbound)
+		}
+	}
+}
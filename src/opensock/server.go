@@ -2,12 +2,13 @@ package opensock
 
 import(
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"netcore"
-	"time"
 	"utility"
-	"strings"
-	"strconv"
+	"sync/atomic"
+	"fmt"
+	"os"
 
 )
 
@@ -16,57 +17,313 @@ const (
 	modeServer
 	modeStandard
 )
+
+//DefaultConfigFile the config file read when no other is given
+const DefaultConfigFile = "opensock.cfg"
+
+//Version is set by the build with -ldflags "-X opensock.Version=..."
+var Version = "dev"
 type ServerConfig struct{
 	ServerIP string `json:"serverip"`
 	BindAddr string `json:"bindaddr"`
 	Mode     string `json:"mode"`
 	Key 	 string `json:"key"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Users    []*UserConfig `json:"users"`
+	Reverse  []*ReverseConfig `json:"reverse"`
+	Forwards []*ForwardConfig `json:"forwards"`
+	DNS      *DNSConfig `json:"dns"`
+	Limits   *LimitConfig `json:"limits"`
+	Admission *netcore.AdmissionConfig `json:"admission"`
+	Timeouts *TimeoutConfig `json:"timeouts"`
+	NoDirectCopy bool `json:"nodirectcopy"` //relay through netcore in the standard mode
+	DrainTimeout int `json:"draintimeout"` //seconds the sessions have to finish at shutdown
+	Admin    *AdminConfig `json:"admin"`
+	AccessLog *AccessLogConfig `json:"accesslog"`
+	Capture  *CaptureConfig `json:"capture"`
+	Sniff    bool `json:"sniff"` //sniff the domain on the listener of mode
+	SniffTimeout int `json:"snifftimeout"` //milliseconds waited for the first bytes of a sniffed client
+	ProxyProtocol *ProxyProtocolConfig `json:"proxyprotocol"` //the header of a load balancer on the listener of mode
+	Socket   *SocketConfig `json:"socket"` //the sockets of the listeners of mode and of the implied outbounds
+	Rules    []*RuleConfig `json:"rules"`
+	Inbounds []*InboundConfig `json:"inbounds"`
+	Outbounds []*OutboundConfig `json:"outbounds"`
+	inbounds []*InboundConfig //the inbounds including the ones implied by mode
+	outbounds map[string]Outbound //by tag, including direct and tunnel
+	route string //the tag of the outbound reaching the destination of the sessions
+	socksAuth bool //the socks clients authenticate with the users
+	sniff bool //look for the domain in the first bytes of the clients
 }
 
 type SockServer struct{
 	mode int
 	log *utility.LogModule 
 	logCtx *utility.LogContext
+	stopChan chan struct{}
+	opts *Options
+}
+
+//Options how the server is started. Mode and BindAddr override the config file
+//when they are not empty, the reloads keep the overrides
+type Options struct{
+	Config   string
+	Mode     string
+	BindAddr string
+}
+
+var admission *netcore.Admission
+
+//runtimeState the config and the limits used by new sessions. Reload replaces it
+//as a whole, the running sessions keep what they started with
+type runtimeState struct{
+	cfg *ServerConfig
+	limits *rateLimits
+	inbounds map[string]*InboundConfig
+}
+
+var activeState atomic.Value
+var defaultState = &runtimeState{cfg: &ServerConfig{}, limits: newRateLimits(nil)}
+
+func currentState() *runtimeState{
+	if st, ok := activeState.Load().(*runtimeState); ok{
+		return st
+	}
+	return defaultState
+}
+
+func setState(cfg *ServerConfig){
+	st := &runtimeState{cfg: cfg, limits: newRateLimits(cfg.Limits), inbounds: make(map[string]*InboundConfig)}
+	for _, in := range cfg.inbounds{
+		st.inbounds[in.Tag] = in
+	}
+	activeState.Store(st)
 }
 
-var serverConfig *ServerConfig
+func (st *runtimeState) inbound(tag string) *InboundConfig{
+	return st.inbounds[tag]
+}
 func NewSockServer(log *utility.LogModule)*SockServer{
+	return NewSockServerWithOptions(log, &Options{Config: DefaultConfigFile})
+}
+
+//NewSockServerWithOptions create a server reading the config file of opts
+func NewSockServerWithOptions(log *utility.LogModule, opts *Options)*SockServer{
 	return &SockServer{
 		mode:modeStandard,
 		log:log,
 		logCtx: utility.NewLogContext(0, log),
+		stopChan: make(chan struct{}, 2),
+		opts: opts,
+	}
+}
+
+//stop ask Main to shut down, asking again skips the draining
+func (serv *SockServer) stop(){
+	select{
+	case serv.stopChan <- struct{}{}:
+	default:
 	}
 }
-func LoadConfig(log *utility.LogContext) *ServerConfig{
-	data, err := ioutil.ReadFile("opensock.cfg")	
+//ReadConfig read and validate the config file at path
+func ReadConfig(path string) (*ServerConfig, error){
+	data, err := ioutil.ReadFile(path)	
 	if err != nil{
-		log.LogWarn("load config error:%v", err)
-		return nil
+		return nil, errors.New("load config error:" + err.Error())
 	}
 	cfg := &ServerConfig{}
 	if err := json.Unmarshal(data, cfg); err != nil{
-		log.LogWarn("%v", err)
-		return nil
+		return nil, errors.New("parse config " + path + ":" + err.Error())
 	}
-	return cfg	
+	if err := cfg.validate(); err != nil{
+		return nil, errors.New("invalid config:" + err.Error())
+	}
+	return cfg, nil
+}
+
+//loadConfig read the config file of the options and apply the overrides
+func (serv *SockServer) loadConfig() (*ServerConfig, error){
+	cfg, err := ReadConfig(serv.opts.Config)
+	if err != nil{
+		return nil, err
+	}
+	if serv.opts.Mode != ""{
+		cfg.Mode = serv.opts.Mode
+	}
+	if serv.opts.BindAddr != ""{
+		cfg.BindAddr = serv.opts.BindAddr
+	}
+	if err := cfg.buildOutbounds(); err != nil{
+		return nil, errors.New("invalid config:" + err.Error())
+	}
+	if err := cfg.buildRules(); err != nil{
+		return nil, errors.New("invalid config:" + err.Error())
+	}
+	if err := cfg.buildInbounds(); err != nil{
+		return nil, errors.New("invalid config:" + err.Error())
+	}
+	return cfg, nil
+}
+
+//CheckConfig validate the config file at path like the server does at start
+func CheckConfig(path string) error{
+	serv := &SockServer{opts: &Options{Config: path}}
+	_, err := serv.loadConfig()
+	return err
 }
-func (serv *SockServer) Main(){
-	cfg :=  LoadConfig(serv.logCtx)	
-	if cfg == nil{
-		panic("invalid config file")
+
+func (cfg *ServerConfig) validate() error{
+	if len(cfg.Key) > 256{
+		return errors.New("key longer than 256 bytes")
+	}
+	for _, u := range cfg.Users{
+		if err := u.validate(); err != nil{
+			return err
+		}
+	}
+	for _, r := range cfg.Reverse{
+		if r.RemotePort <= 0 || r.RemotePort > 65535 || r.Target == ""{
+			return errors.New("invalid reverse tunnel")
+		}
+	}
+	for _, f := range cfg.Forwards{
+		if err := f.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.DNS != nil{
+		if err := cfg.DNS.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.Limits != nil{
+		if err := cfg.Limits.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.Admission != nil{
+		if err := cfg.Admission.Validate(); err != nil{
+			return err
+		}
 	}
-	serverConfig = cfg
-	addrPair := strings.Split(cfg.BindAddr, ":")	
-	if len(addrPair) != 2{
-		panic("invalid ip address")
+	if cfg.Timeouts != nil{
+		if err := cfg.Timeouts.validate(); err != nil{
+			return err
+		}
 	}
+	if cfg.Admin != nil{
+		if err := cfg.Admin.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.AccessLog != nil{
+		if err := cfg.AccessLog.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.Capture != nil{
+		if err := cfg.Capture.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.ProxyProtocol != nil{
+		if err := cfg.ProxyProtocol.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.Socket != nil{
+		if err := cfg.Socket.validate(); err != nil{
+			return err
+		}
+	}
+	if cfg.SniffTimeout < 0{
+		return errors.New("negative sniff timeout")
+	}
+	if cfg.DrainTimeout < 0{
+		return errors.New("negative drain timeout")
+	}
+	return nil
+}
 
-	port, err := strconv.Atoi(addrPair[1])
+//Reload load the config file again for the new sessions, the running sessions
+//keep the config they started with. The listeners, the reverse tunnel bindings,
+//the dns and the access log need a restart
+func (serv *SockServer) Reload() error{
+	cfg, err := serv.loadConfig()
 	if err != nil{
-		panic("invalid port")
+		return err
 	}
-	go netcore.TcpServer(addrPair[0], port, serv.logCtx, ClientInit)
-	for{
-		time.Sleep(time.Second * 10)
+	old := currentState().cfg
+	if cfg.listenerKey() != old.listenerKey(){
+		return errors.New("mode, bindaddr and the inbound listeners can't change without restart")
 	}
-}
\ No newline at end of file
+	setState(cfg)
+	if admission == nil && cfg.Admission != nil{
+		serv.logCtx.LogWarn("admission control starts after restart")
+	}
+	admission.Update(cfg.Admission)
+	serv.logCtx.LogInfo("config reloaded")
+	return nil
+}
+//Main run the server until it's asked to stop, it returns the exit status
+func (serv *SockServer) Main() int{
+	cfg, err := serv.loadConfig()
+	if err != nil{
+		return serv.fail(err.Error())
+	}
+	lns, err := serv.listenInbounds(cfg)
+	if err != nil{
+		return serv.fail(err.Error())
+	}
+	setState(cfg)
+	admission = netcore.NewAdmission(cfg.Admission)
+	if cfg.AccessLog != nil{
+		if accessLog, err = newAccessLogger(cfg.AccessLog, serv.logCtx); err != nil{
+			for _, ln := range lns{
+				ln.Close()
+			}
+			return serv.fail("failed to open access log:" + err.Error())
+		}
+	}
+	go logStats(serv.logCtx)
+	go serv.handleSignals()
+	if cfg.Admin != nil{
+		go startAdmin(cfg.Admin, serv)
+	}
+	for i, in := range cfg.inbounds{
+		serv.logCtx.LogInfo("inbound:%s type:%s listen:%s route:%s", in.Tag, in.Type, in.Listen, in.Route)
+		if in.Socket != nil{
+			serv.logCtx.LogInfo("inbound:%s socket options:%s", in.Tag, in.Socket.String())
+		}
+		listeners.add(lns[i])
+		//the inbounds admit the connections, after the PROXY protocol header
+		go netcore.ServeTCPThrottled(lns[i], serv.logCtx, admission, inboundHandler(in.Tag))
+	}
+	if cfg.Socket != nil{
+		serv.logCtx.LogInfo("implied outbounds socket options:%s", cfg.Socket.String())
+	}
+	for _, out := range cfg.Outbounds{
+		if out.Socket != nil{
+			serv.logCtx.LogInfo("outbound:%s socket options:%s", out.Tag, out.Socket.String())
+		}
+	}
+	//the reverse tunnels and the dns need a server
+	if cfg.ServerIP != ""{
+		for _, r := range cfg.Reverse{
+			go runReverseTunnel(r, cfg, serv.log)
+		}
+		if cfg.DNS != nil{
+			go startDNS(cfg.DNS, cfg, serv.log)
+		}
+	}
+	<-serv.stopChan
+	return serv.Shutdown(serv.stopChan)
+}
+
+//fail log why the server can't start and stop the log module
+func (serv *SockServer) fail(reason string) int{
+	serv.logCtx.LogWarn("failed to start:%s", reason)
+	serv.log.Exit()
+	fmt.Fprintln(os.Stderr, "opensock failed to start:" + reason)
+	return ExitFailed
+}
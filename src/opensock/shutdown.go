@@ -0,0 +1,111 @@
+package opensock
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDrainTimeout = 30
+	drainCheckInterval  = 100 * time.Millisecond
+	//closeWait how long the sessions closed at the deadline have to exit
+	closeWait = time.Second
+)
+
+//the exit status of the process
+const (
+	ExitOK      = 0  //all the sessions finished in time, or the command succeeded
+	ExitFailed  = 1  //the server can't start, or the command failed
+	ExitDrained = 2  //the sessions left at the drain deadline are closed
+	ExitUsage   = 64 //invalid command line
+)
+
+//listenerSet the listeners, the admin api and the tunnel control connections
+//closed at shutdown
+type listenerSet struct {
+	lock    sync.Mutex
+	closers map[io.Closer]struct{}
+	stopped bool
+}
+
+var listeners = &listenerSet{closers: make(map[io.Closer]struct{})}
+
+//add track c, it's closed at once and false is returned during shutdown
+func (l *listenerSet) add(c io.Closer) bool {
+	l.lock.Lock()
+	if l.stopped {
+		l.lock.Unlock()
+		c.Close()
+		return false
+	}
+	l.closers[c] = struct{}{}
+	l.lock.Unlock()
+	return true
+}
+
+func (l *listenerSet) remove(c io.Closer) {
+	l.lock.Lock()
+	delete(l.closers, c)
+	l.lock.Unlock()
+}
+
+func (l *listenerSet) stopping() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stopped
+}
+
+func (l *listenerSet) closeAll() {
+	l.lock.Lock()
+	l.stopped = true
+	closers := l.closers
+	l.closers = make(map[io.Closer]struct{})
+	l.lock.Unlock()
+	for c := range closers {
+		c.Close()
+	}
+}
+
+//Shutdown stop accepting, let the sessions finish until the drain timeout of
+//the config then close the rest. A value on force skips the waiting. The log
+//module is stopped, it returns the exit status
+func (serv *SockServer) Shutdown(force <-chan struct{}) int {
+	drain := time.Duration(currentState().cfg.DrainTimeout) * time.Second
+	if drain == 0 {
+		drain = defaultDrainTimeout * time.Second
+	}
+	listeners.closeAll()
+	//the reverse tunnel bindings are listeners too
+	sessions.closeAll("bind", "shutdown")
+	serv.logCtx.LogInfo("shutting down, drain %d sessions in %v", sessions.count(), drain)
+	status := ExitOK
+	if !waitSessions(drain, force) {
+		n := sessions.closeAll("", "shutdown")
+		serv.logCtx.LogWarn("close %d sessions left after draining", n)
+		waitSessions(closeWait, nil)
+		status = ExitDrained
+	}
+	accessLog.close()
+	serv.logCtx.LogInfo("shutdown complete, exit status:%d", status)
+	serv.log.Exit()
+	return status
+}
+
+//waitSessions wait until all the sessions exit, it returns false on timeout or force
+func waitSessions(timeout time.Duration, force <-chan struct{}) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for sessions.count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return false
+		case <-force:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+// +build !windows
+
+package opensock
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+//handleSignals reload the config on SIGHUP, reopen the log files on SIGUSR1 and
+//shut down on SIGTERM or SIGINT, the second one skips the draining
+func (serv *SockServer) handleSignals() {
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range signals {
+		serv.handleSignal(sig)
+	}
+}
+
+//handleSignal do what sig asks for
+func (serv *SockServer) handleSignal(sig os.Signal) {
+	switch sig {
+	case syscall.SIGHUP:
+		serv.logCtx.LogInfo("got SIGHUP, reload config")
+		if err := serv.Reload(); err != nil {
+			serv.logCtx.LogWarn("reload config err:%v", err)
+		}
+	case syscall.SIGUSR1:
+		serv.logCtx.LogInfo("got SIGUSR1, reopen log files")
+		serv.log.SendSignal()
+		accessLog.reopen()
+	default:
+		serv.logCtx.LogInfo("got %v, shut down", sig)
+		serv.stop()
+	}
+}
@@ -0,0 +1,40 @@
+// +build !windows
+
+package opensock
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+	"utility"
+)
+
+//TestSignalReopen SIGUSR1 reopens the access log moved away by logrotate
+func TestSignalReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	//the sessions of the tests before have queued their records
+	if !waitSessions(testTimeout, nil) {
+		t.Fatalf("%d sessions left", sessions.count())
+	}
+	prev := accessLog
+	accessLog = testAccessLogger(t, &AccessLogConfig{File: path})
+	defer func() { accessLog = prev }()
+	logHandle := utility.NewLog("signal", "WARN", 0, dir)
+	defer logHandle.Exit()
+	serv := NewSockServerWithOptions(logHandle, &Options{})
+	if err := os.Rename(path, path+".old"); err != nil {
+		t.Fatal(err)
+	}
+	serv.handleSignal(syscall.SIGUSR1)
+	deadline := time.Now().Add(testTimeout)
+	for _, err := os.Stat(path); os.IsNotExist(err); _, err = os.Stat(path) {
+		if time.Now().After(deadline) {
+			t.Fatal("the access log isn't reopened on SIGUSR1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	accessLog.close()
+}
@@ -0,0 +1,17 @@
+package opensock
+
+import (
+	"os"
+	"os/signal"
+)
+
+//handleSignals shut down on ctrl-c, there is no SIGHUP nor SIGUSR1 on windows,
+//use the admin api
+func (serv *SockServer) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt)
+	for sig := range signals {
+		serv.logCtx.LogInfo("got %v, shut down", sig)
+		serv.stop()
+	}
+}
@@ -0,0 +1,66 @@
+package opensock
+
+import (
+	"io"
+	"net"
+	"protocol/sniff"
+	"time"
+)
+
+//defaultSniffTimeout the milliseconds waited for the first bytes of a client,
+//a protocol where the server speaks first waits that long before it's connected
+const defaultSniffTimeout = 300
+
+//sniffer collect the first bytes of a client until the domain it's talking to
+//is found, the tls server name or the http Host
+type sniffer struct {
+	data     []byte
+	domain   string
+	deadline time.Time
+}
+
+func newSniffer(timeout int) *sniffer {
+	if timeout == 0 {
+		timeout = defaultSniffTimeout
+	}
+	return &sniffer{deadline: time.Now().Add(time.Duration(timeout) * time.Millisecond)}
+}
+
+//feed add the data of the client, it returns true when the sniffing is over
+func (s *sniffer) feed(data []byte) bool {
+	s.data = append(s.data, data...)
+	domain, done := sniff.Domain(s.data)
+	if !done && len(s.data) < sniff.MaxSize {
+		return false
+	}
+	s.domain = domain
+	return true
+}
+
+func (s *sniffer) expired() bool {
+	return !time.Now().Before(s.deadline)
+}
+
+//sniffConn read the first bytes of a connection after buffered until the domain
+//is found, the timeout or the EOF. It returns the domain and all the data read
+func sniffConn(conn net.Conn, buffered []byte, timeout int) (string, []byte, error) {
+	s := newSniffer(timeout)
+	if len(buffered) > 0 && s.feed(buffered) {
+		return s.domain, s.data, nil
+	}
+	conn.SetReadDeadline(s.deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 && s.feed(buf[:n]) {
+			return s.domain, s.data, nil
+		}
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() || err == io.EOF {
+			return "", s.data, nil
+		}
+		if err != nil {
+			return "", s.data, err
+		}
+	}
+}
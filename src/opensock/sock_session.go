@@ -2,15 +2,12 @@ package opensock
 import (
 	"core"
 	"utility"
-	"crypto/rc4"
 	"net"
 	"netcore"
 	//"strings"
-	//"time"
 	"protocol/socks"
+	"protocol/tunnel"
 	"errors"
-	"strconv"
-	"strings"
 )
 
 const(
@@ -22,115 +19,390 @@ const(
 type Sock5Session struct {
 	state        int
 	upstream     *Upstream
-	cipher       *rc4.Cipher
-	sockNodeAddr []*net.TCPAddr
 	log  		*utility.LogContext
 	con         *netcore.Connection
 	session     *core.Session
 	protocol    *socks.Sock5
-	mode 		int
+	cfg         *ServerConfig
+	user        *UserConfig
+	tunneled    bool   //the session runs on the plain data of a tunnel session, it can't detach
+	failed      error
+	limiter     *sessionLimiter
+	remote      net.Addr
+	local       net.Addr //the address of the listener the client connected
+	userAdmitted bool
+	flow        *flowState
+	direct      net.Conn //the destination of the direct relay
+	dest        string
+	sniffer     *sniffer //set while the first bytes of the client are sniffed
+	limits      *rateLimits
+	info        *sessionInfo
 }
 
+func init(){
+	RegisterInbound(inboundSocks, newSocksInbound)
+}
+
+//socksInbound a socks5 server
+type socksInbound struct{
+	in *InboundConfig
+}
+
+//legacySocksInbound the socks listener of the client mode, the server runs the socks protocol
+type legacySocksInbound struct{
+	in *InboundConfig
+}
+
+func newSocksInbound(in *InboundConfig) (Inbound, error){
+	if in.legacy{
+		return &legacySocksInbound{in: in}, nil
+	}
+	return &socksInbound{in: in}, nil
+}
+
+func (i *socksInbound) Accept(conn net.Conn, logHandle *utility.LogModule){
+	NewSock5Session(conn, logHandle, i.in.session)
+}
+
+func (i *legacySocksInbound) Accept(conn net.Conn, logHandle *utility.LogModule){
+	go newClientRelay(conn, logHandle, i.in.session)
+}
 
 func ClientInit(conn net.Conn, logHandle *utility.LogModule){
-	NewSock5Session(conn, logHandle, serverConfig)
+	metrics.acceptConn()
+	cfg := currentState().cfg
+	switch cfg.Mode{
+	case "client":
+		go newClientRelay(conn, logHandle, cfg)
+	case "server":
+		newTunnelSession(conn, logHandle, cfg)
+	default:
+		NewSock5Session(conn, logHandle, cfg)
+	}
+}
+
+//newClientRelay carry the raw socks stream of a local client through the
+//tunnel, the server runs the socks protocol
+func newClientRelay(conn net.Conn, logHandle *utility.LogModule, cfg *ServerConfig){
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	info := sessions.add("socks", conn.RemoteAddr().String(), log)
+	tunnelConn, codec, err := cfg.tunnelServer().dial(tunnel.CmdSocks, "", info.traceID())
+	if err != nil{
+		log.LogWarn("failed to connect server:%s err:%v", cfg.ServerIP, err)
+		info.setReason("dial_failed")
+		sessions.remove(info)
+		conn.Close()
+		return
+	}
+	up := NewUpstreamWithConn(tunnelConn, log)
+	info.setRoute(routeTunnel, up.RemoteAddr())
+	limiter := currentState().limits.newSessionLimiter(nil, info)
+	relay := newTunnelRelay(codec, up, false, limiter, cfg.Timeouts, log)
+	relay.waitStatus = true
+	relay.info = info
+	relay.sniffing = true
+	con := netcore.NewConnection(conn, relay, log)
+	info.setKill(con.Close)
 }
 
 //NewSock5Session create a new session
 func NewSock5Session(conn net.Conn, logHandle *utility.LogModule, cfg *ServerConfig) *Sock5Session{
+	log := utility.NewLogContext(0, logHandle)
+	s := newSocksSession(cfg, sessions.add("socks", conn.RemoteAddr().String(), log), conn.RemoteAddr(), log)
+	s.local = conn.LocalAddr()
+	s.con = netcore.NewConnection(conn, s, s.log)
+	s.info.setKill(s.con.Close)
+	return s
+}
+
+//newSocksSession create the socks session of a client, the destination is
+//resolved by the outbound
+func newSocksSession(cfg *ServerConfig, info *sessionInfo, remote net.Addr, log *utility.LogContext) *Sock5Session{
 	s := &Sock5Session{
-		log : utility.NewLogContext(0, logHandle),
+		log : log,
 		state : sessionStateUpstream,
+		cfg : cfg,
+		limits : currentState().limits,
+		remote : remote,
+		flow : newFlowState(cfg.Timeouts),
+		info : info,
 	}
-	if cfg.Mode == "server"{
-		s.mode = modeServer
-		s.cipher, _ = rc4.NewCipher([]byte(cfg.Key))
-	}else if cfg.Mode == "client"{
-		s.mode = modeClient
-		token := strings.Split(cfg.ServerIP, ":") 
-		ip := net.ParseIP(token[0])
-		port, _:= strconv.Atoi(token[1])
-		s.sockNodeAddr = make([]*net.TCPAddr, 1)
-		s.sockNodeAddr[0] = &net.TCPAddr{IP:ip, Port: port}
-		s.upstream = NewUpstream(0, s.sockNodeAddr, s.log)
-		if s.upstream == nil{
-			return nil
-		}
-		s.cipher, _ = rc4.NewCipher([]byte(cfg.Key))
-		
-	}else if cfg.Mode == "standard"{
-		s.mode = modeStandard
-	}
-	s.con = netcore.NewConnection(conn, s, s.log)
+	s.limiter = s.limits.newSessionLimiter(nil, s.info)
 	s.protocol = socks.NewSock5(s.log)
+	s.protocol.SetNoResolve()
+	if cfg.socksAuth{
+		s.protocol.SetAuth(s.socksAuth)
+	}
 	return s
 }
 
 //ReadProc process the data from connection
 func (s *Sock5Session) ReadProc(data []byte)(int, []byte, error){
-	pro := s.protocol
-	state := s.protocol.GetCurrentState()
-	decodeSize := 0
-	if s.mode == modeClient{
-			size := len(data)
-			dst := make([]byte, size + 4) 
-			utility.WriteUint32(dst, uint32(size))
-			s.cipher.XORKeyStream(dst[4:], data)
-			s.upstream.SendMsg(dst)
-			return size, nil, nil
+	if s.failed != nil{
+		return 0, nil, s.failed
 	}
-	if s.mode == modeServer{
-		_, size := utility.ReadUint32(data)
-		if int(size) < len(data) - 4{
-			return 0, nil, nil
+	s.flow.active()
+	return s.handleSocks(data)
+}
+
+//forwarding the request is done, the data goes to the destination
+func (s *Sock5Session) forwarding() bool{
+	return s.protocol.GetCurrentState() == socks.StateDataForward
+}
+
+//setUser admit the authenticated user and apply its limits, user is nil for anonymous
+func (s *Sock5Session) setUser(user *UserConfig) error{
+	if user != nil{
+		if !admission.AdmitUser(user.Name){
+			return errors.New("too many sessions for user:" + user.Name)
 		}
-		data = data[4:]
-		s.cipher.XORKeyStream(data[:size], data[:size])
-		decodeSize += 4
+		s.userAdmitted = true
 	}
+	s.user = user
+	s.limiter = s.limits.newSessionLimiter(user, s.info)
+	if user != nil{
+		s.info.setUser(user.Name)
+	}
+	return nil
+}
+
+//socksAuth check the username/password of a socks client
+func (s *Sock5Session) socksAuth(name, password string) bool{
+	user, ok := s.cfg.authenticate(name, password)
+	if !ok{
+		return false
+	}
+	if err := s.setUser(user); err != nil{
+		s.log.LogWarn("%v", err)
+		return false
+	}
+	return true
+}
 
+//handleSocks run the socks5 protocol on the plain data
+func (s *Sock5Session) handleSocks(data []byte)(int, []byte, error){
+	pro := s.protocol
+	state := s.protocol.GetCurrentState()
 	var resp []byte
 	size := 0
 	var err error
+	if s.failed != nil{
+		//the failure is replied, the session closes on the next update
+		return len(data), nil, nil
+	}
 	switch state{
 	case socks.StateMethodNegotiation:
-		size, resp, err = pro.MethodNego(data)	
+		size, resp, err = pro.MethodNego(data)
 		if err != nil{
+			handshakeFailed(s.info, s.remote, "socks_method", s.log)
+		}
+		if err != nil || size == 0{
+			return size, resp, err
+		}
+		if pro.AuthRequired(){
+			pro.SetState(socks.StateAuth)
+		}else{
+			pro.SetState(socks.StateRequest)
+		}
+	case socks.StateAuth:
+		var ok bool
+		size, resp, ok, err = pro.HandleAuth(data)
+		if err != nil && size > 0{
+			//reply the failure before closing
+			s.log.LogWarn("socks auth failed:%v", err)
+			handshakeFailed(s.info, s.remote, "socks_auth", s.log)
+			s.failed = err
+			return size, resp, nil
+		}
+		if err != nil{
+			handshakeFailed(s.info, s.remote, "socks_auth", s.log)
+		}
+		if !ok{
 			return size, resp, err
 		}
 		pro.SetState(socks.StateRequest)
 	case socks.StateRequest:
 		size, resp, err = pro.HandleRequest(data)
 		if err != nil{
+			handshakeFailed(s.info, s.remote, "socks_request", s.log)
+		}
+		if err != nil || size == 0{
 			return size, resp, err
 		}
 		pro.SetState(socks.StateDataForward)
-		s.upstream = NewUpstream(0, pro.GetDestAddr(), s.log)
-		if s.upstream == nil{
-			return size, nil, errors.New("failed to connect server")
-		}	
+		s.dest = pro.GetDestName()
+		s.info.setDest("socks", s.dest)
+		if s.cfg.sniff{
+			//the request is granted before the destination is connected, the
+			//first bytes of the client may tell its domain
+			if s.detachable(){
+				return size, resp, core.ErrDetach
+			}
+			s.sniffer = newSniffer(s.cfg.SniffTimeout)
+			return size, resp, nil
+		}
+		var conn net.Conn
+		conn, err = s.dial("")
+		if err != nil{
+			//reply the failure before closing
+			s.failed = err
+			return size, socks.FailureReply(socksReply(err)), nil
+		}
+		if s.detachable(){
+			s.direct = conn
+			return size, resp, core.ErrDetach
+		}
+		s.upstream = NewUpstreamWithConn(conn, s.log)
 	case socks.StateDataForward:
-		msg := make([]byte, len(data))
+		if s.sniffer != nil{
+			if s.sniffer.feed(data){
+				err = s.endSniff()
+			}
+			return len(data), nil, err
+		}
+		s.limiter.uploadData(data)
+		msg := utility.GetBuffer(len(data))
 		copy(msg, data)
 		s.upstream.SendMsg(msg)
 		size = len(data)
 	}
-	return size + decodeSize, resp, err
+	return size, resp, err
+}
+
+//detachable the client connection can be relayed directly once the destination is connected
+func (s *Sock5Session) detachable() bool{
+	return !s.tunneled && !s.cfg.NoDirectCopy
+}
+
+//dial connect the destination of the request, domain is the sniffed one
+func (s *Sock5Session) dial(domain string) (net.Conn, error){
+	req := &DialRequest{Dest: s.dest, Domain: domain, Client: s.remote, Local: s.local, User: s.user.userName(), Trace: s.info.traceID()}
+	conn, err := dialRoute(s.cfg, req, s.info, s.log)
+	if err != nil{
+		s.log.LogWarn("failed to connect:%s err:%v", s.dest, err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+//endSniff connect the destination with what was sniffed and send it the data
+//read meanwhile
+func (s *Sock5Session) endSniff() error{
+	sn := s.sniffer
+	s.sniffer = nil
+	conn, err := s.dial(sn.domain)
+	if err != nil{
+		return err
+	}
+	s.upstream = NewUpstreamWithConn(conn, s.log)
+	if len(sn.data) > 0{
+		s.limiter.uploadData(sn.data)
+		msg := utility.GetBuffer(len(sn.data))
+		copy(msg, sn.data)
+		s.upstream.SendMsg(msg)
+	}
+	return nil
 }
 
 func (s *Sock5Session) UpdateProc()([]byte, error){
+	if s.failed != nil{
+		return nil, s.failed
+	}
+	if s.sniffer != nil{
+		if !s.sniffer.expired(){
+			return nil, nil
+		}
+		if err := s.endSniff(); err != nil{
+			return nil, err
+		}
+	}
 	if s.upstream == nil{
+		if s.flow.expired(){
+			s.info.setReason("idle_timeout")
+			return nil, errIdleTimeout
+		}
 		return nil, nil
 	}
-	msg, err := s.upstream.RecvMsg()
-	if err == errTimeout{
-		return nil, nil
+	msg, err := s.flow.recv(s.upstream)
+	s.info.closeWith(err)
+	if err != nil || msg == nil{
+		return nil, err
 	}
-	if err != nil{
-
-	}	
 	s.log.LogDebug("recv mesg from upstream size:%d", len(msg))
+	s.limiter.downloadData(msg)
 	return msg, nil
 }
 
+//handshakeFailed count the failure and report it to the admission controller
+func handshakeFailed(info *sessionInfo, remote net.Addr, reason string, log *utility.LogContext){
+	info.setReason("handshake_failed")
+	metrics.handshakeFailure(reason)
+	if admission.HandshakeFailed(remote){
+		log.LogWarn("ban address:%s for repeated handshake failures", remote.String())
+	}
+}
+
+//DetachProc relay the client connection and the destination directly
+func (s *Sock5Session) DetachProc(conn net.Conn, buffered []byte){
+	if s.direct == nil{
+		//the request was granted to sniff the first bytes of the client
+		domain, data, err := sniffConn(conn, buffered, s.cfg.SniffTimeout)
+		if err != nil{
+			s.info.setReason("client_reset")
+		}else{
+			s.direct, err = s.dial(domain)
+		}
+		if err != nil{
+			conn.Close()
+			s.releaseUser()
+			sessions.remove(s.info)
+			return
+		}
+		buffered = data
+	}
+	relay := newDirectRelay(conn, s.direct, s.cfg.Timeouts, s.limiter, s.log)
+	relay.info = s.info
+	s.info.setKill(func(){ relay.close(false) })
+	relay.run(buffered)
+	//netcore doesn't call CloseProc for a detached connection
+	s.releaseUser()
+	sessions.remove(s.info)
+}
 
+//ShutdownProc propagate the EOF of the client to the upstream
+func (s *Sock5Session) ShutdownProc() error{
+	if s.sniffer != nil{
+		if err := s.endSniff(); err != nil{
+			return err
+		}
+	}
+	if s.upstream == nil{
+		return errors.New("client shut down before the request")
+	}
+	return s.flow.shutdown(s.upstream)
+}
+
+//ResetProc reset the upstream too when the client connection exits
+func (s *Sock5Session) ResetProc(){
+	s.info.setReason("client_reset")
+	s.flow.reset = true
+}
+
+//releaseUser give back the session slot of the user, before the session is
+//removed so the slot is free once the session is gone
+func (s *Sock5Session) releaseUser(){
+	if s.userAdmitted{
+		s.userAdmitted = false
+		admission.ReleaseUser(s.user.Name)
+	}
+}
+
+//CloseProc release the upstream when the client connection exits
+func (s *Sock5Session) CloseProc(){
+	s.releaseUser()
+	sessions.remove(s.info)
+	if s.upstream != nil{
+		s.flow.release(s.upstream)
+	}
+}
@@ -0,0 +1,196 @@
+package opensock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"netcore"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//the largest keepalive idle and interval in seconds and the most probes linux takes
+const (
+	maxKeepAliveTime  = 32767
+	maxKeepAliveCount = 127
+)
+
+//SocketConfig tune the tcp sockets of a listener or of an outbound. NoDelay
+//sends the small writes at once, on by default. The keepalive probes start after
+//KeepAliveIdle seconds without traffic and are repeated every KeepAliveInterval
+//seconds, the connection is dropped after KeepAliveCount unanswered ones. 0 keeps
+//the default and an idle of -1 disables the probes. SendBuffer and RecvBuffer are
+//the sizes in bytes of the socket buffers, 0 leaves them to the system. FastOpen
+//enables TCP Fast Open and MultipathTCP asks for MPTCP, which falls back to tcp
+//when the peer or the kernel lacks it. Both are linux only
+type SocketConfig struct {
+	NoDelay           *bool `json:"nodelay"`
+	KeepAliveIdle     int   `json:"keepaliveidle"`
+	KeepAliveInterval int   `json:"keepaliveinterval"`
+	KeepAliveCount    int   `json:"keepalivecount"`
+	SendBuffer        int   `json:"sendbuffer"`
+	RecvBuffer        int   `json:"recvbuffer"`
+	FastOpen          bool  `json:"fastopen"`
+	MultipathTCP      bool  `json:"mptcp"`
+}
+
+func (c *SocketConfig) validate() error {
+	if c.KeepAliveIdle < -1 || c.KeepAliveIdle > maxKeepAliveTime {
+		return errors.New("invalid keepalive idle:" + strconv.Itoa(c.KeepAliveIdle))
+	}
+	if c.KeepAliveInterval < 0 || c.KeepAliveInterval > maxKeepAliveTime {
+		return errors.New("invalid keepalive interval:" + strconv.Itoa(c.KeepAliveInterval))
+	}
+	if c.KeepAliveCount < 0 || c.KeepAliveCount > maxKeepAliveCount {
+		return errors.New("invalid keepalive count:" + strconv.Itoa(c.KeepAliveCount))
+	}
+	if c.KeepAliveIdle == -1 && (c.KeepAliveInterval != 0 || c.KeepAliveCount != 0) {
+		return errors.New("keepalive interval or count with the keepalive disabled")
+	}
+	if c.SendBuffer < 0 {
+		return errors.New("invalid send buffer:" + strconv.Itoa(c.SendBuffer))
+	}
+	if c.RecvBuffer < 0 {
+		return errors.New("invalid receive buffer:" + strconv.Itoa(c.RecvBuffer))
+	}
+	if c.FastOpen || c.MultipathTCP {
+		return socketOptionsSupported()
+	}
+	return nil
+}
+
+//keepAlive the keepalive of the connections, false when it's left as it is. The
+//fields not given keep their value
+func (c *SocketConfig) keepAlive() (net.KeepAliveConfig, bool) {
+	if c.KeepAliveIdle == 0 && c.KeepAliveInterval == 0 && c.KeepAliveCount == 0 {
+		return net.KeepAliveConfig{}, false
+	}
+	if c.KeepAliveIdle < 0 {
+		return net.KeepAliveConfig{}, true
+	}
+	ka := net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+	if c.KeepAliveIdle > 0 {
+		ka.Idle = time.Duration(c.KeepAliveIdle) * time.Second
+	}
+	if c.KeepAliveInterval > 0 {
+		ka.Interval = time.Duration(c.KeepAliveInterval) * time.Second
+	}
+	if c.KeepAliveCount > 0 {
+		ka.Count = c.KeepAliveCount
+	}
+	return ka, true
+}
+
+//apply set the options of a connected socket, the ones of the listener or of
+//the dial are set by listen and dialer
+func (c *SocketConfig) apply(conn *net.TCPConn) error {
+	if c.NoDelay != nil {
+		if err := conn.SetNoDelay(*c.NoDelay); err != nil {
+			return err
+		}
+	}
+	if ka, ok := c.keepAlive(); ok {
+		if err := conn.SetKeepAliveConfig(ka); err != nil {
+			return err
+		}
+	}
+	if c.SendBuffer > 0 {
+		if err := conn.SetWriteBuffer(c.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if c.RecvBuffer > 0 {
+		if err := conn.SetReadBuffer(c.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//listen on host:port with the fast open and the mptcp of c, which may be nil
+func (c *SocketConfig) listen(host string, port int) (net.Listener, error) {
+	if c == nil || !c.FastOpen && !c.MultipathTCP {
+		return netcore.ListenTCP(host, port)
+	}
+	lc := &net.ListenConfig{}
+	lc.SetMultipathTCP(c.MultipathTCP)
+	if c.FastOpen {
+		lc.Control = func(network, address string, raw syscall.RawConn) error {
+			return controlSocket(raw, func(fd uintptr) error {
+				return c.control(fd, true)
+			})
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+//dialer add the fast open and the mptcp of c to d, control is the one the
+//egress already set
+func (c *SocketConfig) dialer(d *net.Dialer) {
+	d.SetMultipathTCP(c.MultipathTCP)
+	if !c.FastOpen {
+		return
+	}
+	control := d.Control
+	d.Control = func(network, address string, raw syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, raw); err != nil {
+				return err
+			}
+		}
+		return controlSocket(raw, func(fd uintptr) error {
+			return c.control(fd, false)
+		})
+	}
+}
+
+//listenKey the options of a listener which can't change without restart
+func (c *SocketConfig) listenKey() string {
+	if c == nil {
+		return ""
+	}
+	return strconv.FormatBool(c.FastOpen) + " " + strconv.FormatBool(c.MultipathTCP)
+}
+
+//String the options set, for the log
+func (c *SocketConfig) String() string {
+	var opts []string
+	if c.NoDelay != nil {
+		opts = append(opts, "nodelay:"+strconv.FormatBool(*c.NoDelay))
+	}
+	if ka, ok := c.keepAlive(); ok && !ka.Enable {
+		opts = append(opts, "keepalive:off")
+	} else if ok {
+		opts = append(opts, "keepalive:"+strconv.Itoa(c.KeepAliveIdle)+"/"+strconv.Itoa(c.KeepAliveInterval)+"/"+strconv.Itoa(c.KeepAliveCount))
+	}
+	if c.SendBuffer > 0 {
+		opts = append(opts, "sendbuffer:"+strconv.Itoa(c.SendBuffer))
+	}
+	if c.RecvBuffer > 0 {
+		opts = append(opts, "recvbuffer:"+strconv.Itoa(c.RecvBuffer))
+	}
+	if c.FastOpen {
+		opts = append(opts, "fastopen")
+	}
+	if c.MultipathTCP {
+		opts = append(opts, "mptcp")
+	}
+	if len(opts) == 0 {
+		return "default"
+	}
+	return strings.Join(opts, " ")
+}
+
+//controlSocket run f on the file descriptor of raw
+func controlSocket(raw syscall.RawConn, f func(fd uintptr) error) error {
+	var ferr error
+	err := raw.Control(func(fd uintptr) {
+		ferr = f(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,23 @@
+package opensock
+
+import "syscall"
+
+const (
+	tcpFastOpen        = 0x17 //TCP_FASTOPEN
+	tcpFastOpenConnect = 0x1e //TCP_FASTOPEN_CONNECT, linux 4.11
+	//fastOpenQueue the pending fast open requests of a listener
+	fastOpenQueue = 256
+)
+
+func socketOptionsSupported() error {
+	return nil
+}
+
+//control enable the fast open of a listener, or of a connection which then
+//sends its first data with the SYN
+func (c *SocketConfig) control(fd uintptr, listen bool) error {
+	if listen {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueue)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+}
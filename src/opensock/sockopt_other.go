@@ -0,0 +1,15 @@
+// +build !linux
+
+package opensock
+
+import "errors"
+
+var errNoSocketOptions = errors.New("fastopen and mptcp are only supported on linux")
+
+func socketOptionsSupported() error {
+	return errNoSocketOptions
+}
+
+func (c *SocketConfig) control(fd uintptr, listen bool) error {
+	return errNoSocketOptions
+}
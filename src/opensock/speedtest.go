@@ -0,0 +1,352 @@
+package opensock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"netcore"
+	"protocol/tunnel"
+	"strconv"
+	"strings"
+	"time"
+	"utility"
+)
+
+const (
+	speedTestPing     = "ping"
+	speedTestUpload   = "upload"
+	speedTestDownload = "download"
+	//maxSpeedTestBytes the most bytes a client may ask the server to send
+	maxSpeedTestBytes = 1 << 30
+	speedTestTimeout  = 30 * time.Second
+	defaultPings      = 10
+	defaultTestBytes  = 10 * 1024 * 1024
+)
+
+//speedTest the server end of a speed test, it runs on the connection detached
+//from netcore so the throughput isn't bound by the polling
+type speedTest struct {
+	kind    string
+	size    int64
+	codec   *tunnel.Codec
+	limiter *sessionLimiter
+	info    *sessionInfo
+	log     *utility.LogContext
+}
+
+//startSpeedTest handle the CmdTest handshake on the server
+func (t *tunnelSession) startSpeedTest(arg string) (byte, error) {
+	kind, size := arg, int64(0)
+	var err error
+	if i := strings.IndexByte(arg, ':'); i >= 0 {
+		kind = arg[:i]
+		size, err = strconv.ParseInt(arg[i+1:], 10, 64)
+	}
+	switch kind {
+	case speedTestPing, speedTestUpload:
+	case speedTestDownload:
+		if err != nil || size <= 0 || size > maxSpeedTestBytes {
+			return tunnel.StatusBadRequest, errors.New("invalid speed test size:" + arg)
+		}
+	default:
+		return tunnel.StatusBadRequest, errors.New("unknown speed test:" + arg)
+	}
+	t.info.setDest("speedtest", "")
+	t.log.LogInfo("speed test:%s of client:%s", arg, t.remote.String())
+	s := &speedTest{kind: kind, size: size, codec: t.codec, limiter: t.limiter, info: t.info, log: t.log}
+	t.detach = s.run
+	return tunnel.StatusOK, nil
+}
+
+//run answer the test until the client closes the connection
+func (s *speedTest) run(conn net.Conn, buffered []byte) {
+	defer utility.CatchPanic(s.log, nil)
+	raw := conn
+	if tcpConn, ok := netcore.TCPConn(conn); ok {
+		raw = tcpConn
+	}
+	stream := tunnel.NewBufferedConn(raw, s.codec, buffered)
+	var err error
+	switch s.kind {
+	case speedTestPing:
+		err = s.echo(stream)
+	case speedTestUpload:
+		err = s.receive(stream)
+	case speedTestDownload:
+		err = s.send(stream)
+	}
+	if err != nil {
+		s.log.LogInfo("speed test of client:%s err:%v", conn.RemoteAddr().String(), err)
+		s.info.setReason("client_reset")
+	}
+	conn.Close()
+}
+
+//echo send every frame back
+func (s *speedTest) echo(stream *tunnel.Conn) error {
+	for {
+		stream.SetReadDeadline(time.Now().Add(speedTestTimeout))
+		payload, err := stream.ReadFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.limiter.uploadBytes(len(payload))
+		s.limiter.downloadBytes(len(payload))
+		stream.SetWriteDeadline(time.Now().Add(speedTestTimeout))
+		if _, err := stream.Write(payload); err != nil {
+			return err
+		}
+	}
+}
+
+//receive count the bytes until the EOF, then reply the count
+func (s *speedTest) receive(stream *tunnel.Conn) error {
+	buf := make([]byte, tunnel.MaxPayload)
+	var total uint64
+	for {
+		stream.SetReadDeadline(time.Now().Add(speedTestTimeout))
+		n, err := stream.Read(buf)
+		total += uint64(n)
+		s.limiter.uploadBytes(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, total)
+	stream.SetWriteDeadline(time.Now().Add(speedTestTimeout))
+	if _, err := stream.Write(count); err != nil {
+		return err
+	}
+	return stream.CloseWrite()
+}
+
+//send the bytes asked, then wait for the client to close
+func (s *speedTest) send(stream *tunnel.Conn) error {
+	chunk := make([]byte, tunnel.MaxPayload)
+	for left := s.size; left > 0; {
+		n := len(chunk)
+		if int64(n) > left {
+			n = int(left)
+		}
+		s.limiter.downloadBytes(n)
+		stream.SetWriteDeadline(time.Now().Add(speedTestTimeout))
+		if _, err := stream.Write(chunk[:n]); err != nil {
+			return err
+		}
+		left -= int64(n)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return err
+	}
+	stream.SetReadDeadline(time.Now().Add(speedTestTimeout))
+	_, err := io.Copy(io.Discard, stream)
+	return err
+}
+
+//SpeedTestOptions the server to test, the empty fields are taken from Config.
+//Pings is the number of round trips and Bytes the size of each transfer
+type SpeedTestOptions struct {
+	Config   string
+	Server   string
+	Key      string
+	User     string
+	Password string
+	Pings    int
+	Bytes    int64
+}
+
+//SpeedTestResult what the speed test measured
+type SpeedTestResult struct {
+	Server   string
+	Trace    string        //the trace id of the test streams in the logs of the server
+	Connect  time.Duration //the tcp connection and the handshake
+	RTTMin   time.Duration
+	RTTAvg   time.Duration
+	RTTMax   time.Duration
+	Download time.Duration //the time to receive Bytes
+	Upload   time.Duration //the time until the server confirmed Bytes
+	Bytes    int64
+}
+
+//tunnel the tunnel outbound of the options
+func (opts *SpeedTestOptions) tunnel() (*tunnelOutbound, error) {
+	out := &OutboundConfig{Server: opts.Server, Key: opts.Key, User: opts.User, Password: opts.Password}
+	if opts.Config != "" {
+		cfg, err := ReadConfig(opts.Config)
+		if err != nil {
+			return nil, err
+		}
+		def := cfg.tunnelOutboundConfig()
+		if out.Server == "" {
+			out.Server = def.Server
+		}
+		if out.Key == "" {
+			out.Key = def.Key
+		}
+		if out.User == "" {
+			out.User = def.User
+		}
+		if out.Password == "" {
+			out.Password = def.Password
+		}
+	}
+	if out.Server == "" {
+		return nil, errors.New("serverip required")
+	}
+	o, err := newTunnelOutbound(out)
+	if err != nil {
+		return nil, err
+	}
+	return o.(*tunnelOutbound), nil
+}
+
+//SpeedTest measure the round trip time, the download and the upload throughput
+//of the tunnel to a server with test streams the server answers itself
+func SpeedTest(opts *SpeedTestOptions) (*SpeedTestResult, error) {
+	out, err := opts.tunnel()
+	if err != nil {
+		return nil, err
+	}
+	res := &SpeedTestResult{Server: out.server, Trace: utility.NewTraceID(), Bytes: opts.Bytes}
+	if res.Bytes <= 0 {
+		res.Bytes = defaultTestBytes
+	}
+	if res.Bytes > maxSpeedTestBytes {
+		return nil, errors.New("the test size is over " + strconv.Itoa(maxSpeedTestBytes) + " bytes")
+	}
+	pings := opts.Pings
+	if pings <= 0 {
+		pings = defaultPings
+	}
+	start := time.Now()
+	stream, err := out.open(tunnel.CmdTest, speedTestPing, res.Trace, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Connect = time.Since(start)
+	err = res.ping(stream, pings)
+	stream.Close()
+	if err != nil {
+		return nil, errors.New("ping:" + err.Error())
+	}
+	if err := res.download(out); err != nil {
+		return nil, errors.New("download:" + err.Error())
+	}
+	if err := res.upload(out); err != nil {
+		return nil, errors.New("upload:" + err.Error())
+	}
+	return res, nil
+}
+
+func (res *SpeedTestResult) ping(stream *tunnel.Conn, count int) error {
+	var total time.Duration
+	payload := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		stream.SetDeadline(time.Now().Add(speedTestTimeout))
+		start := time.Now()
+		if _, err := stream.Write(payload); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(stream, payload); err != nil {
+			return err
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if i == 0 || rtt < res.RTTMin {
+			res.RTTMin = rtt
+		}
+		if rtt > res.RTTMax {
+			res.RTTMax = rtt
+		}
+	}
+	res.RTTAvg = total / time.Duration(count)
+	return nil
+}
+
+func (res *SpeedTestResult) download(out *tunnelOutbound) error {
+	start := time.Now()
+	stream, err := out.open(tunnel.CmdTest, speedTestDownload+":"+strconv.FormatInt(res.Bytes, 10), res.Trace, nil)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	//the deadline is for each read, a large size takes longer than it
+	buf := make([]byte, tunnel.MaxPayload)
+	var n int64
+	for {
+		stream.SetReadDeadline(time.Now().Add(speedTestTimeout))
+		read, err := stream.Read(buf)
+		n += int64(read)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if n != res.Bytes {
+		return errors.New("received " + strconv.FormatInt(n, 10) + " bytes")
+	}
+	res.Download = time.Since(start)
+	return nil
+}
+
+func (res *SpeedTestResult) upload(out *tunnelOutbound) error {
+	start := time.Now()
+	stream, err := out.open(tunnel.CmdTest, speedTestUpload, res.Trace, nil)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	chunk := make([]byte, tunnel.MaxPayload)
+	for left := res.Bytes; left > 0; {
+		n := len(chunk)
+		if int64(n) > left {
+			n = int(left)
+		}
+		stream.SetWriteDeadline(time.Now().Add(speedTestTimeout))
+		if _, err := stream.Write(chunk[:n]); err != nil {
+			return err
+		}
+		left -= int64(n)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return err
+	}
+	count := make([]byte, 8)
+	stream.SetReadDeadline(time.Now().Add(speedTestTimeout))
+	if _, err := io.ReadFull(stream, count); err != nil {
+		return err
+	}
+	if n := binary.BigEndian.Uint64(count); n != uint64(res.Bytes) {
+		return errors.New("the server received " + strconv.FormatUint(n, 10) + " bytes")
+	}
+	res.Upload = time.Since(start)
+	return nil
+}
+
+//Print write the result for a person
+func (res *SpeedTestResult) Print(w io.Writer) {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds()*1000, 'f', 2, 64) + "ms"
+	}
+	mbits := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(res.Bytes)*8/d.Seconds()/1e6, 'f', 1, 64) + "Mbit/s"
+	}
+	size := strconv.FormatFloat(float64(res.Bytes)/(1024*1024), 'f', 1, 64) + "MB"
+	fmt.Fprintf(w, "server   %s\n", res.Server)
+	fmt.Fprintf(w, "trace    %s\n", res.Trace)
+	fmt.Fprintf(w, "connect  %s\n", ms(res.Connect))
+	fmt.Fprintf(w, "rtt      min %s avg %s max %s\n", ms(res.RTTMin), ms(res.RTTAvg), ms(res.RTTMax))
+	fmt.Fprintf(w, "download %s in %.2fs %s\n", size, res.Download.Seconds(), mbits(res.Download))
+	fmt.Fprintf(w, "upload   %s in %.2fs %s\n", size, res.Upload.Seconds(), mbits(res.Upload))
+}
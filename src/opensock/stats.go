@@ -0,0 +1,42 @@
+package opensock
+
+import (
+	"sync/atomic"
+	"time"
+	"utility"
+)
+
+const statsInterval = time.Minute
+
+//serverStats the aggregate counters of the process, the throttle fields are
+//the time spent waiting for the rate limits in nanoseconds
+type serverStats struct {
+	UploadBytes      uint64 `json:"uploadbytes"`
+	DownloadBytes    uint64 `json:"downloadbytes"`
+	UploadThrottle   int64  `json:"uploadthrottle"`
+	DownloadThrottle int64  `json:"downloadthrottle"`
+}
+
+var stats serverStats
+
+func (st *serverStats) snapshot() serverStats {
+	return serverStats{
+		UploadBytes:      atomic.LoadUint64(&st.UploadBytes),
+		DownloadBytes:    atomic.LoadUint64(&st.DownloadBytes),
+		UploadThrottle:   atomic.LoadInt64(&st.UploadThrottle),
+		DownloadThrottle: atomic.LoadInt64(&st.DownloadThrottle),
+	}
+}
+
+//logStats dump the counters periodically
+func logStats(log *utility.LogContext) {
+	for {
+		time.Sleep(statsInterval)
+		st := stats.snapshot()
+		log.LogInfo("stats upload:%d download:%d upload throttled:%v download throttled:%v",
+			st.UploadBytes, st.DownloadBytes, time.Duration(st.UploadThrottle), time.Duration(st.DownloadThrottle))
+		if admission != nil{
+			log.LogInfo("admission stats:%+v", admission.Stats())
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package opensock
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//logTimeLayout the time at the start of the lines of the debug log
+const logTimeLayout = "2006/01/02 15:04:05.000000"
+
+//traceEntry a line of log or an access record of the traced session
+type traceEntry struct {
+	time time.Time
+	file string
+	text string
+}
+
+//FindTrace write the lines of the debug logs and the access log records of the
+//session with the trace id, from all the files in the order of their time. The
+//files of the client and of the server can be mixed, it returns the matches
+func FindTrace(trace string, paths []string, w io.Writer) (int, error) {
+	var entries []*traceEntry
+	for _, path := range paths {
+		found, err := readTrace(trace, path)
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, found...)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].time.Before(entries[j].time)
+	})
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s: %s\n", e.file, e.text)
+	}
+	return len(entries), nil
+}
+
+//readTrace find the entries of the trace in one file. A line of the debug log
+//is followed by the line telling its source, which is kept with it. A line
+//whose time isn't known takes the time of the line before
+func readTrace(trace, path string) ([]*traceEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []*traceEntry
+	var last *traceEntry
+	var now time.Time
+	tag := "[trace:" + trace + "]"
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		t, logLine := lineTime(line)
+		if logLine {
+			now = t
+		}
+		if last != nil && strings.HasPrefix(line, "file:") {
+			last.text += "  " + line
+			last = nil
+			continue
+		}
+		last = nil
+		if !strings.Contains(line, trace) {
+			continue
+		}
+		//a longer id or another field holding it isn't the trace: the debug log
+		//has the tag, the json records the field and a custom format the id alone
+		e := &traceEntry{time: now, file: path, text: strings.TrimSpace(line)}
+		if rec, ok := accessRecord(line); ok {
+			if rec.Trace != trace {
+				continue
+			}
+			e.time = rec.Start.Add(time.Duration(rec.Duration * float64(time.Second)))
+		} else if strings.Contains(line, tag) {
+			last = e
+		} else if logLine || !hasWord(line, trace) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+//hasWord check that line has word between characters that can't be in it
+func hasWord(line, word string) bool {
+	for i := strings.Index(line, word); i >= 0; {
+		end := i + len(word)
+		if (i == 0 || !isWordByte(line[i-1])) && (end == len(line) || !isWordByte(line[end])) {
+			return true
+		}
+		next := strings.Index(line[i+1:], word)
+		if next < 0 {
+			return false
+		}
+		i += 1 + next
+	}
+	return false
+}
+
+func isWordByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+//lineTime parse the time of a line of the debug log, after the prefix of the logger
+func lineTime(line string) (time.Time, bool) {
+	i := strings.IndexAny(line, "0123456789")
+	if i < 0 || len(line) < i+len(logTimeLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(logTimeLayout, line[i:i+len(logTimeLayout)], time.Local)
+	return t, err == nil
+}
+
+//accessRecord parse a json line of the access log
+func accessRecord(line string) (*AccessRecord, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return nil, false
+	}
+	rec := &AccessRecord{}
+	if err := json.Unmarshal([]byte(line), rec); err != nil {
+		return nil, false
+	}
+	return rec, true
+}
@@ -0,0 +1,60 @@
+package opensock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindTrace(t *testing.T) {
+	dir := t.TempDir()
+	debug := filepath.Join(dir, "opensock.log")
+	access := filepath.Join(dir, "access.log")
+	custom := filepath.Join(dir, "custom.log")
+	lines := []string{
+		"chat2026/10/19 10:00:00.000002 [000000001][INFO]: [trace:abcd] new session  ",
+		"file:registry.go line:244",
+		"chat2026/10/19 10:00:00.000003 [000000002][INFO]: [trace:abcdef] new session  ",
+		"file:registry.go line:244",
+		"chat2026/10/19 10:00:00.000004 [000000003][INFO]: user abcd connected  ",
+		"file:inbound.go line:1",
+	}
+	records := []string{
+		`{"id":1,"trace":"abcdef","start":"2026-10-20T12:00:00Z","duration":1,"user":"abcd"}`,
+		`{"id":2,"trace":"abcd","start":"2026-10-20T12:00:00Z","duration":2}`,
+	}
+	os.WriteFile(debug, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	os.WriteFile(access, []byte(strings.Join(records, "\n")+"\n"), 0644)
+	os.WriteFile(custom, []byte("user:abcde trace:abcdef0 up:1\ntrace:abcd up:2\n"), 0644)
+	cases := []struct {
+		trace string
+		want  []string //the start of the lines found, in order
+	}{
+		{"abcd", []string{custom + ": trace:abcd up:2", debug + ": chat2026/10/19 10:00:00.000002", access + `: {"id":2`}},
+		{"abcdef", []string{debug + ": chat2026/10/19 10:00:00.000003", access + `: {"id":1`}},
+		{"abc", nil},
+		{"10", nil},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		n, err := FindTrace(c.trace, []string{access, debug, custom}, &out)
+		found := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if err != nil || n != len(c.want) || n > 0 && len(found) != n {
+			t.Errorf("%s: %d found err:%v\n%s", c.trace, n, err, out.String())
+			continue
+		}
+		for i, want := range c.want {
+			if !strings.HasPrefix(found[i], want) {
+				t.Errorf("%s: line %d %q", c.trace, i, found[i])
+			}
+		}
+		if i := n - 2; n > 0 && !strings.HasSuffix(found[i], "file:registry.go line:244") {
+			t.Errorf("%s: the source of the line is lost %q", c.trace, found[i])
+		}
+	}
+	if _, err := FindTrace("abcd", []string{filepath.Join(dir, "missing.log")}, &bytes.Buffer{}); err == nil {
+		t.Fatal("a missing file given on the command line isn't reported")
+	}
+}
@@ -0,0 +1,45 @@
+package opensock
+
+import (
+	"net"
+	"utility"
+)
+
+func init() {
+	RegisterInbound(inboundTransparent, newTransparentInbound)
+}
+
+//transparentInbound the connections redirected by the firewall
+type transparentInbound struct {
+	in *InboundConfig
+}
+
+func newTransparentInbound(in *InboundConfig) (Inbound, error) {
+	if err := transparentSupported(); err != nil {
+		return nil, err
+	}
+	return &transparentInbound{in: in}, nil
+}
+
+func (i *transparentInbound) Accept(conn net.Conn, logHandle *utility.LogModule) {
+	go serveTransparent(conn, logHandle, i.in)
+}
+
+//serveTransparent carry a connection redirected by the firewall to its original destination
+func serveTransparent(conn net.Conn, logHandle *utility.LogModule, in *InboundConfig) {
+	log := utility.NewLogContext(0, logHandle)
+	defer utility.CatchPanic(log, nil)
+	dest, err := originalDest(conn)
+	if err != nil {
+		log.LogWarn("no original destination of connection:%s err:%v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	//a connection made to the listener itself would loop
+	if dest == conn.LocalAddr().String() {
+		log.LogWarn("connection:%s is not redirected", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	routeConn(&inboundConn{conn: conn, kind: inboundTransparent, dest: dest}, logHandle, in.session)
+}
@@ -0,0 +1,59 @@
+package opensock
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"netcore"
+	"strconv"
+	"syscall"
+)
+
+//SO_ORIGINAL_DST of netfilter, the same value for ipv4 and ipv6
+const soOriginalDst = 80
+
+func transparentSupported() error {
+	return nil
+}
+
+//originalDest return the destination of a connection before the iptables REDIRECT
+func originalDest(conn net.Conn) (string, error) {
+	tcpConn, ok := netcore.TCPConn(conn)
+	if !ok {
+		return "", errors.New("not a tcp connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var dest string
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if addr, ok := tcpConn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo
+			info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+			if serr == nil {
+				dest = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(networkPort(info.Addr.Port)))
+			}
+			return
+		}
+		//sockaddr_in fits in the 16 bytes of the multicast address
+		var mreq *syscall.IPv6Mreq
+		mreq, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if serr == nil {
+			sa := mreq.Multiaddr
+			dest = net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(sa[2])<<8|int(sa[3])))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	return dest, serr
+}
+
+//networkPort convert a port stored in network byte order
+func networkPort(port uint16) int {
+	var b [2]byte
+	binary.NativeEndian.PutUint16(b[:], port)
+	return int(binary.BigEndian.Uint16(b[:]))
+}
@@ -0,0 +1,18 @@
+// +build !linux
+
+package opensock
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTransparent = errors.New("the transparent inbound is only supported on linux")
+
+func transparentSupported() error {
+	return errNoTransparent
+}
+
+func originalDest(conn net.Conn) (string, error) {
+	return "", errNoTransparent
+}
@@ -0,0 +1,298 @@
+package opensock
+
+import (
+	"core"
+	"errors"
+	"net"
+	"netcore"
+	"protocol/tunnel"
+	"utility"
+)
+
+func init() {
+	RegisterInbound(inboundTunnel, newTunnelInbound)
+}
+
+//tunnelReplays the hellos of the tunnel clients accepted by this process
+var tunnelReplays = tunnel.NewReplayFilter()
+
+//tunnelInbound the server end of the tunnel
+type tunnelInbound struct {
+	in *InboundConfig
+}
+
+func newTunnelInbound(in *InboundConfig) (Inbound, error) {
+	return &tunnelInbound{in: in}, nil
+}
+
+func (i *tunnelInbound) Accept(conn net.Conn, logHandle *utility.LogModule) {
+	newTunnelSession(conn, logHandle, i.in.session)
+}
+
+//tunnelSession the server end of a tunnel connection. The first frame is the
+//handshake whose command decides who handles the rest of the stream: a socks
+//session on the plain data, or a delegate relaying the frames to the destination
+//or holding a reverse tunnel, or a speed test taking the connection over
+type tunnelSession struct {
+	codec     *tunnel.Codec
+	cfg       *ServerConfig
+	log       *utility.LogContext
+	con       *netcore.Connection
+	remote    net.Addr
+	local     net.Addr
+	info      *sessionInfo
+	limits    *rateLimits
+	limiter   *sessionLimiter
+	user      *UserConfig
+	release   func() //give back the session slot of the user
+	flow      *flowState
+	handshake bool //the first frame has been handled
+	failed    error
+	socks     *Sock5Session
+	plain     []byte //decoded payload not consumed by the socks session yet
+	delegate  core.Session
+	detach    func(conn net.Conn, buffered []byte) //takes the connection over from netcore after the handshake
+}
+
+func newTunnelSession(conn net.Conn, logHandle *utility.LogModule, cfg *ServerConfig) *tunnelSession {
+	log := utility.NewLogContext(0, logHandle)
+	codec, err := tunnel.NewServerCodec(cfg.Key, tunnelReplays)
+	if err != nil {
+		log.LogWarn("invalid key:%v", err)
+		conn.Close()
+		return nil
+	}
+	t := &tunnelSession{
+		codec:  codec,
+		cfg:    cfg,
+		log:    log,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+		info:   sessions.add("socks", conn.RemoteAddr().String(), log),
+		limits: currentState().limits,
+		flow:   newFlowState(cfg.Timeouts),
+	}
+	t.limiter = t.limits.newSessionLimiter(nil, t.info)
+	t.con = netcore.NewConnection(conn, t, log)
+	t.info.setKill(t.con.Close)
+	return t
+}
+
+//ReadProc decode the frames of the client
+func (t *tunnelSession) ReadProc(data []byte) (int, []byte, error) {
+	if t.failed != nil {
+		return 0, nil, t.failed
+	}
+	if t.delegate != nil {
+		size, resp, err := t.delegate.ReadProc(data)
+		t.info.closeWith(err)
+		return size, resp, err
+	}
+	t.flow.active()
+	size, payload, err := t.codec.Decode(data)
+	if err != nil {
+		t.log.LogWarn("tunnel decode of client:%s err:%v", t.remote.String(), err)
+		handshakeFailed(t.info, t.remote, decodeReason(err), t.log)
+	}
+	if err != nil || size == 0 {
+		return size, nil, err
+	}
+	if !t.handshake {
+		t.handshake = true
+		resp := t.handleHandshake(payload)
+		if t.detach != nil {
+			return size, resp, core.ErrDetach
+		}
+		return size, resp, nil
+	}
+	if t.socks == nil {
+		return size, nil, nil
+	}
+	if t.socks.forwarding() && len(t.plain) == 0 {
+		_, _, err := t.socks.ReadProc(payload)
+		return size, nil, err
+	}
+	t.plain = append(t.plain, payload...)
+	var resp []byte
+	total := 0
+	for total < len(t.plain) {
+		n, r, err := t.socks.ReadProc(t.plain[total:])
+		if err != nil {
+			return size, nil, err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		resp = append(resp, r...)
+	}
+	t.plain = append(t.plain[:0], t.plain[total:]...)
+	if resp != nil {
+		resp = t.codec.Encode(resp)
+	}
+	return size, resp, nil
+}
+
+//decodeReason the metrics reason of a frame the server can't decode
+func decodeReason(err error) string {
+	switch err {
+	case tunnel.ErrReplay:
+		return "replay"
+	case tunnel.ErrClockSkew:
+		return "clock_skew"
+	}
+	return "decode"
+}
+
+//startSocks run a socks session on the plain data of the tunnel
+func (t *tunnelSession) startSocks() {
+	s := newSocksSession(t.cfg, t.info, t.remote, t.log)
+	s.tunneled = true
+	s.local = t.local
+	s.user = t.user
+	s.limiter = t.limiter
+	t.socks = s
+}
+
+//handleHandshake authenticate the tunnel client and dispatch the command.
+//The status is always replied, a failed session is closed on the next update
+func (t *tunnelSession) handleHandshake(payload []byte) []byte {
+	status := byte(tunnel.StatusOK)
+	hs, err := tunnel.ParseHandshake(payload)
+	if err != nil {
+		status = tunnel.StatusBadRequest
+	}
+	var user *UserConfig
+	if err == nil && utility.IsTraceID(hs.Trace) {
+		//the lines of both ends of the tunnel carry the trace id of the client
+		t.info.setTrace(hs.Trace)
+		t.log.SetTrace(hs.Trace)
+	}
+	if err == nil {
+		var ok bool
+		user, ok = t.cfg.authenticate(hs.User, hs.Password)
+		if !ok {
+			status = tunnel.StatusAuthFailed
+			err = errors.New("auth failed for user:" + hs.User)
+		}
+	}
+	if err == nil {
+		if err = t.setUser(user); err != nil {
+			status = tunnel.StatusBusy
+		}
+	}
+	if err == nil {
+		switch hs.Cmd {
+		case tunnel.CmdSocks:
+			t.startSocks()
+		case tunnel.CmdBind:
+			status, err = t.bindReverse(user, hs.Arg)
+		case tunnel.CmdAccept:
+			status, err = t.acceptReverse(user, hs.Arg)
+		case tunnel.CmdConnect:
+			status, err = t.connectForward(hs.Arg)
+		case tunnel.CmdTest:
+			status, err = t.startSpeedTest(hs.Arg)
+		default:
+			status = tunnel.StatusBadRequest
+			err = errors.New("unknown tunnel cmd")
+		}
+	}
+	if err != nil {
+		t.log.LogWarn("tunnel handshake failed:%v", err)
+		t.info.setReason("handshake_failed")
+		t.failed = err
+		if status == tunnel.StatusBadRequest || status == tunnel.StatusAuthFailed {
+			handshakeFailed(t.info, t.remote, statusReason(status), t.log)
+		} else {
+			metrics.handshakeFailure(statusReason(status))
+		}
+	}
+	return t.codec.Encode([]byte{status})
+}
+
+//setUser admit the authenticated user and apply its limits, user is nil for anonymous
+func (t *tunnelSession) setUser(user *UserConfig) error {
+	release, ok := admitUser(user)
+	if !ok {
+		return errors.New("too many sessions for user:" + user.Name)
+	}
+	t.release = release
+	t.user = user
+	t.limiter = t.limits.newSessionLimiter(user, t.info)
+	t.info.setUser(user.userName())
+	return nil
+}
+
+//DetachProc run what took the connection over, netcore doesn't close it
+func (t *tunnelSession) DetachProc(conn net.Conn, buffered []byte) {
+	t.info.setKill(func() { conn.Close() })
+	t.detach(conn, buffered)
+	if t.release != nil {
+		t.release()
+	}
+	sessions.remove(t.info)
+}
+
+//UpdateProc return the data for the client
+func (t *tunnelSession) UpdateProc() ([]byte, error) {
+	if t.failed != nil {
+		return nil, t.failed
+	}
+	if t.delegate != nil {
+		msg, err := t.delegate.UpdateProc()
+		t.info.closeWith(err)
+		return msg, err
+	}
+	if t.socks == nil {
+		if t.flow.expired() {
+			t.info.setReason("idle_timeout")
+			return nil, errIdleTimeout
+		}
+		return nil, nil
+	}
+	msg, err := t.socks.UpdateProc()
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	return t.codec.Encode(msg), nil
+}
+
+//ShutdownProc propagate the EOF of the client to the destination
+func (t *tunnelSession) ShutdownProc() error {
+	if t.delegate != nil {
+		if halfCloser, ok := t.delegate.(core.SessionHalfCloser); ok {
+			return halfCloser.ShutdownProc()
+		}
+		return errors.New("half-close not supported")
+	}
+	if t.socks == nil {
+		return errors.New("client shut down before the request")
+	}
+	return t.socks.ShutdownProc()
+}
+
+//ResetProc reset the destination too when the client connection exits
+func (t *tunnelSession) ResetProc() {
+	t.info.setReason("client_reset")
+	if resetter, ok := t.delegate.(core.SessionResetter); ok {
+		resetter.ResetProc()
+	}
+	if t.socks != nil {
+		t.socks.ResetProc()
+	}
+}
+
+//CloseProc release what the session holds when the client connection exits
+func (t *tunnelSession) CloseProc() {
+	if t.release != nil {
+		t.release()
+	}
+	sessions.remove(t.info)
+	if closer, ok := t.delegate.(core.SessionCloser); ok {
+		closer.CloseProc()
+	}
+	if t.socks != nil {
+		t.socks.CloseProc()
+	}
+}
@@ -0,0 +1,115 @@
+package opensock
+
+import (
+	"errors"
+	"net"
+	"netcore"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+//unixPrefix starts the listen addresses, the forward remotes and the tunnel
+//servers which are unix sockets
+const unixPrefix = "unix:"
+
+const networkUnix = "unix"
+
+//unixPath the path of a unix: address
+func unixPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return "", false
+	}
+	return addr[len(unixPrefix):], true
+}
+
+//dialAddr the network and the address to dial for a unix: path or a host:port
+func dialAddr(addr string) (string, string) {
+	if path, ok := unixPath(addr); ok {
+		return networkUnix, path
+	}
+	return "tcp", addr
+}
+
+//validAddr check a host:port or a unix: path
+func validAddr(addr string) bool {
+	if path, ok := unixPath(addr); ok {
+		return path != ""
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err == nil
+}
+
+//unixSocket the file of a unix listener, an owner of -1 is kept
+type unixSocket struct {
+	path string
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+//parseUnixSocket check the unix listener of an inbound. mode is octal, owner
+//is user, user:group or :group, by name or id
+func parseUnixSocket(path, mode, owner string) (*unixSocket, error) {
+	if path == "" {
+		return nil, errors.New("empty unix socket path")
+	}
+	s := &unixSocket{path: path, uid: -1, gid: -1}
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m == 0 || m > 0777 {
+			return nil, errors.New("invalid socket mode:" + mode)
+		}
+		s.mode = os.FileMode(m)
+	}
+	if owner == "" {
+		return s, nil
+	}
+	name, group := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		name, group = owner[:i], owner[i+1:]
+	}
+	var err error
+	if name != "" {
+		if s.uid, err = lookupID(name, false); err != nil {
+			return nil, err
+		}
+	}
+	if group != "" {
+		if s.gid, err = lookupID(group, true); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//lookupID the id of a user or a group given by name or id
+func lookupID(name string, group bool) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, errors.New("unknown socket group:" + name)
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, errors.New("unknown socket owner:" + name)
+		}
+		id = u.Uid
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, errors.New("no numeric id of:" + name)
+	}
+	return n, nil
+}
+
+func (s *unixSocket) listen() (net.Listener, error) {
+	return netcore.ListenUnix(s.path, s.mode, s.uid, s.gid)
+}
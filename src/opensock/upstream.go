@@ -1,10 +1,20 @@
 package opensock
 import(
+	"core"
 	"net"
 	"utility"
 	"netcore"
 	"errors"
-	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const(
+	upstreamOpen = iota
+	upstreamEOF    //the destination shut down its sending side
+	upstreamClosed //the connection exits before EOF
+	upstreamReset  //the destination reset the connection
 )
 
 type Upstream struct {
@@ -14,71 +24,176 @@ type Upstream struct {
 	log *utility.LogContext
 	msgChan chan []byte	
 	outMsgChan chan []byte
+	state int32
+	closeWrite int32 //the session asks to shut down the sending side
+	writeClosed bool
+	done chan struct{} //closed when the upstream is closed or its connection exits
+	doneOnce sync.Once
+	lastSend []byte //the pooled buffers returned last time, released on the next call
+	lastRecv []byte
+	remote string
 }
 var(
 errTimeout = errors.New("timeout")
+errUpstreamClosed = errors.New("upstream closed")
 )
 
 func  NewUpstream(cmd int, addrs []*net.TCPAddr, log *utility.LogContext) *Upstream {
-	up := &Upstream{}
 	for _, addr := range addrs {
 		tcpConn, err := net.DialTCP("tcp", nil, addr)
 		if err != nil {
 			log.LogWarn("%s", err.Error())
 			continue
 		}
-
-		up.log = utility.NewLogContext(0, log.GetHandle())
+		up := NewUpstreamWithConn(tcpConn, log)
 		up.tcpConn = tcpConn
-		up.conn = netcore.NewConnection(tcpConn, up, up.log)	
-		up.msgChan = make(chan []byte, 256)
-		up.outMsgChan = make(chan []byte, 128)
-		up.log.LogInfo("new upstream for connection:%d addr:%s", log.GetID(), tcpConn.LocalAddr().String())
 		return up
 	}
 	return nil
 }
 
+//NewUpstreamWithConn create an upstream on an established connection
+func NewUpstreamWithConn(conn net.Conn, log *utility.LogContext) *Upstream {
+	up := &Upstream{}
+	up.log = utility.NewLogContext(0, log.GetHandle())
+	if trace := log.Trace(); trace != "" {
+		up.log.SetTrace(trace)
+	}
+	up.msgChan = make(chan []byte, 256)
+	up.outMsgChan = make(chan []byte, 128)
+	up.done = make(chan struct{})
+	up.remote = conn.RemoteAddr().String()
+	up.conn = netcore.NewConnection(conn, up, up.log)
+	up.log.LogInfo("new upstream for connection:%d addr:%s", log.GetID(), conn.LocalAddr().String())
+	return up
+}
+
 func (u *Upstream) ReadProc(data[]byte) (int, []byte, error){
-	msg := make([]byte, len(data))
+	msg := utility.GetBuffer(len(data))
 	copy(msg, data)
-	u.outMsgChan <- msg
+	select{
+	case u.outMsgChan <- msg:
+	case <-u.done:
+		return 0, nil, errUpstreamClosed
+	}
 	return len(data), nil, nil
 }
 
+//mergeMsg append the pooled msg to out
+func mergeMsg(out, msg []byte) []byte{
+	if out == nil{
+		return msg
+	}
+	out = utility.AppendBuffer(out, msg)
+	utility.PutBuffer(msg)
+	return out
+}
+
+//UpdateProc return all the messages waiting to be sent to upstream
 func (u *Upstream) UpdateProc()([]byte, error){
-	select {
-	case msg := <- u.msgChan:
-		return msg, nil	
-	default:
+	closeWrite := atomic.LoadInt32(&u.closeWrite) == 1
+	utility.PutBuffer(u.lastSend)
+	var out []byte
+	for {
+		select {
+		case msg := <- u.msgChan:
+			out = mergeMsg(out, msg)
+		default:
+			u.lastSend = out
+			if closeWrite{
+				u.writeClosed = true
+				return out, core.ErrCloseWrite
+			}
+			return out, nil
+		}
 	}
-	return nil, nil
 }
 
-//RecvMsg return a byte slice 
+//ShutdownProc the destination won't send any more data
+func (u *Upstream) ShutdownProc() error{
+	atomic.CompareAndSwapInt32(&u.state, upstreamOpen, upstreamEOF)
+	return nil
+}
+
+//ResetProc the destination reset the connection
+func (u *Upstream) ResetProc(){
+	atomic.CompareAndSwapInt32(&u.state, upstreamOpen, upstreamReset)
+}
+
+//CloseProc wake up the session waiting on the upstream
+func (u *Upstream) CloseProc(){
+	if !u.writeClosed || atomic.LoadInt32(&u.state) != upstreamEOF{
+		atomic.CompareAndSwapInt32(&u.state, upstreamOpen, upstreamClosed)
+		atomic.CompareAndSwapInt32(&u.state, upstreamEOF, upstreamClosed)
+	}
+	u.finish()
+}
+
+func (u *Upstream) finish(){
+	u.doneOnce.Do(func(){ close(u.done) })
+}
+
+//RecvMsg return a byte slice valid until the next call. It returns io.EOF after
+//all the data is received if the destination shut down the connection,
+//errUpstreamClosed or core.ErrReset if the connection exits abnormally
 func (u *Upstream) RecvMsg()([]byte, error){
-	buf := bytes.NewBuffer(make([]byte, 0, 2048))
+	//load the state before draining, the data arrives before the state changes
+	state := atomic.LoadInt32(&u.state)
+	utility.PutBuffer(u.lastRecv)
+	u.lastRecv = nil
+	var out []byte
 	more := true
-	size := 0
 	for more{
 		select{
 		case msg := <-u.outMsgChan:
-			if msg == nil{
-				return nil, errors.New("closed channel") 
-			}
-			buf.Write(msg)
-			size += len(msg)
+			out = mergeMsg(out, msg)
 		default:
 			more = false
 		}
 	}
-	if size == 0{
-		return nil, errTimeout
+	if len(out) > 0{
+		u.lastRecv = out
+		return out, nil
 	}
-	return buf.Bytes()[:size], nil
+	switch state{
+	case upstreamEOF:
+		return nil, io.EOF
+	case upstreamClosed:
+		return nil, errUpstreamClosed
+	case upstreamReset:
+		return nil, core.ErrReset
+	}
+	return nil, errTimeout
 }
 
+//SendMsg queue msg to be sent to upstream, it takes the ownership of msg
 func (u *Upstream) SendMsg(msg []byte){
 	u.log.LogDebug("send message to upstream size:%d", len(msg))
-	u.msgChan <- msg
-}
\ No newline at end of file
+	select{
+	case u.msgChan <- msg:
+	case <-u.done:
+		u.log.LogDebug("drop message to closed upstream size:%d", len(msg))
+	}
+}
+
+//CloseWrite shut down the sending side after the queued messages are sent
+func (u *Upstream) CloseWrite(){
+	atomic.StoreInt32(&u.closeWrite, 1)
+}
+
+//RemoteAddr return the address of the destination
+func (u *Upstream) RemoteAddr() string{
+	return u.remote
+}
+
+//Close close the connection to upstream
+func (u *Upstream) Close(){
+	u.finish()
+	u.conn.Close()
+}
+
+//Abort close the connection to upstream with a reset
+func (u *Upstream) Abort(){
+	u.finish()
+	u.conn.Abort()
+}
@@ -0,0 +1,89 @@
+package opensock
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//UserConfig describe an account which may use the tunnel
+type UserConfig struct {
+	Name      string   `json:"name"`
+	Password  string   `json:"password"`
+	BindPorts []string `json:"bindports"`
+	Limit     *RateConfig `json:"limit"`
+	bindRange [][2]int
+}
+
+//parsePortRange parse "port" or "first-last"
+func parsePortRange(s string) ([2]int, error) {
+	var r [2]int
+	token := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	for i := range r {
+		p := token[0]
+		if i < len(token) {
+			p = token[i]
+		}
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || port <= 0 || port > 65535 {
+			return r, errors.New("invalid port range:" + s)
+		}
+		r[i] = port
+	}
+	if r[0] > r[1] {
+		return r, errors.New("invalid port range:" + s)
+	}
+	return r, nil
+}
+
+func (u *UserConfig) validate() error {
+	if u.Name == "" {
+		return errors.New("user without name")
+	}
+	u.bindRange = u.bindRange[:0]
+	for _, s := range u.BindPorts {
+		r, err := parsePortRange(s)
+		if err != nil {
+			return err
+		}
+		u.bindRange = append(u.bindRange, r)
+	}
+	return u.Limit.validate()
+}
+
+//canBind check whether the user is allowed to listen on the port for a reverse tunnel
+func (u *UserConfig) canBind(port int) bool {
+	for _, r := range u.bindRange {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+//userName the name of the user, empty for anonymous
+func (u *UserConfig) userName() string {
+	if u == nil {
+		return ""
+	}
+	return u.Name
+}
+
+//authenticate return the matched user. When no user is configured
+//anonymous access is allowed and a nil user is returned
+func (cfg *ServerConfig) authenticate(name, password string) (*UserConfig, bool) {
+	if len(cfg.Users) == 0 {
+		return nil, true
+	}
+	for _, u := range cfg.Users {
+		if u.Name != name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1 {
+			return u, true
+		}
+		break
+	}
+	return nil, false
+}
@@ -0,0 +1,191 @@
+package dns
+
+import (
+	"errors"
+	"strings"
+	"utility"
+)
+
+const (
+	headerLen     = 12
+	maxPointers   = 16
+	typeOPT       = 41
+	flagTC        = 1 << 9
+	flagQR        = 1 << 15
+	rcodeMask     = 0xf
+	DefaultUDPLen = 512
+)
+
+const (
+	RcodeSuccess  = 0
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+)
+
+var errInvalidMessage = errors.New("invalid dns message")
+
+//Message is the little part of a dns message needed to forward and cache it
+type Message struct {
+	ID     uint16
+	Flags  uint16
+	Name   string
+	Type   uint16
+	Class  uint16
+	//MinTTL the min ttl of the answer and authority records
+	MinTTL uint32
+	//Records number of records in answer and authority sections
+	Records int
+	//UDPSize the payload size announced by the EDNS OPT record, 0 without EDNS
+	UDPSize uint16
+	//questionEnd the offset after the first question
+	questionEnd int
+	//ttlOffsets the offset of the ttl of every record except OPT
+	ttlOffsets []int
+	ttls       []uint32
+}
+
+//readName read a possibly compressed name, it returns the name and the offset after it
+func readName(data []byte, off int) (string, int, error) {
+	labels := make([]string, 0, 4)
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(data) {
+			return "", 0, errInvalidMessage
+		}
+		l := int(data[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(data) {
+				return "", 0, errInvalidMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			jumps++
+			if jumps > maxPointers {
+				return "", 0, errInvalidMessage
+			}
+			off = (l&0x3f)<<8 | int(data[off+1])
+		default:
+			if off+1+l > len(data) {
+				return "", 0, errInvalidMessage
+			}
+			labels = append(labels, strings.ToLower(string(data[off+1:off+1+l])))
+			off += 1 + l
+		}
+	}
+}
+
+//Parse parse the header, the first question and the ttl of every record
+func Parse(data []byte) (*Message, error) {
+	if len(data) < headerLen {
+		return nil, errInvalidMessage
+	}
+	m := &Message{}
+	_, m.ID = utility.ReadUint16(data)
+	_, m.Flags = utility.ReadUint16(data[2:])
+	var counts [4]uint16
+	for i := range counts {
+		_, counts[i] = utility.ReadUint16(data[4+i*2:])
+	}
+	off := headerLen
+	for i := 0; i < int(counts[0]); i++ {
+		name, next, err := readName(data, off)
+		if err != nil || next+4 > len(data) {
+			return nil, errInvalidMessage
+		}
+		if i == 0 {
+			m.Name = name
+			_, m.Type = utility.ReadUint16(data[next:])
+			_, m.Class = utility.ReadUint16(data[next+2:])
+			m.questionEnd = next + 4
+		}
+		off = next + 4
+	}
+	records := int(counts[1]) + int(counts[2])
+	m.Records = records
+	first := true
+	for i := 0; i < records+int(counts[3]); i++ {
+		_, next, err := readName(data, off)
+		if err != nil || next+10 > len(data) {
+			return nil, errInvalidMessage
+		}
+		_, rrType := utility.ReadUint16(data[next:])
+		_, class := utility.ReadUint16(data[next+2:])
+		_, ttl := utility.ReadUint32(data[next+4:])
+		_, rdLen := utility.ReadUint16(data[next+8:])
+		if rrType == typeOPT {
+			m.UDPSize = class
+		} else {
+			m.ttlOffsets = append(m.ttlOffsets, next+4)
+			m.ttls = append(m.ttls, ttl)
+			if i < records && (first || ttl < m.MinTTL) {
+				m.MinTTL = ttl
+				first = false
+			}
+		}
+		off = next + 10 + int(rdLen)
+		if off > len(data) {
+			return nil, errInvalidMessage
+		}
+	}
+	return m, nil
+}
+
+//Rcode return the response code
+func (m *Message) Rcode() int {
+	return int(m.Flags & rcodeMask)
+}
+
+//Truncated check the TC flag
+func (m *Message) Truncated() bool {
+	return m.Flags&flagTC != 0
+}
+
+//IsResponse check the QR flag
+func (m *Message) IsResponse() bool {
+	return m.Flags&flagQR != 0
+}
+
+//Key identify the question for caching
+func (m *Message) Key() string {
+	return utility.Format("%s/%d/%d", m.Name, m.Type, m.Class)
+}
+
+//SetID rewrite the id of a raw message
+func SetID(data []byte, id uint16) {
+	utility.WriteUint16(data, id)
+}
+
+//AgeTTL decrease the ttl of every record of the raw message parsed into m
+func (m *Message) AgeTTL(data []byte, elapsed uint32) {
+	for i, off := range m.ttlOffsets {
+		ttl := uint32(0)
+		if m.ttls[i] > elapsed {
+			ttl = m.ttls[i] - elapsed
+		}
+		utility.WriteUint32(data[off:], ttl)
+	}
+}
+
+//Truncate keep the header and the question of a response and set the TC flag,
+//so the client retries over tcp
+func (m *Message) Truncate(data []byte) []byte {
+	end, questions := m.questionEnd, uint16(1)
+	if end == 0 {
+		end, questions = headerLen, 0
+	}
+	out := make([]byte, end)
+	copy(out, data)
+	utility.WriteUint16(out[2:], m.Flags|flagTC)
+	utility.WriteUint16(out[4:], questions)
+	for i := 6; i < headerLen; i++ {
+		out[i] = 0
+	}
+	return out
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+)
+
+//response an answer to Example.COM A with two records, the second name
+//compressed, and an EDNS OPT record
+func response() []byte {
+	msg := []byte{
+		0x12, 0x34, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 1,
+		7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'C', 'O', 'M', 0, 0, 1, 0, 1,
+	}
+	msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 1, 44, 0, 4, 1, 2, 3, 4)
+	msg = append(msg, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 5, 6, 7, 8)
+	msg = append(msg, 0, 0, 41, 4, 208, 0, 0, 0, 0, 0, 0)
+	return msg
+}
+
+func TestParse(t *testing.T) {
+	data := response()
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 0x1234 || !m.IsResponse() || m.Truncated() || m.Rcode() != RcodeSuccess {
+		t.Fatalf("header %+v", m)
+	}
+	if m.Key() != "example.com/1/1" || m.Records != 2 || m.MinTTL != 60 || m.UDPSize != 1232 {
+		t.Fatalf("message %+v", m)
+	}
+	m.AgeTTL(data, 100)
+	aged, err := Parse(data)
+	if err != nil || aged.ttls[0] != 200 || aged.ttls[1] != 0 {
+		t.Fatalf("aged ttls %v err:%v", aged.ttls, err)
+	}
+	truncated, err := Parse(m.Truncate(data))
+	if err != nil || !truncated.Truncated() || truncated.Records != 0 || truncated.Name != "example.com" {
+		t.Fatalf("truncated %+v err:%v", truncated, err)
+	}
+	SetID(data, 7)
+	if m, _ := Parse(data); m.ID != 7 {
+		t.Fatalf("id %d", m.ID)
+	}
+}
+
+func TestParseTruncated(t *testing.T) {
+	data := response()
+	for n := 0; n < len(data); n++ {
+		if _, err := Parse(data[:n]); err == nil {
+			t.Errorf("%d of %d bytes parsed", n, len(data))
+		}
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	header := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	question := func(name ...byte) []byte {
+		return append(append(append([]byte{}, header...), name...), 0, 1, 0, 1)
+	}
+	answer := func(rr ...byte) []byte {
+		msg := question(1, 'a', 0)
+		msg[7] = 1
+		return append(msg, rr...)
+	}
+	twoQuestions := question(1, 'a', 0)
+	twoQuestions[5] = 2
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"pointer loop", question(0xc0, 12)},
+		{"pointer chain", question(0xc0, 14, 0xc0, 12)},
+		{"pointer out", question(0xc0, 200)},
+		{"half pointer", append(append([]byte{}, header...), 0xc0)},
+		{"label overflow", question(63, 'a', 0)},
+		{"name without end", append(append([]byte{}, header...), 1, 'a')},
+		{"rdata overflow", answer(0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 1, 0, 5, 1, 2, 3, 4)},
+		{"record header", answer(0xc0, 12, 0, 1, 0, 1, 0, 0)},
+		{"more questions", twoQuestions},
+	}
+	for _, c := range cases {
+		if m, err := Parse(c.data); err == nil {
+			t.Errorf("%s: parsed %+v", c.name, m)
+		}
+	}
+	if _, err := Parse(answer(0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 1, 0, 4, 1, 2, 3, 4)); err != nil {
+		t.Fatalf("valid answer: %v", err)
+	}
+}
+
+func TestTruncateWithoutQuestion(t *testing.T) {
+	data := []byte{0, 9, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0}
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := m.Truncate(data)
+	if len(out) != headerLen || !bytes.Equal(out[:2], data[:2]) || out[2]&0x02 == 0 {
+		t.Fatalf("truncated %v", out)
+	}
+}
@@ -0,0 +1,198 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	//maxV1Len the longest line of the version 1, with the CRLF
+	maxV1Len = 107
+	v2Header = 16
+	v2Local  = 0x20
+	v2Proxy  = 0x21
+	v2TCP4   = 0x11
+	v2TCP6   = 0x21
+	v2Unspec = 0x00
+)
+
+var (
+	sigV1 = []byte("PROXY ")
+	sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+var ErrInvalid = errors.New("invalid proxy protocol header")
+
+//Header the addresses of a connection relayed by a proxy: Source the client and
+//Dest the address the client connected. Both are nil when the proxy doesn't tell
+//them, for its own health checks or a protocol other than tcp
+type Header struct {
+	Source *net.TCPAddr
+	Dest   *net.TCPAddr
+}
+
+//Read the header, version 1 or 2, at the start of r. A stream starting with
+//anything else returns a nil header with the bytes read to find out, at most
+//the length of a signature. r is read byte by byte until the end of the header
+//so nothing after it is consumed
+func Read(r io.Reader) (*Header, []byte, error) {
+	buf := make([]byte, 0, len(sigV2))
+	one := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, one); err != nil {
+			return nil, buf, err
+		}
+		buf = append(buf, one[0])
+		v1 := bytes.HasPrefix(sigV1, buf)
+		v2 := bytes.HasPrefix(sigV2, buf)
+		switch {
+		case v1 && len(buf) == len(sigV1):
+			h, err := readV1(r)
+			return h, nil, err
+		case v2 && len(buf) == len(sigV2):
+			h, err := readV2(r)
+			return h, nil, err
+		case !v1 && !v2:
+			return nil, buf, nil
+		}
+	}
+}
+
+//readV1 parse the rest of the line after the signature
+func readV1(r io.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1Len)
+	one := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(sigV1)+len(line) >= maxV1Len {
+			return nil, ErrInvalid
+		}
+		if _, err := io.ReadFull(r, one); err != nil {
+			return nil, err
+		}
+		line = append(line, one[0])
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] == "UNKNOWN" {
+		return &Header{}, nil
+	}
+	if len(fields) != 5 || fields[0] != "TCP4" && fields[0] != "TCP6" {
+		return nil, ErrInvalid
+	}
+	v4 := fields[0] == "TCP4"
+	src, err := parseAddr(fields[1], fields[3], v4)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseAddr(fields[2], fields[4], v4)
+	if err != nil {
+		return nil, err
+	}
+	return &Header{Source: src, Dest: dst}, nil
+}
+
+func parseAddr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") == v4 {
+		return nil, ErrInvalid
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 || strconv.Itoa(p) != port {
+		return nil, ErrInvalid
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+//readV2 parse the binary header after the signature, the TLVs are skipped
+func readV2(r io.Reader) (*Header, error) {
+	head := make([]byte, v2Header-len(sigV2))
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, ErrInvalid
+	}
+	data := make([]byte, binary.BigEndian.Uint16(head[2:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	switch head[0] {
+	case v2Local:
+		return &Header{}, nil
+	case v2Proxy:
+	default:
+		return nil, ErrInvalid
+	}
+	size := 0
+	switch head[1] {
+	case v2TCP4:
+		size = net.IPv4len
+	case v2TCP6:
+		size = net.IPv6len
+	default:
+		return &Header{}, nil
+	}
+	if len(data) < 2*size+4 {
+		return nil, ErrInvalid
+	}
+	h := &Header{
+		Source: &net.TCPAddr{IP: net.IP(data[:size]), Port: int(binary.BigEndian.Uint16(data[2*size:]))},
+		Dest:   &net.TCPAddr{IP: net.IP(data[size : 2*size]), Port: int(binary.BigEndian.Uint16(data[2*size+2:]))},
+	}
+	return h, nil
+}
+
+//Format encode the header in version 1 or 2. Without both addresses it tells
+//the receiver to use the ones of the connection. An ipv4 address is mapped to
+//ipv6 when the other one is ipv6
+func (h *Header) Format(version int) []byte {
+	src, dst, v4 := h.addrs()
+	if version == 1 {
+		if src == nil {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		line := "PROXY " + family + " " + formatIP(src.IP, v4) + " " + formatIP(dst.IP, v4) + " " +
+			strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n"
+		return []byte(line)
+	}
+	out := append([]byte{}, sigV2...)
+	if src == nil {
+		return append(out, v2Proxy, v2Unspec, 0, 0)
+	}
+	family, size := byte(v2TCP6), net.IPv6len
+	if v4 {
+		family, size = v2TCP4, net.IPv4len
+	}
+	out = append(out, v2Proxy, family, 0, byte(2*size+4))
+	out = append(out, src.IP...)
+	out = append(out, dst.IP...)
+	return append(out, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+}
+
+//formatIP write an ipv4 mapped to ipv6 in the ipv6 notation
+func formatIP(ip net.IP, v4 bool) string {
+	if ip4 := ip.To4(); ip4 != nil && !v4 {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+//addrs the addresses in the same family, nil unless both are known
+func (h *Header) addrs() (*net.TCPAddr, *net.TCPAddr, bool) {
+	if h.Source == nil || h.Dest == nil || h.Source.IP == nil || h.Dest.IP == nil {
+		return nil, nil, false
+	}
+	src4, dst4 := h.Source.IP.To4(), h.Dest.IP.To4()
+	if src4 != nil && dst4 != nil {
+		return &net.TCPAddr{IP: src4, Port: h.Source.Port}, &net.TCPAddr{IP: dst4, Port: h.Dest.Port}, true
+	}
+	return &net.TCPAddr{IP: h.Source.IP.To16(), Port: h.Source.Port}, &net.TCPAddr{IP: h.Dest.IP.To16(), Port: h.Dest.Port}, false
+}
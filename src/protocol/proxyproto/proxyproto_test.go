@@ -0,0 +1,141 @@
+package proxyproto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func addr(s string) *net.TCPAddr {
+	a, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+//v2 a version 2 header with the command, the family and the address block
+func v2(command, family byte, data ...byte) []byte {
+	out := append([]byte{}, sigV2...)
+	out = append(out, command, family, byte(len(data)>>8), byte(len(data)))
+	return append(out, data...)
+}
+
+func TestRead(t *testing.T) {
+	tcp4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x10, 0x92, 0x04, 0x38}
+	cases := []struct {
+		name    string
+		data    []byte
+		src     string //empty for a header without addresses
+		dst     string
+		pending string //the bytes read from a stream without header
+		err     bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 1080\r\n"), "203.0.113.7:4242", "10.0.0.1:1080", "", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 65535 0\r\n"), "[2001:db8::1]:65535", "10.0.0.1:0", "", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN ffff::1 ::1 1 2\r\n"), "", "", "", false},
+		{"v1 longest", []byte("PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"), "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", "", false},
+		{"v1 overflow", []byte("PROXY UNKNOWN " + strings.Repeat("a", 100) + "\r\n"), "", "", "", true},
+		{"v1 without crlf", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n" + strings.Repeat("a", 100)), "", "", "", true},
+		{"v1 family", []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n"), "", "", "", true},
+		{"v1 tcp6 with ipv4", []byte("PROXY TCP6 10.0.0.2 10.0.0.1 1 2\r\n"), "", "", "", true},
+		{"v1 udp", []byte("PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n"), "", "", "", true},
+		{"v1 fields", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n"), "", "", "", true},
+		{"v1 double space", []byte("PROXY TCP4 1.2.3.4  5.6.7.8 1 2\r\n"), "", "", "", true},
+		{"v1 port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 65536 2\r\n"), "", "", "", true},
+		{"v1 port sign", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 +1 2\r\n"), "", "", "", true},
+		{"v1 port zeros", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 01 2\r\n"), "", "", "", true},
+		{"v2 tcp4", v2(v2Proxy, v2TCP4, tcp4...), "203.0.113.7:4242", "10.0.0.1:1080", "", false},
+		{"v2 tcp4 with tlvs", v2(v2Proxy, v2TCP4, append(tcp4, 4, 0, 1, 0)...), "203.0.113.7:4242", "10.0.0.1:1080", "", false},
+		{"v2 tcp6", v2(v2Proxy, v2TCP6, append(net.ParseIP("2001:db8::1"), append(net.ParseIP("2001:db8::2"), 0, 1, 0, 2)...)...), "[2001:db8::1]:1", "[2001:db8::2]:2", "", false},
+		{"v2 local", v2(v2Local, v2TCP4, tcp4...), "", "", "", false},
+		{"v2 local empty", v2(v2Local, v2Unspec), "", "", "", false},
+		{"v2 unspec", v2(v2Proxy, v2Unspec), "", "", "", false},
+		{"v2 udp", v2(v2Proxy, 0x12, tcp4...), "", "", "", false},
+		{"v2 version", v2(0x11, v2TCP4, tcp4...), "", "", "", true},
+		{"v2 command", v2(0x22, v2TCP4, tcp4...), "", "", "", true},
+		{"v2 short tcp4", v2(v2Proxy, v2TCP4, tcp4[:11]...), "", "", "", true},
+		{"v2 short tcp6", v2(v2Proxy, v2TCP6, tcp4...), "", "", "", true},
+		{"v2 length", v2(v2Proxy, v2TCP4, tcp4...)[:len(sigV2)+4+4], "", "", "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\n"), "", "", "G", false},
+		{"v1 prefix", []byte("PROXIED"), "", "", "PROXI", false},
+		{"v2 prefix", []byte("\r\n\r\nGET"), "", "", "\r\n\r\nG", false},
+		{"empty", nil, "", "", "", true},
+	}
+	for _, c := range cases {
+		rest := []byte("after the header")
+		r := bytes.NewReader(append(append([]byte{}, c.data...), rest...))
+		if c.err {
+			r = bytes.NewReader(c.data)
+		}
+		h, pending, err := Read(r)
+		if (err != nil) != c.err {
+			t.Errorf("%s: err:%v", c.name, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if string(pending) != c.pending || c.pending != "" && h != nil {
+			t.Errorf("%s: header %+v pending %q", c.name, h, pending)
+			continue
+		}
+		if c.pending != "" {
+			continue
+		}
+		var src, dst string
+		if h.Source != nil {
+			src, dst = h.Source.String(), h.Dest.String()
+		}
+		if src != c.src || dst != c.dst {
+			t.Errorf("%s: source %q dest %q", c.name, src, dst)
+		}
+		if left, _ := io.ReadAll(r); !bytes.Equal(left, rest) {
+			t.Errorf("%s: %q left after the header", c.name, left)
+		}
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	h := &Header{Source: addr("203.0.113.7:4242"), Dest: addr("[2001:db8::1]:1080")}
+	for _, version := range []int{1, 2} {
+		data := h.Format(version)
+		for n := 0; n < len(data); n++ {
+			if h, _, err := Read(bytes.NewReader(data[:n])); err == nil {
+				t.Errorf("v%d: %d of %d bytes read as %+v", version, n, len(data), h)
+			}
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		name     string
+		h        *Header
+		src, dst string
+	}{
+		{"ipv4", &Header{Source: addr("203.0.113.7:4242"), Dest: addr("10.0.0.1:1080")}, "203.0.113.7:4242", "10.0.0.1:1080"},
+		{"ipv6", &Header{Source: addr("[2001:db8::1]:1"), Dest: addr("[2001:db8::2]:65535")}, "[2001:db8::1]:1", "[2001:db8::2]:65535"},
+		{"mixed", &Header{Source: addr("203.0.113.7:4242"), Dest: addr("[2001:db8::2]:443")}, "203.0.113.7:4242", "[2001:db8::2]:443"},
+		{"no dest", &Header{Source: addr("203.0.113.7:4242")}, "", ""},
+		{"empty", &Header{}, "", ""},
+	}
+	for _, c := range cases {
+		for _, version := range []int{1, 2} {
+			h, pending, err := Read(bytes.NewReader(c.h.Format(version)))
+			if err != nil || h == nil || pending != nil {
+				t.Errorf("%s v%d: header %+v err:%v", c.name, version, h, err)
+				continue
+			}
+			var src, dst string
+			if h.Source != nil {
+				src, dst = h.Source.String(), h.Dest.String()
+			}
+			if src != c.src || dst != c.dst {
+				t.Errorf("%s v%d: source %q dest %q", c.name, version, src, dst)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sniff
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+//MaxSize the most bytes worth reading to find the domain, a full tls record
+const MaxSize = 5 + 16384
+
+const (
+	tlsHandshake     = 0x16
+	tlsClientHello   = 1
+	tlsServerNameExt = 0
+	tlsHostName      = 0
+)
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE", "CONNECT"}
+
+//Domain find the domain the client is talking to in the first bytes of its
+//stream: the server name of a tls ClientHello or the Host of an http request.
+//done is false while more data is needed, the domain is empty when the stream
+//is neither or carries none
+func Domain(data []byte) (domain string, done bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+	if data[0] == tlsHandshake {
+		return serverName(data)
+	}
+	return httpHost(data)
+}
+
+//serverName parse the server name extension of a ClientHello in the first record
+func serverName(data []byte) (string, bool) {
+	if len(data) < 5 {
+		return "", false
+	}
+	if data[1] != 3 {
+		return "", true
+	}
+	size := int(data[3])<<8 | int(data[4])
+	if len(data) < 5+size {
+		return "", len(data) >= MaxSize
+	}
+	msg := data[5 : 5+size]
+	if len(msg) < 4 || msg[0] != tlsClientHello {
+		return "", true
+	}
+	msgLen := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+	if len(msg) < 4+msgLen {
+		//the hello goes on in the next record, the extensions are at its end
+		return "", true
+	}
+	r := reader(msg[4 : 4+msgLen])
+	if !r.skip(2+32) || !r.skipVector(1) || !r.skipVector(2) || !r.skipVector(1) {
+		return "", true
+	}
+	exts, ok := r.vector(2)
+	for ok && len(exts) >= 4 {
+		typ := int(exts[0])<<8 | int(exts[1])
+		var ext reader
+		if ext, ok = exts[2:].vector(2); !ok {
+			break
+		}
+		exts = exts[4+len(ext):]
+		if typ != tlsServerNameExt {
+			continue
+		}
+		list, ok := ext.vector(2)
+		for ok && len(list) >= 3 {
+			nameType := list[0]
+			var name reader
+			if name, ok = list[1:].vector(2); !ok {
+				break
+			}
+			list = list[3+len(name):]
+			if nameType == tlsHostName {
+				return strings.ToLower(string(name)), true
+			}
+		}
+		break
+	}
+	return "", true
+}
+
+//reader read the length prefixed vectors of a tls message
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+//vector return the vector whose length takes size bytes, it's not consumed
+func (r reader) vector(size int) (reader, bool) {
+	if len(r) < size {
+		return nil, false
+	}
+	n := 0
+	for _, b := range r[:size] {
+		n = n<<8 | int(b)
+	}
+	if len(r) < size+n {
+		return nil, false
+	}
+	return r[size : size+n], true
+}
+
+func (r *reader) skipVector(size int) bool {
+	v, ok := r.vector(size)
+	return ok && r.skip(size+len(v))
+}
+
+//httpHost find the Host header of an http request
+func httpHost(data []byte) (string, bool) {
+	sp := bytes.IndexByte(data, ' ')
+	if sp < 0 {
+		return "", len(data) > len("OPTIONS")
+	}
+	method := string(data[:sp])
+	known := false
+	for _, m := range httpMethods {
+		known = known || m == method
+	}
+	if !known {
+		return "", true
+	}
+	lines := data
+	for {
+		end := bytes.Index(lines, []byte("\r\n"))
+		if end < 0 {
+			return "", len(data) >= MaxSize
+		}
+		line := lines[:end]
+		lines = lines[end+2:]
+		if len(line) == 0 {
+			return "", true
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 || !strings.EqualFold(string(line[:colon]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if net.ParseIP(host) != nil {
+			return "", true
+		}
+		return strings.ToLower(host), true
+	}
+}
@@ -0,0 +1,125 @@
+package sniff
+
+import (
+	"bytes"
+	"testing"
+)
+
+//vec prefix data with its length on size bytes
+func vec(size int, data ...byte) []byte {
+	out := make([]byte, size, size+len(data))
+	for i, n := size-1, len(data); i >= 0; i, n = i-1, n>>8 {
+		out[i] = byte(n)
+	}
+	return append(out, data...)
+}
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+//sni the server name extension with the names of the given types
+func sni(names ...[]byte) []byte {
+	return cat([]byte{0, tlsServerNameExt}, vec(2, vec(2, cat(names...)...)...))
+}
+
+func hostName(nameType byte, name string) []byte {
+	return append([]byte{nameType}, vec(2, []byte(name)...)...)
+}
+
+//hello a ClientHello message with the extensions
+func hello(exts ...byte) []byte {
+	body := cat([]byte{3, 3}, make([]byte, 32), vec(1), vec(2, 0x13, 0x01), vec(1, 0), vec(2, exts...))
+	return append([]byte{tlsClientHello}, vec(3, body...)...)
+}
+
+//record put msg in tls handshake records of at most size bytes
+func record(size int, msg []byte) []byte {
+	var out []byte
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > size {
+			n = size
+		}
+		out = append(out, tlsHandshake, 3, 1)
+		out = append(out, vec(2, msg[:n]...)...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+func TestServerName(t *testing.T) {
+	full := record(MaxSize, hello(sni(hostName(tlsHostName, "Example.COM"))...))
+	for n := 0; n < len(full); n++ {
+		if domain, done := Domain(full[:n]); done || domain != "" {
+			t.Fatalf("%d of %d bytes: %q done:%v", n, len(full), domain, done)
+		}
+	}
+	other := []byte{0, 10, 0, 2, 0, 0x1d}
+	badList := cat([]byte{0, tlsServerNameExt}, vec(2, 0, 9, tlsHostName, 0, 3, 'a'))
+	badName := sni([]byte{tlsHostName, 0, 200, 'a'})
+	badExt := []byte{0, tlsServerNameExt, 0, 200, 0}
+	notHello := hello(sni(hostName(tlsHostName, "a.com"))...)
+	notHello[0] = 2
+	huge := append([]byte{tlsHandshake, 3, 1, 0xff, 0xff}, make([]byte, MaxSize-5)...)
+	cases := []struct {
+		name   string
+		data   []byte
+		domain string
+		done   bool
+	}{
+		{"full", full, "example.com", true},
+		{"after another extension", record(MaxSize, hello(cat(other, sni(hostName(tlsHostName, "a.com")))...)), "a.com", true},
+		{"other name type first", record(MaxSize, hello(sni(hostName(1, "x"), hostName(tlsHostName, "b.com"))...)), "b.com", true},
+		{"only other name types", record(MaxSize, hello(sni(hostName(1, "x"))...)), "", true},
+		{"without server name", record(MaxSize, hello(other...)), "", true},
+		{"without extensions", record(MaxSize, hello()), "", true},
+		{"split records", record(40, hello(sni(hostName(tlsHostName, "a.com"))...)), "", true},
+		{"not a hello", record(MaxSize, notHello), "", true},
+		{"ssl2", []byte{tlsHandshake, 2, 0, 0, 4, 1, 0, 0, 0}, "", true},
+		{"empty record", []byte{tlsHandshake, 3, 1, 0, 0}, "", true},
+		{"short hello", record(MaxSize, append([]byte{tlsClientHello}, vec(3, make([]byte, 16)...)...)), "", true},
+		{"extension overflow", record(MaxSize, hello(badExt...)), "", true},
+		{"name list overflow", record(MaxSize, hello(badList...)), "", true},
+		{"name overflow", record(MaxSize, hello(badName...)), "", true},
+		{"record over the max size", huge, "", true},
+	}
+	for _, c := range cases {
+		domain, done := Domain(c.data)
+		if domain != c.domain || done != c.done {
+			t.Errorf("%s: %q done:%v, %q done:%v expected", c.name, domain, done, c.domain, c.done)
+		}
+	}
+}
+
+func TestHTTPHost(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   string
+		domain string
+		done   bool
+	}{
+		{"host", "GET / HTTP/1.1\r\nHost: Example.com\r\n\r\n", "example.com", true},
+		{"port", "POST /x HTTP/1.1\r\nUser-Agent: a:b\r\nhost:example.com:8080 \r\n\r\n", "example.com", true},
+		{"no blank line yet", "GET / HTTP/1.1\r\nHost: example.com\r\n", "example.com", true},
+		{"ipv4", "GET / HTTP/1.1\r\nHost: 10.0.0.1:80\r\n\r\n", "", true},
+		{"ipv6", "GET / HTTP/1.1\r\nHost: [2001:db8::1]:80\r\n\r\n", "", true},
+		{"without host", "GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: late.com\r\n", "", true},
+		{"unknown method", "FETCH / HTTP/1.1\r\nHost: example.com\r\n\r\n", "", true},
+		{"not http", "SSH-2.0-OpenSSH_9.6\r\n", "", true},
+		{"empty", "", "", false},
+		{"short method", "GE", "", false},
+		{"truncated line", "GET / HTTP/1.1\r\nHo", "", false},
+		{"truncated host", "GET / HTTP/1.1\r\nHost: exa", "", false},
+	}
+	for _, c := range cases {
+		domain, done := Domain([]byte(c.data))
+		if domain != c.domain || done != c.done {
+			t.Errorf("%s: %q done:%v, %q done:%v expected", c.name, domain, done, c.domain, c.done)
+		}
+	}
+	long := append([]byte("GET / HTTP/1.1\r\nX: "), bytes.Repeat([]byte("a"), MaxSize)...)
+	if domain, done := Domain(long); domain != "" || !done {
+		t.Fatalf("header without end: %q done:%v", domain, done)
+	}
+}
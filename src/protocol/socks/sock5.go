@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net"
 	//"netcore"
+	"strconv"
 	"sync/atomic"
 	//"time"
 )
@@ -35,6 +36,14 @@ const (
 	sockRepHostUnreachable
 	sockRepConnRefused
 )
+
+//the reply codes of a request whose destination can't be connected
+const (
+	RepFailure         = sockRepErr
+	RepNotAllowed      = sockRepNotAllowed
+	RepHostUnreachable = sockRepHostUnreachable
+	RepConnRefused     = sockRepConnRefused
+)
 const (
 	sockAddrV4         = 1
 	sockAddrDomainName = 3
@@ -50,6 +59,13 @@ const (
 	StateMethodNegotiation = iota
 	StateRequest
 	StateDataForward
+	StateAuth
+)
+
+const (
+	authVersion   = 1
+	authSucceeded = 0
+	authFailed    = 1
 )
 
 const (
@@ -74,6 +90,9 @@ type Sock5 struct {
 	clientMode   bool
 	cipher       *rc4.Cipher
 	destAddrs []*net.TCPAddr
+	destName  string
+	auth      func(user, password string) bool
+	noResolve bool
 	log    		*utility.LogContext
 }
 
@@ -101,6 +120,22 @@ func NewSock5(log *utility.LogContext) *Sock5{
 	}
 }
 
+//SetAuth require the username/password authentication of rfc1929, auth checks
+//the credentials
+func (s *Sock5) SetAuth(auth func(user, password string) bool){
+	s.auth = auth
+}
+
+//AuthRequired tell whether the client must authenticate after the method negotiation
+func (s *Sock5) AuthRequired() bool{
+	return s.auth != nil
+}
+
+//SetNoResolve keep the destination name unresolved, it's dialed somewhere else
+func (s *Sock5) SetNoResolve(){
+	s.noResolve = true
+}
+
 func (s *Sock5)SetState(state int){
 	s.state = state
 }
@@ -110,31 +145,43 @@ func (s *Sock5) GetCurrentState()int{
 func (s *Sock5) GetDestAddr()[]*net.TCPAddr{
 	return s.destAddrs
 }
+
+//GetDestName return the destination as requested by the client, host:port
+func (s *Sock5) GetDestName()string{
+	return s.destName
+}
 func (s *Sock5) MethodNego(data []byte) (int, []byte, error){
+	if len(data) < 2 || len(data) < 2+int(data[1]){
+		return 0, nil, nil
+	}
 	ver := data[0]
 	if ver != sockVersion5 {
 		s.log.LogWarn("invalid sock version:%d", ver)
 		return 0, nil, errors.New("invalid sock version")
 	}
 	nmethod := data[1]
+	want := byte(methodNoAuth)
+	if s.auth != nil{
+		want = methodUserPasswd
+	}
 	
 	find := false
-	for _, method := range data[2:] {
-		if method == methodNoAuth {
+	for _, method := range data[2:2+int(nmethod)] {
+		if method == want {
 			find = true
 			break
 		}
 	}
 	
 	if !find {
-		s.log.LogDebug("does not find no authentication method in method list. method num:%d version:%d",
-			nmethod, ver)
+		s.log.LogDebug("does not find method:%d in method list. method num:%d version:%d",
+			want, nmethod, ver)
 		return 0, nil, errors.New("not supported method")
 	}
 
 	resp := make([]byte, 2)
 	resp[0] = sockVersion5
-	resp[1] = methodNoAuth
+	resp[1] = want
 	/*
 	if s.serverMode {
 		s.cipher.XORKeyStream(resp, resp)
@@ -187,9 +234,93 @@ func resolveIPPort(cmd int, data []byte, log *utility.LogContext) ([]*net.TCPAdd
 	return addrs, size, err
 }
 
+//requestDest return the host:port of a complete request
+func requestDest(data []byte) string{
+	var host string
+	var port []byte
+	switch data[3]{
+	case sockAddrV4:
+		host = net.IP(data[4:8]).String()
+		port = data[8:10]
+	case sockAddrDomainName:
+		size := int(data[4])
+		host = string(data[5 : 5+size])
+		port = data[5+size : 7+size]
+	default:
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+}
+
+//requestComplete check whether data contains the whole request
+func requestComplete(data []byte) bool{
+	if len(data) < 5{
+		return false
+	}
+	switch data[3]{
+	case sockAddrV4:
+		return len(data) >= 4+6
+	case sockAddrDomainName:
+		return len(data) >= 4+1+int(data[4])+2
+	}
+	return true
+}
+
+//SniffDest find the destination in the first bytes sent by a socks5 client, the
+//method negotiation then the request. done is false while more data is needed
+func SniffDest(data []byte) (dest string, done bool){
+	if len(data) < 2 || len(data) < 2+int(data[1]){
+		return "", false
+	}
+	if data[0] != sockVersion5{
+		return "", true
+	}
+	req := data[2+int(data[1]):]
+	if !requestComplete(req){
+		return "", false
+	}
+	if req[0] != sockVersion5{
+		return "", true
+	}
+	return requestDest(req), true
+}
+
+//HandleAuth check the username/password request. A failure is replied, then
+//the error tells to close the connection
+func (s *Sock5) HandleAuth(data []byte) (int, []byte, bool, error){
+	if len(data) < 2 || len(data) < 3+int(data[1]){
+		return 0, nil, false, nil
+	}
+	ulen := int(data[1])
+	plen := int(data[2+ulen])
+	size := 3 + ulen + plen
+	if len(data) < size{
+		return 0, nil, false, nil
+	}
+	if data[0] != authVersion{
+		return 0, nil, false, errors.New("invalid auth version")
+	}
+	user := string(data[2 : 2+ulen])
+	if !s.auth(user, string(data[3+ulen:size])){
+		return size, []byte{authVersion, authFailed}, false, errors.New("auth failed for user:" + user)
+	}
+	return size, []byte{authVersion, authSucceeded}, true, nil
+}
+
+//requestLen return the size of a complete request
+func requestLen(data []byte) int{
+	if data[3] == sockAddrDomainName{
+		return 4 + 1 + int(data[4]) + 2
+	}
+	return 4 + 6
+}
+
 //HandleRequest
 func (s *Sock5) HandleRequest(data []byte) (int, []byte, error){
 	s.log.LogDebug("call handleRequest")
+	if !requestComplete(data){
+		return 0, nil, nil
+	}
 	if data[0] != sockVersion5 || data[2] != sockReserved || (data[3] != sockAddrV4 && data[3] != sockAddrDomainName) {
 		s.log.LogWarn("invalid version:%d cmd:%d r:%d addr:%d", data[0], data[1], data[2], data[3])
 		return 0, nil, errors.New("")
@@ -200,12 +331,27 @@ func (s *Sock5) HandleRequest(data []byte) (int, []byte, error){
 		return 0, nil, errors.New("")
 	}
 
+	s.destName = requestDest(data)
+	if s.noResolve{
+		return requestLen(data), requestReply(data), nil
+	}
 	addrs, size, err := resolveIPPort(int(data[3]), data[4:], s.log)
 	if err != nil {
 		s.log.LogWarn("%s", err.Error())
 		return 0, nil, err 
 	}
 	s.destAddrs = addrs
+	return 4 + size, requestReply(data), nil
+}
+
+//FailureReply the reply of a request failed with rep, the session is closed
+//after it
+func FailureReply(rep byte) []byte{
+	return []byte{sockVersion5, rep, 0, sockAddrV4, 0, 0, 0, 0, 0, 0}
+}
+
+//requestReply the success reply of a request
+func requestReply(data []byte) []byte{
 	resp := make([]byte, 10)
 	resp[0] = sockVersion5
 	resp[1] = sockRepOK
@@ -214,7 +360,7 @@ func (s *Sock5) HandleRequest(data []byte) (int, []byte, error){
 	for i := 4; i < 10; i++ {
 		resp[i] = data[i]
 	}
-	return 4 + size, resp, nil
+	return resp
 }
 
 
@@ -0,0 +1,105 @@
+package tunnel
+
+import (
+	"net"
+)
+
+//Conn carry the plain data of a stream over the frames of a tunnel connection.
+//Read and Write can be used by two goroutines, like the connection under it
+type Conn struct {
+	net.Conn
+	codec *Codec
+	buf   []byte //the received bytes, buf[start:end] are not decoded yet
+	start int
+	end   int
+	plain []byte //the payload of the last frame not read yet
+}
+
+//NewConn wrap a connection whose frames are coded by codec
+func NewConn(conn net.Conn, codec *Codec) *Conn {
+	return &Conn{Conn: conn, codec: codec, buf: make([]byte, maxFrameLen)}
+}
+
+//NewBufferedConn wrap a connection whose frames in buffered were received
+//before it's read
+func NewBufferedConn(conn net.Conn, codec *Codec, buffered []byte) *Conn {
+	c := NewConn(conn, codec)
+	if len(buffered) > len(c.buf) {
+		c.buf = make([]byte, len(buffered)+maxFrameLen)
+	}
+	c.end = copy(c.buf, buffered)
+	return c
+}
+
+//ReadFrame return the payload of the next frame, it's valid until the next read.
+//The data of a frame received partly before an error is kept for the next call
+func (c *Conn) ReadFrame() ([]byte, error) {
+	for {
+		size, payload, err := c.codec.Decode(c.buf[c.start:c.end])
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 {
+			c.start += size
+			return payload, nil
+		}
+		if c.start > 0 {
+			c.end = copy(c.buf, c.buf[c.start:c.end])
+			c.start = 0
+		}
+		n, err := c.Conn.Read(c.buf[c.end:])
+		c.end += n
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+//ReadStatus read the status frame which answers a handshake, the data after
+//the status is returned by Read
+func (c *Conn) ReadStatus() (byte, error) {
+	payload, err := c.ReadFrame()
+	if err != nil {
+		return 0, err
+	}
+	if len(payload) == 0 {
+		return StatusBadRequest, nil
+	}
+	c.plain = payload[1:]
+	return payload[0], nil
+}
+
+//Read read the payload of the frames
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		payload, err := c.ReadFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.plain = payload
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+//Write encode p into frames
+func (c *Conn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(c.codec.Encode(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//CloseWrite shut down the sending side of the connection
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+//NetConn return the connection carrying the frames
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
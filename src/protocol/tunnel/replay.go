@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+	"utility"
+)
+
+//ReplayFilter remember the hellos a server accepted. A hello is refused when
+//it was seen before or when its time is out of MaxClockSkew, so the ones older
+//than twice the skew can be forgotten
+type ReplayFilter struct {
+	mu     sync.Mutex
+	seen   map[string]int64 //the unix time of each hello
+	pruned int64
+}
+
+func NewReplayFilter() *ReplayFilter {
+	return &ReplayFilter{seen: make(map[string]int64)}
+}
+
+//add record hello, false when it's already there
+func (f *ReplayFilter) add(hello []byte) bool {
+	_, sent := utility.ReadUint64(hello)
+	key := string(hello)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.seen[key]; ok {
+		return false
+	}
+	f.seen[key] = int64(sent)
+	t := now().Unix()
+	keep := int64(2 * MaxClockSkew / time.Second)
+	if t-f.pruned > keep {
+		for k, sent := range f.seen {
+			if t-sent > keep {
+				delete(f.seen, k)
+			}
+		}
+		f.pruned = t
+	}
+	return true
+}
@@ -0,0 +1,303 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"time"
+	"utility"
+)
+
+//Version is the first byte of a tunnel handshake, the first frame of every
+//tunnel connection
+const Version = 1
+
+const (
+	CmdNone = iota
+	//CmdSocks the rest of the stream is a socks5 conversation
+	CmdSocks
+	//CmdBind ask the server to listen on the port in Arg for a reverse tunnel
+	CmdBind
+	//CmdAccept attach the stream to the pending reverse connection whose id is in Arg
+	CmdAccept
+	//CmdConnect connect the host:port in Arg, the rest of the stream is forwarded to it
+	CmdConnect
+	//CmdTest run a speed test the server answers itself, Arg is ping, upload or download:<bytes>
+	CmdTest
+)
+
+const (
+	StatusOK = iota
+	StatusBadRequest
+	StatusAuthFailed
+	StatusNotAllowed
+	StatusFailed
+	StatusBusy
+	//StatusRefused and StatusUnreachable tell why the destination of a connect
+	//failed, a client not knowing them takes them as another failure
+	StatusRefused
+	StatusUnreachable
+)
+
+const (
+	frameHeaderLen = 4
+	//MaxPayload the max payload size of one encoded frame, larger data is split
+	MaxPayload = 16384
+	//maxFrameLen a frame must fit in the receive buffer of netcore.Connection
+	maxFrameLen = 16384 * 2
+	//helloLen the unix time and the nonce the client sends first
+	helloLen = 8 + 16
+)
+
+//MaxClockSkew how far the time in the hello of a client may be from the time of
+//the server, the hellos are remembered twice as long to refuse the replays
+const MaxClockSkew = 2 * time.Minute
+
+const (
+	labelClient = "opensock client"
+	labelServer = "opensock server"
+)
+
+//now is replaced by the tests
+var now = time.Now
+
+var (
+	errInvalidFrame     = errors.New("invalid tunnel frame")
+	errInvalidHandshake = errors.New("invalid tunnel handshake")
+	errInvalidKey       = errors.New("the key must have 1 to 256 bytes")
+	//ErrClockSkew the time in the hello of the client is too far from the server
+	ErrClockSkew = errors.New("tunnel hello out of the clock skew")
+	//ErrReplay the hello of the client was already used by another connection
+	ErrReplay = errors.New("replayed tunnel hello")
+)
+
+var statusTable = []string{"ok", "bad request", "auth failed", "not allowed", "failed", "too many sessions", "connection refused", "host unreachable"}
+
+//StatusText return a readable description of the status
+func StatusText(status byte) string {
+	if int(status) < len(statusTable) {
+		return statusTable[status]
+	}
+	return "unknown"
+}
+
+//Handshake is the first frame sent by the client on every tunnel connection.
+//Trace is the id of the session in the logs of the client, it's optional
+type Handshake struct {
+	Cmd      byte
+	User     string
+	Password string
+	Arg      string
+	Trace    string
+}
+
+//Marshal encode the handshake: VER CMD then user, password, arg and trace, each
+//prefixed by a 2 bytes length. A server ignoring the trace reads the rest alike
+func (h *Handshake) Marshal() []byte {
+	fields := []string{h.User, h.Password, h.Arg, h.Trace}
+	size := 2
+	for _, f := range fields {
+		size += 2 + len(f)
+	}
+	data := make([]byte, size)
+	data[0] = Version
+	data[1] = h.Cmd
+	left := data[2:]
+	for _, f := range fields {
+		left = utility.WriteUint16(left, uint16(len(f)))
+		left = left[copy(left, f):]
+	}
+	return data
+}
+
+//ParseHandshake decode a handshake from a frame payload
+func ParseHandshake(data []byte) (*Handshake, error) {
+	if len(data) < 2 || data[0] != Version {
+		return nil, errInvalidHandshake
+	}
+	h := &Handshake{Cmd: data[1]}
+	fields := []*string{&h.User, &h.Password, &h.Arg, &h.Trace}
+	left := data[2:]
+	for i, f := range fields {
+		if i == len(fields)-1 && len(left) == 0 {
+			//sent by a client without trace
+			break
+		}
+		if len(left) < 2 {
+			return nil, errInvalidHandshake
+		}
+		var size uint16
+		left, size = utility.ReadUint16(left)
+		if len(left) < int(size) {
+			return nil, errInvalidHandshake
+		}
+		*f = string(left[:size])
+		left = left[size:]
+	}
+	return h, nil
+}
+
+//Codec frames, encrypts and authenticates the two directions of a tunnel
+//connection. The client starts the stream with a hello in clear: the unix time
+//and a random nonce. Each direction has its own AES-GCM key derived from the
+//shared key and the hello, so every connection has fresh keys. A frame is a 4
+//bytes big endian length followed by the sealed payload, the nonce of a frame is
+//its sequence number in its direction and the length is authenticated with it
+type Codec struct {
+	enc     cipher.AEAD
+	dec     cipher.AEAD
+	encSeq  uint64
+	decSeq  uint64
+	key     []byte
+	hello   []byte        //the hello of the client, until the server decoded the first frame
+	filter  *ReplayFilter //the hellos the server already accepted
+	pending bool          //the hello is still at the start of the data to decode
+}
+
+//NewClientCodec create the codec of a client, hello is sent before the first frame.
+//Both sides of the tunnel must use the same key
+func NewClientCodec(key string) (*Codec, []byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	hello := make([]byte, helloLen)
+	utility.WriteUint64(hello, uint64(now().Unix()))
+	if _, err := rand.Read(hello[8:]); err != nil {
+		return nil, nil, err
+	}
+	c := &Codec{key: []byte(key)}
+	if err := c.derive(hello, labelClient, labelServer); err != nil {
+		return nil, nil, err
+	}
+	return c, hello, nil
+}
+
+//NewServerCodec create the codec of a server, the keys are derived from the hello
+//of the client. filter refuses the hellos seen before, it's shared by the
+//connections of a server
+func NewServerCodec(key string, filter *ReplayFilter) (*Codec, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return &Codec{key: []byte(key), filter: filter}, nil
+}
+
+func checkKey(key string) error {
+	if len(key) == 0 || len(key) > 256 {
+		return errInvalidKey
+	}
+	return nil
+}
+
+//derive the keys of the connection of hello, enc and dec are the labels of the
+//directions sent and received
+func (c *Codec) derive(hello []byte, enc, dec string) error {
+	var err error
+	if c.enc, err = deriveAEAD(c.key, enc, hello); err != nil {
+		return err
+	}
+	c.dec, err = deriveAEAD(c.key, dec, hello)
+	return err
+}
+
+func deriveAEAD(key []byte, label string, hello []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(hello)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//acceptHello check the time of the hello of a client and derive the keys. The
+//nonce is recorded by the filter once the first frame proves the client has the key
+func (c *Codec) acceptHello(hello []byte) error {
+	_, sent := utility.ReadUint64(hello)
+	skew := now().Unix() - int64(sent)
+	if skew > int64(MaxClockSkew/time.Second) || skew < -int64(MaxClockSkew/time.Second) {
+		return ErrClockSkew
+	}
+	c.hello = append([]byte{}, hello...)
+	c.pending = true
+	return c.derive(hello, labelServer, labelClient)
+}
+
+func frameNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	utility.WriteUint64(nonce, seq)
+	return nonce
+}
+
+//Encode encrypt data into one or more frames
+func (c *Codec) Encode(data []byte) []byte {
+	frames := (len(data) + MaxPayload - 1) / MaxPayload
+	if frames == 0 {
+		frames = 1
+	}
+	overhead := c.enc.Overhead()
+	dst := make([]byte, 0, len(data)+frames*(frameHeaderLen+overhead))
+	for {
+		size := len(data)
+		if size > MaxPayload {
+			size = MaxPayload
+		}
+		header := dst[len(dst) : len(dst)+frameHeaderLen]
+		utility.WriteUint32(header, uint32(size+overhead))
+		dst = c.enc.Seal(dst[:len(dst)+frameHeaderLen], frameNonce(c.encSeq), data[:size], header)
+		c.encSeq++
+		data = data[size:]
+		if len(data) == 0 {
+			break
+		}
+	}
+	return dst
+}
+
+//Decode decrypt the first frame of data in place. It returns the number of bytes
+//consumed and the payload, the size is 0 when the frame is not complete yet. On
+//the server the first call also takes the hello of the client
+func (c *Codec) Decode(data []byte) (int, []byte, error) {
+	if c.dec == nil {
+		if len(data) < helloLen {
+			return 0, nil, nil
+		}
+		if err := c.acceptHello(data[:helloLen]); err != nil {
+			return 0, nil, err
+		}
+	}
+	skip := 0
+	if c.pending {
+		skip = helloLen
+	}
+	frame := data[skip:]
+	if len(frame) < frameHeaderLen {
+		return 0, nil, nil
+	}
+	_, size := utility.ReadUint32(frame)
+	total := frameHeaderLen + int(size)
+	if total > maxFrameLen || int(size) < c.dec.Overhead() {
+		return 0, nil, errInvalidFrame
+	}
+	if len(frame) < total {
+		return 0, nil, nil
+	}
+	sealed := frame[frameHeaderLen:total]
+	payload, err := c.dec.Open(sealed[:0], frameNonce(c.decSeq), sealed, frame[:frameHeaderLen])
+	if err != nil {
+		return 0, nil, errInvalidFrame
+	}
+	c.decSeq++
+	if c.pending {
+		c.pending = false
+		if c.filter != nil && !c.filter.add(c.hello) {
+			return 0, nil, ErrReplay
+		}
+		c.hello = nil
+	}
+	return skip + total, payload, nil
+}
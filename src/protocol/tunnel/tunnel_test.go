@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const testKey = "secret"
+
+//clientStream the hello and the frames of data sent by a new client
+func clientStream(t *testing.T, data ...[]byte) (*Codec, []byte) {
+	c, hello, err := NewClientCodec(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := hello
+	for _, d := range data {
+		stream = append(stream, c.Encode(d)...)
+	}
+	return c, stream
+}
+
+//decodeAll decode the frames of stream fed byte by byte, like a slow network
+func decodeAll(c *Codec, stream []byte) ([][]byte, error) {
+	var out [][]byte
+	start := 0
+	for end := 1; end <= len(stream); end++ {
+		data := append([]byte{}, stream[start:end]...)
+		size, payload, err := c.Decode(data)
+		if err != nil {
+			return out, err
+		}
+		if size > 0 {
+			out = append(out, append([]byte{}, payload...))
+			start += size
+		}
+	}
+	return out, nil
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 2*MaxPayload+10)
+	client, stream := clientStream(t, []byte("hello"), nil, big)
+	server, err := NewServerCodec(testKey, NewReplayFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames, err := decodeAll(server, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bytes.Join(frames, nil)
+	if want := append([]byte("hello"), big...); !bytes.Equal(got, want) || len(frames) != 5 {
+		t.Fatalf("%d frames, %d bytes decoded", len(frames), len(got))
+	}
+	reply, err := decodeAll(client, server.Encode([]byte{StatusOK}))
+	if err != nil || len(reply) != 1 || !bytes.Equal(reply[0], []byte{StatusOK}) {
+		t.Fatalf("reply %v err:%v", reply, err)
+	}
+}
+
+func TestCodecRejects(t *testing.T) {
+	_, stream := clientStream(t, []byte("handshake"), []byte("data"))
+	first := helloLen + frameHeaderLen + len("handshake") + 16
+	flip := func(i int) []byte {
+		s := append([]byte{}, stream...)
+		s[i] ^= 1
+		return s
+	}
+	swapped := append(append([]byte{}, stream[:helloLen]...), stream[first:]...)
+	cases := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"hello time", flip(4), ErrClockSkew},
+		{"hello time in the skew", flip(7), errInvalidFrame},
+		{"hello nonce", flip(helloLen - 1), errInvalidFrame},
+		{"length", flip(helloLen + 3), errInvalidFrame},
+		{"payload", flip(helloLen + frameHeaderLen), errInvalidFrame},
+		{"tag", flip(first - 1), errInvalidFrame},
+		{"second frame", flip(len(stream) - 1), errInvalidFrame},
+		{"reordered", swapped, errInvalidFrame},
+		{"short length", append(append([]byte{}, stream[:helloLen]...), 0, 0, 0, 15), errInvalidFrame},
+		{"long length", append(append([]byte{}, stream[:helloLen]...), 0, 1, 0, 0), errInvalidFrame},
+	}
+	for _, c := range cases {
+		server, _ := NewServerCodec(testKey, NewReplayFilter())
+		if _, err := decodeAll(server, c.stream); err != c.err {
+			t.Errorf("%s: err:%v, %v expected", c.name, err, c.err)
+		}
+	}
+	server, _ := NewServerCodec("other", NewReplayFilter())
+	if _, err := decodeAll(server, stream); err != errInvalidFrame {
+		t.Errorf("wrong key: err:%v", err)
+	}
+}
+
+func TestCodecReplay(t *testing.T) {
+	filter := NewReplayFilter()
+	_, stream := clientStream(t, []byte("handshake"))
+	for i, want := range []error{nil, ErrReplay} {
+		server, _ := NewServerCodec(testKey, filter)
+		if _, err := decodeAll(server, stream); err != want {
+			t.Fatalf("connection %d: err:%v, %v expected", i, err, want)
+		}
+	}
+	//the hello is refused by its time once the filter forgot it
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(3 * MaxClockSkew) }
+	_, other := clientStream(t, []byte("handshake"))
+	server, _ := NewServerCodec(testKey, filter)
+	if _, err := decodeAll(server, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := filter.seen[string(stream[:helloLen])]; ok {
+		t.Fatal("the old hello is still remembered")
+	}
+	server, _ = NewServerCodec(testKey, filter)
+	if _, err := decodeAll(server, stream); err != ErrClockSkew {
+		t.Fatalf("old hello: err:%v", err)
+	}
+}
+
+func TestCodecKey(t *testing.T) {
+	for _, key := range []string{"", string(make([]byte, 257))} {
+		if _, _, err := NewClientCodec(key); err == nil {
+			t.Errorf("client key of %d bytes accepted", len(key))
+		}
+		if _, err := NewServerCodec(key, nil); err == nil {
+			t.Errorf("server key of %d bytes accepted", len(key))
+		}
+	}
+}
+
+func TestParseHandshake(t *testing.T) {
+	full := (&Handshake{Cmd: CmdConnect, User: "alice", Password: "pw", Arg: "example.com:443", Trace: "abc"}).Marshal()
+	noTrace := full[:len(full)-2-len("abc")]
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"full", full, true},
+		{"without trace", noTrace, true},
+		{"empty", nil, false},
+		{"version", append([]byte{Version + 1}, full[1:]...), false},
+		{"only command", full[:2], false},
+		{"truncated length", full[:3], false},
+		{"truncated field", full[:8], false},
+		{"truncated trace", full[:len(full)-1], false},
+	}
+	for _, c := range cases {
+		h, err := ParseHandshake(c.data)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err:%v", c.name, err)
+			continue
+		}
+		if c.ok && (h.User != "alice" || h.Arg != "example.com:443") {
+			t.Errorf("%s: %+v", c.name, h)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package utility
+
+import (
+	"math/bits"
+	"sync"
+)
+
+//the pooled buffers have a capacity of a power of two between 1KB and 4MB,
+//big enough for the data merged from a busy upstream
+const (
+	minBufferShift = 10
+	maxBufferShift = 22
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+//holderPool recycle the pointers stored in bufferPools, so putting a buffer back
+//doesn't allocate
+var holderPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+//bufferClass return the index of the smallest class holding size bytes, -1 if none
+func bufferClass(size int) int {
+	shift := bits.Len(uint(size - 1))
+	if size <= 1 || shift < minBufferShift {
+		return 0
+	}
+	if shift > maxBufferShift {
+		return -1
+	}
+	return shift - minBufferShift
+}
+
+//GetBuffer return a buffer of length size. Buffers larger than the biggest
+//class are allocated and never pooled
+func GetBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class < 0 {
+		return make([]byte, size)
+	}
+	if h, ok := bufferPools[class].Get().(*[]byte); ok {
+		b := *h
+		*h = nil
+		holderPool.Put(h)
+		return b[:size]
+	}
+	return make([]byte, size, 1<<(class+minBufferShift))
+}
+
+//PutBuffer give a buffer back to the pool, it must not be used afterwards.
+//Buffers not obtained from GetBuffer are dropped unless their capacity is a class
+func PutBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class < 0 || 1<<(class+minBufferShift) != cap(b) {
+		return
+	}
+	h := holderPool.Get().(*[]byte)
+	*h = b[:0]
+	bufferPools[class].Put(h)
+}
+
+//AppendBuffer append src to the pooled buffer dst. When dst is full it's replaced
+//by a bigger pooled buffer and given back to the pool
+func AppendBuffer(dst, src []byte) []byte {
+	need := len(dst) + len(src)
+	if need <= cap(dst) {
+		return append(dst, src...)
+	}
+	size := 2 * cap(dst)
+	if size < need {
+		size = need
+	}
+	b := GetBuffer(size)[:need]
+	copy(b, dst)
+	copy(b[len(dst):], src)
+	PutBuffer(dst)
+	return b
+}
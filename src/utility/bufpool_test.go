@@ -0,0 +1,46 @@
+package utility
+
+import "testing"
+
+func BenchmarkBuffer(b *testing.B) {
+	for _, size := range []int{1500, 32 << 10} {
+		b.Run(Format("make-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := make([]byte, size)
+					buf[0] = 1
+				}
+			})
+		})
+		b.Run(Format("pool-%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					buf := GetBuffer(size)
+					buf[0] = 1
+					PutBuffer(buf)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkAppendBuffer(b *testing.B) {
+	msg := make([]byte, 1500)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var out []byte
+		for j := 0; j < 16; j++ {
+			part := GetBuffer(len(msg))
+			copy(part, msg)
+			if out == nil {
+				out = part
+				continue
+			}
+			out = AppendBuffer(out, part)
+			PutBuffer(part)
+		}
+		PutBuffer(out)
+	}
+}
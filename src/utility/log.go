@@ -16,6 +16,7 @@ type LogModule struct {
 	lock             *sync.Mutex
 	msgChan          chan *logMsg
 	exitChan         chan bool
+	exitDone         chan bool
 	level            uint32
 	file             *os.File
 	logFile          string
@@ -90,6 +91,7 @@ func NewLog(logFile string, logLevel string, limit int, path string) *LogModule
 		lock:             new(sync.Mutex),
 		msgChan:          make(chan *logMsg, 1024),
 		exitChan:         make(chan bool, 1),
+		exitDone:         make(chan bool),
 		level:            level,
 		file:             file,
 		limit:            limit,
@@ -143,9 +145,25 @@ func (l *LogModule) Log(level uint32, format string, v ...interface{}) {
 	l.msgChan <- msg
 }
 
-//LogExit notify log module exit
+//Exit write the queued messages, close the log file and stop the log module.
+//It returns after the file is closed, nothing may be logged afterwards
 func (l *LogModule) Exit() {
 	l.exitChan <- true
+	<-l.exitDone
+}
+
+//flush write the messages still queued
+func (c *LogModule) flush() {
+	for {
+		select {
+		case msg := <-c.msgChan:
+			if msg.level >= c.level {
+				c.log.Print(msg.data)
+			}
+		default:
+			return
+		}
+	}
 }
 
 //SendSignal notify log some event
@@ -184,15 +202,17 @@ func (c *LogModule) output() {
 	for {
 		select {
 		case <-c.exitChan:
+			c.flush()
 			c.log.Printf("log module exit cleanly")
 			c.file.Close()
+			close(c.exitDone)
 			return
 		case msg := <-c.msgChan:
 			c.lineNumber += 2
 			if msg.level == logLevelFatal {
 				c.log.Fatal(msg.data)
 			} else if msg.level >= c.level {
-				c.log.Printf(msg.data)
+				c.log.Print(msg.data)
 			}
 			if c.lineNumber < c.limit {
 				continue
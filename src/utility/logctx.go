@@ -1,11 +1,14 @@
 package utility
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"sync/atomic"
 )
 type LogContext struct {
 	id uint32
 	*LogModule
 	handle *LogModule
+	trace  atomic.Value //the prefix of the lines with the trace id
 }
 
 var logID uint32
@@ -16,7 +19,42 @@ func NewLogContext(id uint32, log *LogModule) *LogContext {
 	if id == 0{
 		id = atomic.AddUint32(&logID, 1)
 	}
-	return &LogContext{id, log, log}
+	return &LogContext{id: id, LogModule: log, handle: log}
+}
+
+//NewTraceID return a random id following a session through the processes it crosses
+func NewTraceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//IsTraceID check a trace id received from a peer before it goes into the logs
+func IsTraceID(id string) bool {
+	if len(id) == 0 || len(id) > 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+//SetTrace tag the following lines with the trace id
+func (l *LogContext) SetTrace(id string) {
+	l.trace.Store("[trace:" + id + "] ")
+}
+
+//Trace return the trace id set on the context, empty without one
+func (l *LogContext) Trace() string {
+	prefix := l.tracePrefix()
+	if prefix == "" {
+		return ""
+	}
+	return prefix[len("[trace:") : len(prefix)-len("] ")]
+}
+
+func (l *LogContext) tracePrefix() string {
+	prefix, _ := l.trace.Load().(string)
+	return prefix
 }
 
 func (l *LogContext) GetID()uint32{
@@ -26,20 +64,20 @@ func (l *LogContext) GetID()uint32{
 
 //LogDebug output debug level information
 func (l *LogContext) LogDebug(format string, v ...interface{}) {
-	l.Log(logLevelDebug|(l.id<<constLogLevelShift), format, v...)
+	l.Log(logLevelDebug|(l.id<<constLogLevelShift), l.tracePrefix()+format, v...)
 }
 
 //LogInfo output debug level information
 func (l *LogContext) LogInfo(format string, v ...interface{}) {
-	l.Log(logLevelInfo|(l.id<<constLogLevelShift), format, v...)
+	l.Log(logLevelInfo|(l.id<<constLogLevelShift), l.tracePrefix()+format, v...)
 }
 
 //LogWarn output warning level information
 func (l *LogContext) LogWarn(format string, v ...interface{}) {
-	l.Log(logLeveLWarn|(l.id<<constLogLevelShift), format, v...)
+	l.Log(logLeveLWarn|(l.id<<constLogLevelShift), l.tracePrefix()+format, v...)
 }
 
 //LogFatal output debug level information
 func (l *LogContext) LogFatal(format string, v ...interface{}) {
-	l.Log(logLevelFatal|(l.id<<constLogLevelShift), format, v...)
+	l.Log(logLevelFatal|(l.id<<constLogLevelShift), l.tracePrefix()+format, v...)
 }
@@ -0,0 +1,46 @@
+package utility
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsTraceID(t *testing.T) {
+	cases := []struct {
+		id string
+		ok bool
+	}{
+		{NewTraceID(), true},
+		{"0123456789abcdef", true},
+		{"ABCDEF01", true},
+		{"00", true},
+		{strings.Repeat("ab", 16), true},
+		{"", false},
+		{"0", false},
+		{"abc", false},
+		{strings.Repeat("ab", 17), false},
+		{"0123456789abcdeg", false},
+		{"01 3", false},
+		{"0a\n[trace:x] ", false},
+		{"0a\x00b", false},
+	}
+	for _, c := range cases {
+		if IsTraceID(c.id) != c.ok {
+			t.Errorf("%q: %v expected", c.id, c.ok)
+		}
+	}
+	if a, b := NewTraceID(), NewTraceID(); len(a) != 16 || a == b {
+		t.Fatalf("trace ids %s %s", a, b)
+	}
+}
+
+func TestLogContextTrace(t *testing.T) {
+	l := NewLogContext(0, nil)
+	if trace := l.Trace(); trace != "" {
+		t.Fatalf("trace %q without one set", trace)
+	}
+	l.SetTrace("0a1b")
+	if trace := l.Trace(); trace != "0a1b" {
+		t.Fatalf("trace %q", trace)
+	}
+}
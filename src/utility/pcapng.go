@@ -0,0 +1,206 @@
+package utility
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapBlockSection   = 0x0A0D0D0A
+	pcapBlockInterface = 1
+	pcapBlockPacket    = 6
+	pcapByteOrderMagic = 0x1A2B3C4D
+	//pcapLinkRaw the packets start with their ipv4 or ipv6 header
+	pcapLinkRaw = 101
+)
+
+//PcapWriter write ip packets to a pcapng stream with one raw ip interface,
+//the timestamps are in microseconds
+type PcapWriter struct {
+	w io.Writer
+}
+
+//NewPcapWriter write the section header and the interface description
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	le := binary.LittleEndian
+	head := make([]byte, 28+20)
+	le.PutUint32(head[0:], pcapBlockSection)
+	le.PutUint32(head[4:], 28)
+	le.PutUint32(head[8:], pcapByteOrderMagic)
+	le.PutUint16(head[12:], 1)
+	le.PutUint16(head[14:], 0)
+	le.PutUint64(head[16:], ^uint64(0)) //the section length isn't known
+	le.PutUint32(head[24:], 28)
+	idb := head[28:]
+	le.PutUint32(idb[0:], pcapBlockInterface)
+	le.PutUint32(idb[4:], 20)
+	le.PutUint16(idb[8:], pcapLinkRaw)
+	le.PutUint32(idb[12:], 0) //no snap length
+	le.PutUint32(idb[16:], 20)
+	if _, err := w.Write(head); err != nil {
+		return nil, err
+	}
+	return &PcapWriter{w: w}, nil
+}
+
+//WritePacket write an enhanced packet block
+func (p *PcapWriter) WritePacket(ts time.Time, packet []byte) (int, error) {
+	le := binary.LittleEndian
+	padded := (len(packet) + 3) &^ 3
+	total := 28 + padded + 4
+	blk := make([]byte, total)
+	micros := uint64(ts.UnixNano() / 1000)
+	le.PutUint32(blk[0:], pcapBlockPacket)
+	le.PutUint32(blk[4:], uint32(total))
+	le.PutUint32(blk[8:], 0)
+	le.PutUint32(blk[12:], uint32(micros>>32))
+	le.PutUint32(blk[16:], uint32(micros))
+	le.PutUint32(blk[20:], uint32(len(packet)))
+	le.PutUint32(blk[24:], uint32(len(packet)))
+	copy(blk[28:], packet)
+	le.PutUint32(blk[total-4:], uint32(total))
+	return p.w.Write(blk)
+}
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpRst = 0x04
+	tcpPsh = 0x08
+	tcpAck = 0x10
+	//tcpMaxSegment the most data put in one synthesized packet
+	tcpMaxSegment = 16384
+)
+
+//TCPFlow synthesize the packets of a tcp connection from the byte stream it
+//carries, so a stream seen above the sockets can be read by the packet tools.
+//Side 0 opens the connection
+type TCPFlow struct {
+	ip   [2]net.IP
+	port [2]int
+	seq  [2]uint32
+	v6   bool
+}
+
+//NewTCPFlow create the flow between client and server, a nil address is 0.0.0.0:0
+func NewTCPFlow(client, server *net.TCPAddr) *TCPFlow {
+	f := &TCPFlow{seq: [2]uint32{0x10000, 0x20000}}
+	for i, addr := range []*net.TCPAddr{client, server} {
+		f.ip[i] = net.IPv4zero
+		if addr != nil && addr.IP != nil {
+			f.ip[i], f.port[i] = addr.IP, addr.Port
+		}
+		if f.ip[i].To4() == nil {
+			f.v6 = true
+		}
+	}
+	for i := range f.ip {
+		if f.v6 {
+			f.ip[i] = f.ip[i].To16()
+		} else {
+			f.ip[i] = f.ip[i].To4()
+		}
+	}
+	return f
+}
+
+//Open return the packets of the three way handshake
+func (f *TCPFlow) Open() [][]byte {
+	syn := f.packet(0, tcpSyn, nil)
+	f.seq[0]++
+	synAck := f.packet(1, tcpSyn|tcpAck, nil)
+	f.seq[1]++
+	return [][]byte{syn, synAck, f.packet(0, tcpAck, nil)}
+}
+
+//Data return the segments carrying data sent by side
+func (f *TCPFlow) Data(side int, data []byte) [][]byte {
+	var packets [][]byte
+	for len(data) > 0 {
+		size := len(data)
+		if size > tcpMaxSegment {
+			size = tcpMaxSegment
+		}
+		packets = append(packets, f.packet(side, tcpPsh|tcpAck, data[:size]))
+		f.seq[side] += uint32(size)
+		data = data[size:]
+	}
+	return packets
+}
+
+//Close return the FIN of side then the FIN of the other side
+func (f *TCPFlow) Close(side int) [][]byte {
+	other := 1 - side
+	fin := f.packet(side, tcpFin|tcpAck, nil)
+	f.seq[side]++
+	finBack := f.packet(other, tcpFin|tcpAck, nil)
+	f.seq[other]++
+	return [][]byte{fin, finBack, f.packet(side, tcpAck, nil)}
+}
+
+//Reset return the RST sent by side
+func (f *TCPFlow) Reset(side int) [][]byte {
+	return [][]byte{f.packet(side, tcpRst|tcpAck, nil)}
+}
+
+//packet build the ip and tcp headers of a segment sent by side
+func (f *TCPFlow) packet(side int, flags byte, payload []byte) []byte {
+	be := binary.BigEndian
+	other := 1 - side
+	ipLen := 20
+	if f.v6 {
+		ipLen = 40
+	}
+	tcpLen := 20 + len(payload)
+	pkt := make([]byte, ipLen+tcpLen)
+	src, dst := f.ip[side], f.ip[other]
+	if f.v6 {
+		pkt[0] = 0x60
+		be.PutUint16(pkt[4:], uint16(tcpLen))
+		pkt[6] = 6 //tcp
+		pkt[7] = 64
+		copy(pkt[8:], src)
+		copy(pkt[24:], dst)
+	} else {
+		pkt[0] = 0x45
+		be.PutUint16(pkt[2:], uint16(ipLen+tcpLen))
+		be.PutUint16(pkt[6:], 0x4000) //don't fragment
+		pkt[8] = 64
+		pkt[9] = 6
+		copy(pkt[12:], src)
+		copy(pkt[16:], dst)
+		be.PutUint16(pkt[10:], ^checksum(0, pkt[:20]))
+	}
+	tcp := pkt[ipLen:]
+	be.PutUint16(tcp[0:], uint16(f.port[side]))
+	be.PutUint16(tcp[2:], uint16(f.port[other]))
+	be.PutUint32(tcp[4:], f.seq[side])
+	if flags&tcpAck != 0 {
+		be.PutUint32(tcp[8:], f.seq[other])
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	be.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	//the pseudo header: the addresses, the protocol and the tcp length
+	sum := uint32(checksum(0, src))
+	sum = uint32(checksum(sum, dst)) + 6 + uint32(tcpLen)
+	be.PutUint16(tcp[16:], ^checksum(sum, tcp))
+	return pkt
+}
+
+//checksum add data to the ones' complement sum, the result is folded to 16 bits
+func checksum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,169 @@
+package utility
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type pcapBlock struct {
+	kind uint32
+	body []byte
+}
+
+//readBlocks split a pcapng stream in its blocks, checking the lengths at both
+//ends and the alignment
+func readBlocks(t *testing.T, data []byte) []pcapBlock {
+	le := binary.LittleEndian
+	var blocks []pcapBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%d bytes left after the last block", len(data))
+		}
+		total := int(le.Uint32(data[4:]))
+		if total%4 != 0 || total < 12 || total > len(data) || int(le.Uint32(data[total-4:])) != total {
+			t.Fatalf("block of %d bytes in %d", total, len(data))
+		}
+		blocks = append(blocks, pcapBlock{le.Uint32(data), data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestPcapWriter(t *testing.T) {
+	le := binary.LittleEndian
+	var out bytes.Buffer
+	p, err := NewPcapWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	sizes := []int{0, 1, 2, 3, 4, 5, 1500}
+	for _, size := range sizes {
+		if _, err := p.WritePacket(ts, bytes.Repeat([]byte{0xab}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blocks := readBlocks(t, out.Bytes())
+	if len(blocks) != 2+len(sizes) {
+		t.Fatalf("%d blocks", len(blocks))
+	}
+	if b := blocks[0]; b.kind != pcapBlockSection || le.Uint32(b.body) != pcapByteOrderMagic {
+		t.Fatalf("section header %+v", b)
+	}
+	if b := blocks[1]; b.kind != pcapBlockInterface || le.Uint16(b.body) != pcapLinkRaw {
+		t.Fatalf("interface %+v", b)
+	}
+	for i, size := range sizes {
+		b := blocks[2+i]
+		micros := uint64(le.Uint32(b.body[4:]))<<32 | uint64(le.Uint32(b.body[8:]))
+		captured, length := int(le.Uint32(b.body[12:])), int(le.Uint32(b.body[16:]))
+		data := b.body[20:]
+		if b.kind != pcapBlockPacket || micros != 1700000000123456 || captured != size || length != size {
+			t.Errorf("packet of %d bytes: kind %d time %d lengths %d %d", size, b.kind, micros, captured, length)
+			continue
+		}
+		if len(data) != (size+3)&^3 || !bytes.Equal(data[:size], bytes.Repeat([]byte{0xab}, size)) || bytes.Count(data[size:], []byte{0}) != len(data)-size {
+			t.Errorf("packet of %d bytes: data %x", size, data)
+		}
+	}
+}
+
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestPcapWriterError(t *testing.T) {
+	if _, err := NewPcapWriter(failWriter{}); err == nil {
+		t.Fatal("header written to a failing writer")
+	}
+	p := &PcapWriter{w: failWriter{}}
+	if _, err := p.WritePacket(time.Now(), []byte{1}); err == nil {
+		t.Fatal("packet written to a failing writer")
+	}
+}
+
+//checkPacket verify the checksums of a synthesized packet and return its
+//sequence number, flags and payload
+func checkPacket(t *testing.T, pkt []byte, v6 bool) (uint32, byte, []byte) {
+	be := binary.BigEndian
+	ipLen, src, dst := 20, pkt[12:16], pkt[16:20]
+	if v6 {
+		ipLen, src, dst = 40, pkt[8:24], pkt[24:40]
+		if pkt[0] != 0x60 || int(be.Uint16(pkt[4:])) != len(pkt)-ipLen {
+			t.Fatalf("ipv6 header %x", pkt[:ipLen])
+		}
+	} else if pkt[0] != 0x45 || int(be.Uint16(pkt[2:])) != len(pkt) || checksum(0, pkt[:20]) != 0xffff {
+		t.Fatalf("ipv4 header %x", pkt[:ipLen])
+	}
+	tcp := pkt[ipLen:]
+	sum := uint32(checksum(0, src))
+	sum = uint32(checksum(sum, dst)) + 6 + uint32(len(tcp))
+	if checksum(sum, tcp) != 0xffff {
+		t.Fatalf("tcp checksum of %x", tcp[:20])
+	}
+	return be.Uint32(tcp[4:]), tcp[13], tcp[20:]
+}
+
+func TestTCPFlow(t *testing.T) {
+	cases := []struct {
+		name           string
+		client, server *net.TCPAddr
+		v6             bool
+	}{
+		{"ipv4", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}, false},
+		{"ipv6", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, true},
+		{"mixed", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, true},
+		{"unknown client", nil, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}, false},
+	}
+	upload := bytes.Repeat([]byte("u"), 2*tcpMaxSegment+7)
+	for _, c := range cases {
+		f := NewTCPFlow(c.client, c.server)
+		var packets [][]byte
+		packets = append(packets, f.Open()...)
+		packets = append(packets, f.Data(0, upload)...)
+		packets = append(packets, f.Data(1, []byte("odd"))...)
+		packets = append(packets, f.Data(1, nil)...)
+		packets = append(packets, f.Close(1)...)
+		packets = append(packets, f.Reset(0)...)
+		want := []struct {
+			seq   uint32
+			flags byte
+			size  int
+		}{
+			{0x10000, tcpSyn, 0},
+			{0x20000, tcpSyn | tcpAck, 0},
+			{0x10001, tcpAck, 0},
+			{0x10001, tcpPsh | tcpAck, tcpMaxSegment},
+			{0x10001 + tcpMaxSegment, tcpPsh | tcpAck, tcpMaxSegment},
+			{0x10001 + 2*tcpMaxSegment, tcpPsh | tcpAck, 7},
+			{0x20001, tcpPsh | tcpAck, 3},
+			{0x20004, tcpFin | tcpAck, 0},
+			{0x10001 + uint32(len(upload)), tcpFin | tcpAck, 0},
+			{0x20005, tcpAck, 0},
+			{0x10002 + uint32(len(upload)), tcpRst | tcpAck, 0},
+		}
+		if len(packets) != len(want) {
+			t.Errorf("%s: %d packets", c.name, len(packets))
+			continue
+		}
+		var got []byte
+		for i, pkt := range packets {
+			seq, flags, payload := checkPacket(t, pkt, c.v6)
+			if seq != want[i].seq || flags != want[i].flags || len(payload) != want[i].size {
+				t.Errorf("%s packet %d: seq %#x flags %#x %d bytes", c.name, i, seq, flags, len(payload))
+			}
+			if i >= 3 && i < 6 {
+				got = append(got, payload...)
+			}
+		}
+		if !bytes.Equal(got, upload) {
+			t.Errorf("%s: the segments carry %d bytes", c.name, len(got))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package utility
+
+import (
+	"sync"
+	"time"
+)
+
+//TokenBucket limit the rate of a byte stream. A nil bucket never limits
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//NewTokenBucket create a bucket refilled with rate bytes per second and holding
+//at most burst bytes. It returns nil when rate is not positive
+func NewTokenBucket(rate, burst int64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+//Reserve take n tokens, the bucket may go into debt. It returns how long the
+//caller must wait before the tokens are really available
+func (b *TokenBucket) Reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+//WaitTokens take n tokens from every bucket and sleep until the slowest one allows it.
+//It returns the time slept
+func WaitTokens(n int, buckets ...*TokenBucket) time.Duration {
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.Reserve(n); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return wait
+}
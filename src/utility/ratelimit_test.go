@@ -0,0 +1,67 @@
+package utility
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewTokenBucket(t *testing.T) {
+	if NewTokenBucket(0, 10) != nil || NewTokenBucket(-1, 10) != nil {
+		t.Fatal("a bucket without rate limits")
+	}
+	if b := NewTokenBucket(100, 0); b.burst != 100 || b.tokens != 100 {
+		t.Fatalf("default burst %v tokens %v", b.burst, b.tokens)
+	}
+	var b *TokenBucket
+	if w := b.Reserve(1 << 30); w != 0 {
+		t.Fatalf("nil bucket waits %v", w)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	type step struct {
+		elapsed time.Duration //since the previous step
+		n       int
+		wait    time.Duration
+	}
+	cases := []struct {
+		name        string
+		rate, burst int64
+		steps       []step
+	}{
+		{"within burst", 1000, 500, []step{{0, 200, 0}, {0, 300, 0}}},
+		{"debt", 1000, 500, []step{{0, 500, 0}, {0, 250, 250 * time.Millisecond}, {0, 250, 500 * time.Millisecond}}},
+		{"refill", 1000, 500, []step{{0, 500, 0}, {200 * time.Millisecond, 200, 0}, {0, 100, 100 * time.Millisecond}}},
+		{"refill capped by burst", 1000, 500, []step{{0, 500, 0}, {time.Hour, 600, 100 * time.Millisecond}}},
+		{"debt repaid", 1000, 1000, []step{{0, 3000, 2 * time.Second}, {2 * time.Second, 0, 0}, {0, 1, time.Millisecond}}},
+		{"zero", 10, 10, []step{{0, 0, 0}, {0, 10, 0}, {0, 0, 0}}},
+	}
+	const slack = 20 * time.Millisecond
+	for _, c := range cases {
+		b := NewTokenBucket(c.rate, c.burst)
+		for i, s := range c.steps {
+			b.last = b.last.Add(-s.elapsed)
+			w := b.Reserve(s.n)
+			//the time running during the test only shortens the waits
+			if w > s.wait || w < s.wait-slack {
+				t.Errorf("%s step %d: wait %v, %v expected", c.name, i, w, s.wait)
+			}
+		}
+	}
+}
+
+func TestWaitTokens(t *testing.T) {
+	//big holds enough tokens and refills too slowly to matter during the test
+	big, slow := NewTokenBucket(1, 100), NewTokenBucket(1000, 10)
+	if w := WaitTokens(10, big, nil, slow); w != 0 {
+		t.Fatalf("waited %v within the burst", w)
+	}
+	start := time.Now()
+	w := WaitTokens(20, big, nil, slow)
+	if w < 15*time.Millisecond || time.Since(start) < w {
+		t.Fatalf("waited %v for the slowest bucket, slept %v", w, time.Since(start))
+	}
+	if big.tokens > 71 {
+		t.Fatalf("the big bucket kept %v tokens", big.tokens)
+	}
+}